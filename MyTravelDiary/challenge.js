@@ -0,0 +1,78 @@
+// 留言和昵称认领、登录的人机验证：向服务器领取工作量证明挑战并在浏览器中求解
+// 找到 nonce 使 SHA-256(challenge + ":" + nonce) 的前导零比特数不少于 difficulty
+// 页面可能通过 http 访问，crypto.subtle 不可用，这里自带一个 SHA-256 实现
+(function() {
+    var K = [
+        0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+        0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+        0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+        0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+        0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+        0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+        0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+        0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+    ];
+    var W = new Int32Array(64);
+
+    // sha256Words 计算 ASCII 字符串的 SHA-256，返回 8 个 32 位整数
+    function sha256Words(str) {
+        var len = str.length;
+        var blocks = ((len + 8) >> 6) + 1;
+        var m = new Int32Array(blocks * 16);
+        for (var i = 0; i < len; i++) {
+            m[i >> 2] |= (str.charCodeAt(i) & 0xff) << (24 - (i & 3) * 8);
+        }
+        m[len >> 2] |= 0x80 << (24 - (len & 3) * 8);
+        m[blocks * 16 - 1] = len * 8;
+        var h0 = 0x6a09e667, h1 = 0xbb67ae85, h2 = 0x3c6ef372, h3 = 0xa54ff53a;
+        var h4 = 0x510e527f, h5 = 0x9b05688c, h6 = 0x1f83d9ab, h7 = 0x5be0cd19;
+        for (var b = 0; b < m.length; b += 16) {
+            var a = h0, c1 = h1, c2 = h2, d = h3, e = h4, f = h5, g = h6, h = h7;
+            for (var t = 0; t < 64; t++) {
+                if (t < 16) {
+                    W[t] = m[b + t];
+                } else {
+                    var x = W[t - 15], y = W[t - 2];
+                    var s0 = ((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3);
+                    var s1 = ((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10);
+                    W[t] = (W[t - 16] + s0 + W[t - 7] + s1) | 0;
+                }
+                var S1 = ((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7));
+                var t1 = (h + S1 + ((e & f) ^ (~e & g)) + K[t] + W[t]) | 0;
+                var S0 = ((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10));
+                var t2 = (S0 + ((a & c1) ^ (a & c2) ^ (c1 & c2))) | 0;
+                h = g; g = f; f = e; e = (d + t1) | 0;
+                d = c2; c2 = c1; c1 = a; a = (t1 + t2) | 0;
+            }
+            h0 = (h0 + a) | 0; h1 = (h1 + c1) | 0; h2 = (h2 + c2) | 0; h3 = (h3 + d) | 0;
+            h4 = (h4 + e) | 0; h5 = (h5 + f) | 0; h6 = (h6 + g) | 0; h7 = (h7 + h) | 0;
+        }
+        return [h0, h1, h2, h3, h4, h5, h6, h7];
+    }
+
+    function leadingZeroBits(words) {
+        var n = 0;
+        for (var i = 0; i < words.length; i++) {
+            if (words[i] !== 0) return n + Math.clz32(words[i]);
+            n += 32;
+        }
+        return n;
+    }
+
+    // solveCommentChallenge 领取并求解挑战，返回 { challenge, nonce }，baseURL 为空时使用当前站点
+    window.solveCommentChallenge = async function(baseURL) {
+        var response = await fetch((baseURL || '') + '/comments/challenge', { cache: 'no-store' });
+        if (!response.ok) throw new Error('HTTP ' + response.status);
+        var task = await response.json();
+        var prefix = task.challenge + ':';
+        for (var nonce = 0; ; nonce++) {
+            if (leadingZeroBits(sha256Words(prefix + nonce)) >= task.difficulty) {
+                return { challenge: task.challenge, nonce: String(nonce) };
+            }
+            // 每算一批让出主线程，避免页面卡住
+            if (nonce % 20000 === 19999) {
+                await new Promise(function(resolve) { setTimeout(resolve, 0); });
+            }
+        }
+    };
+})();
@@ -1,17 +1,50 @@
 package main
 
 import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/hmac"
+    "crypto/pbkdf2"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
     "encoding/json"
+    "encoding/xml"
+    "errors"
+    "flag"
     "fmt"
+    "html"
+    "html/template"
+    "image"
+    "image/draw"
+    _ "image/gif"
+    "image/jpeg"
+    "image/png"
     "io"
     "log"
+    "math"
+    "math/bits"
     "net"
     "net/http"
+    "net/mail"
+    "net/smtp"
+    "net/url"
     "os"
+    "path"
     "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
     "strings"
     "sync"
     "time"
+    "unicode"
+    "unicode/utf8"
 )
 
 // AccessRecord 结构
@@ -28,6 +61,9 @@ type AccessRecord struct {
     PagesVisited  []string  `json:"pages_visited"`
     Blocked       bool      `json:"blocked"`
     BlockReason   string    `json:"block_reason,omitempty"`
+    BotClass      string    `json:"bot_class,omitempty"`
+    BotName       string    `json:"bot_name,omitempty"`
+    BotVerified   bool      `json:"bot_verified,omitempty"`
 }
 
 // IPGeolocation 结构
@@ -54,83 +90,7516 @@ type Comment struct {
     ID    int       `json:"id"`
     Nick  string    `json:"nick"`
     Text  string    `json:"text"`
+    // 由 Text 渲染并净化后的 HTML
+    HTML  string    `json:"html"`
     Date  time.Time `json:"date"`
+    // 通过昵称认证发布的留言
+    Verified bool   `json:"verified,omitempty"`
+    // 站长本人发布的留言
+    Owner    bool   `json:"owner,omitempty"`
+    // 留言附带的图片
+    Images   []CommentImage `json:"images,omitempty"`
+    // 等待管理员审核，审核通过前不公开
+    Pending  bool   `json:"pending,omitempty"`
 }
 
+// CommentImage 留言附带的图片，文件名为重新编码后内容的哈希
+type CommentImage struct {
+    Name   string `json:"name"`
+    URL    string `json:"url"`
+    Thumb  string `json:"thumb"`
+    Width  int    `json:"width"`
+    Height int    `json:"height"`
+}
+
+// DiaryEntry 日记条目
+type DiaryEntry struct {
+    ID        int       `json:"id"`
+    City      string    `json:"city"`
+    Title     string    `json:"title"`
+    Body      string    `json:"body"`
+    StartDate string    `json:"start_date,omitempty"`
+    EndDate   string    `json:"end_date,omitempty"`
+    Cover     string    `json:"cover,omitempty"`
+    Tags      []string  `json:"tags"`
+    Status    string    `json:"status"`
+    Author    string    `json:"author"`
+    Revision  int       `json:"revision"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DiaryRevision 日记的一次历史版本
+type DiaryRevision struct {
+    Revision int        `json:"revision"`
+    Editor   string     `json:"editor"`
+    Date     time.Time  `json:"date"`
+    Entry    DiaryEntry `json:"entry"`
+}
+
+// diaryStore 日记持久化文件的结构
+type diaryStore struct {
+    NextID    int                     `json:"next_id"`
+    Entries   []*DiaryEntry           `json:"entries"`
+    Revisions map[int][]DiaryRevision `json:"revisions"`
+}
+
+// diaryEntryInput 创建和修改日记时的请求体
+type diaryEntryInput struct {
+    City      string   `json:"city"`
+    Title     string   `json:"title"`
+    Body      string   `json:"body"`
+    StartDate string   `json:"start_date"`
+    EndDate   string   `json:"end_date"`
+    Cover     string   `json:"cover"`
+    Tags      []string `json:"tags"`
+    Status    string   `json:"status"`
+}
+
+// ServerConfig 结构
+type ServerConfig struct {
+    SecurityHeaders SecurityHeadersConfig `json:"security_headers"`
+    CORS            CORSConfig            `json:"cors"`
+    Server          ServerLimitsConfig    `json:"server"`
+    Static          StaticConfig          `json:"static"`
+    Compression     CompressionConfig     `json:"compression"`
+    Cache           CacheConfig           `json:"cache"`
+    Images          ImageConfig           `json:"images"`
+    Photos          PhotoConfig           `json:"photos"`
+    Gallery         GalleryConfig         `json:"gallery"`
+    Admin           AdminConfig           `json:"admin"`
+    Upload          UploadConfig          `json:"upload"`
+    Music           MusicConfig           `json:"music"`
+    Cities          []CityInfo            `json:"cities"`
+    Render          RenderConfig          `json:"render"`
+    Feed            FeedConfig            `json:"feed"`
+    SEO             SEOConfig             `json:"seo"`
+    Bots            BotConfig             `json:"bots"`
+    Search          SearchConfig          `json:"search"`
+    Notify          NotifyConfig          `json:"notify"`
+    Identity        IdentityConfig        `json:"identity"`
+    Attachments     AttachmentConfig      `json:"attachments"`
+    Challenge       ChallengeConfig       `json:"challenge"`
+}
+
+// ChallengeConfig 匿名留言以及昵称认领、登录的工作量证明配置
+type ChallengeConfig struct {
+    Enabled       bool `json:"enabled"`
+    // 基础难度：SHA-256 结果需要的前导零比特数
+    Difficulty    int  `json:"difficulty"`
+    MaxDifficulty int  `json:"max_difficulty"`
+    TTLSeconds    int  `json:"ttl_seconds"`
+    // 统计窗口内每多 StepComments 次匿名留言或认领登录提交，难度加 1
+    WindowMinutes int  `json:"window_minutes"`
+    StepComments  int  `json:"step_comments"`
+}
+
+// AttachmentConfig 留言图片附件配置
+type AttachmentConfig struct {
+    Enabled           bool   `json:"enabled"`
+    // 保存目录，不能位于静态目录下，只能通过 /comments/{city}/images/ 访问
+    Dir               string `json:"dir"`
+    MaxImages         int    `json:"max_images"`
+    MaxFileBytes      int64  `json:"max_file_bytes"`
+    MaxPixels         int    `json:"max_pixels"`
+    // 重新编码时长边的上限
+    MaxDimension      int    `json:"max_dimension"`
+    ThumbWidth        int    `json:"thumb_width"`
+    Quality           int    `json:"quality"`
+    // 带图留言先进入待审核状态
+    HoldForModeration bool   `json:"hold_for_moderation"`
+}
+
+// IdentityConfig 留言昵称认证配置
+type IdentityConfig struct {
+    Enabled           bool        `json:"enabled"`
+    CookieName        string      `json:"cookie_name"`
+    CookieMaxAgeDays  int         `json:"cookie_max_age_days"`
+    // 未认证用户不能使用的昵称，比较时忽略大小写、空白和标点
+    ReservedNicks     []string    `json:"reserved_nicks"`
+    // 站长昵称，只能凭管理员令牌认领；管理员令牌的名称也视为站长昵称
+    OwnerNicks        []string    `json:"owner_nicks"`
+    MinPasswordLength int         `json:"min_password_length"`
+    MagicLinkMinutes  int         `json:"magic_link_minutes"`
+    // 每个 IP 15 分钟内最多提交的认领、登录和登录链接请求数，0 表示不限制
+    MaxAttemptsPerIP  int         `json:"max_attempts_per_ip"`
+    // 发送登录链接的邮件服务器，只使用其中的服务器和发件人设置
+    Mailer            EmailConfig `json:"mailer"`
+}
+
+// NickAccount 已认领的昵称
+type NickAccount struct {
+    Nick         string    `json:"nick"`
+    PasswordHash string    `json:"password_hash,omitempty"`
+    Salt         string    `json:"salt,omitempty"`
+    Email        string    `json:"email,omitempty"`
+    // 绑定邮箱后需要通过登录链接确认
+    EmailVerified bool     `json:"email_verified"`
+    Owner        bool      `json:"owner"`
+    CreatedAt    time.Time `json:"created_at"`
+}
+
+// identityStore 昵称认证的持久化结构，Secret 用于签名 Cookie
+type identityStore struct {
+    Secret   string                  `json:"secret"`
+    Accounts map[string]*NickAccount `json:"accounts"`
+}
+
+// magicLink 一个尚未使用的登录链接
+type magicLink struct {
+    key     string
+    expires time.Time
+    // 只凭邮箱认领时，账号在确认前只保存在这里
+    claim   *NickAccount
+}
+
+// NotifyConfig 新留言通知配置
+type NotifyConfig struct {
+    Enabled               bool            `json:"enabled"`
+    Webhooks              []WebhookConfig `json:"webhooks"`
+    Emails                []EmailConfig   `json:"emails"`
+    // 汇总模式下合并发送的间隔
+    DigestIntervalMinutes int             `json:"digest_interval_minutes"`
+    MaxRetries            int             `json:"max_retries"`
+    // 第 n 次重试前等待 retry_base_seconds * 2^(n-1) 秒，最长一小时
+    RetryBaseSeconds      int             `json:"retry_base_seconds"`
+    QueueSize             int             `json:"queue_size"`
+}
+
+// WebhookConfig JSON Webhook 通知渠道，请求体使用 Secret 做 HMAC-SHA256 签名
+type WebhookConfig struct {
+    Name   string   `json:"name"`
+    URL    string   `json:"url"`
+    Secret string   `json:"secret"`
+    // 订阅的城市，为空表示全部城市
+    Cities []string `json:"cities"`
+    Digest bool     `json:"digest"`
+}
+
+// EmailConfig SMTP 邮件通知渠道
+type EmailConfig struct {
+    Name        string   `json:"name"`
+    Host        string   `json:"host"`
+    Port        int      `json:"port"`
+    Username    string   `json:"username"`
+    Password    string   `json:"password"`
+    // 465 端口等直接使用 TLS 连接的服务器；否则服务器支持时自动 STARTTLS
+    ImplicitTLS bool     `json:"implicit_tls"`
+    From        string   `json:"from"`
+    To          []string `json:"to"`
+    Cities      []string `json:"cities"`
+    Digest      bool     `json:"digest"`
+}
+
+// commentEvent 一条待通知的留言
+type commentEvent struct {
+    City     string    `json:"city"`
+    CityName string    `json:"city_name"`
+    ID       int       `json:"id"`
+    Nick     string    `json:"nick"`
+    Text     string    `json:"text"`
+    Date     time.Time `json:"date"`
+    URL      string    `json:"url,omitempty"`
+    Images   int       `json:"images,omitempty"`
+    Pending  bool      `json:"pending,omitempty"`
+}
+
+// notifyChannel 通知渠道，Send 返回 errPermanent 包装的错误时不再重试
+type notifyChannel interface {
+    Name() string
+    Send(events []commentEvent, digest bool) error
+}
+
+// notifySubscription 一个渠道及其订阅设置
+type notifySubscription struct {
+    channel notifyChannel
+    cities  []string
+    digest  bool
+    pending []commentEvent
+    // queue 交给该渠道的投递协程，慢渠道不会拖住其他渠道
+    queue chan *notifyDelivery
+}
+
+// notifyDelivery 等待重试的一次投递
+type notifyDelivery struct {
+    sub     *notifySubscription
+    events  []commentEvent
+    digest  bool
+    attempt int
+    next    time.Time
+}
+
+type webhookChannel struct {
+    cfg    WebhookConfig
+    client *http.Client
+}
+
+type emailChannel struct {
+    cfg EmailConfig
+}
+
+// SearchConfig 全文搜索配置
+type SearchConfig struct {
+    // 检查页面和日记文件变化的间隔，0 表示只在启动时建立索引
+    RefreshSeconds int `json:"refresh_seconds"`
+    MaxQueryRunes  int `json:"max_query_runes"`
+    SnippetRunes   int `json:"snippet_runes"`
+}
+
+// searchDoc 索引中的一篇文档：页面段落、日记或留言
+type searchDoc struct {
+    ID     string
+    Kind   string
+    City   string
+    Title  string
+    URL    string
+    Text   string
+    Date   time.Time
+    length int
+}
+
+// searchSource 一个来源文件对应的文档，文件变化时整体替换
+type searchSource struct {
+    modTime time.Time
+    docIDs  []string
+}
+
+// searchResult 搜索结果，Snippet 已转义并用 <mark> 标出命中位置
+type searchResult struct {
+    Type    string    `json:"type"`
+    City    string    `json:"city"`
+    Title   string    `json:"title"`
+    URL     string    `json:"url"`
+    Snippet string    `json:"snippet"`
+    Date    time.Time `json:"date,omitempty"`
+    Score   float64   `json:"score"`
+}
+
+// BotConfig 爬虫识别配置
+type BotConfig struct {
+    Enabled             bool              `json:"enabled"`
+    // 按顺序匹配 User-Agent，第一条命中的规则决定类别
+    Patterns            []BotPattern      `json:"patterns"`
+    // 额外的规则文件，格式与 crawler-user-agents.json 相同，命中后归为 bot 类
+    PatternsFile        string            `json:"patterns_file"`
+    // 各类别的处理策略：allow、throttle、block、cached
+    Policies            map[string]string `json:"policies"`
+    // throttle 策略下每个 IP 每分钟允许的请求数
+    ThrottlePerMinute   int               `json:"throttle_per_minute"`
+    // 普通访客每分钟请求超过该值时归为 aggressive
+    AggressivePerMinute int               `json:"aggressive_per_minute"`
+    VerifyTimeoutMs     int               `json:"verify_timeout_ms"`
+    VerifyCacheMinutes  int               `json:"verify_cache_minutes"`
+}
+
+// BotPattern 一条 User-Agent 规则，Pattern 为不区分大小写的正则表达式
+type BotPattern struct {
+    Name          string   `json:"name"`
+    Pattern       string   `json:"pattern"`
+    Class         string   `json:"class"`
+    // 声称是该爬虫时需要反向 DNS 验证的域名，为空表示不验证
+    VerifyDomains []string `json:"verify_domains,omitempty"`
+}
+
+// BotInfo 一次请求的爬虫识别结果
+type BotInfo struct {
+    Class    string `json:"class"`
+    Name     string `json:"name,omitempty"`
+    Verified bool   `json:"verified,omitempty"`
+}
+
+type compiledBotPattern struct {
+    BotPattern
+    re *regexp.Regexp
+}
+
+type botVerdict struct {
+    info    BotInfo
+    expires time.Time
+}
+
+// dnsResolver 反向 DNS 验证使用的解析器，可以替换为模拟实现
+type dnsResolver interface {
+    LookupAddr(ctx context.Context, addr string) ([]string, error)
+    LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SEOConfig 站点地图、robots.txt 和分享卡片配置，站点地址使用 feed.base_url
+type SEOConfig struct {
+    SiteName     string       `json:"site_name"`
+    // 城市没有封面和相册时使用的分享图片，相对静态目录
+    DefaultImage string       `json:"default_image"`
+    // 是否为城市页面注入 Open Graph / Twitter Card 元数据
+    OpenGraph    bool         `json:"open_graph"`
+    TwitterSite  string       `json:"twitter_site"`
+    Robots       []RobotsRule `json:"robots"`
+    // 追加到 robots.txt 末尾的原始内容
+    RobotsExtra  []string     `json:"robots_extra"`
+}
+
+// RobotsRule robots.txt 中的一组规则
+type RobotsRule struct {
+    UserAgent  string   `json:"user_agent"`
+    Allow      []string `json:"allow"`
+    Disallow   []string `json:"disallow"`
+    CrawlDelay int      `json:"crawl_delay"`
+}
+
+type sitemapURLSet struct {
+    XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+    URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+    Loc        string `xml:"loc"`
+    LastMod    string `xml:"lastmod,omitempty"`
+    ChangeFreq string `xml:"changefreq,omitempty"`
+    Priority   string `xml:"priority,omitempty"`
+}
+
+// FeedConfig 订阅源配置
+type FeedConfig struct {
+    Title           string `json:"title"`
+    Description     string `json:"description"`
+    // 站点地址，例如 http://example.com:9099；为空时站点地图和分享卡片不输出完整地址
+    BaseURL         string `json:"base_url"`
+    MaxItems        int    `json:"max_items"`
+    // 站点订阅源是否包含留言
+    IncludeComments bool   `json:"include_comments"`
+    CacheSeconds    int    `json:"cache_seconds"`
+}
+
+// feedItem 订阅源中的一条内容，与输出格式无关
+type feedItem struct {
+    ID        string
+    Title     string
+    Link      string
+    Summary   string
+    Content   string
+    Author    string
+    Published time.Time
+    Updated   time.Time
+}
+
+// feedDocument 订阅源缓存，内容不变时直接返回
+type feedDocument struct {
+    signature string
+    body      []byte
+    etag      string
+    modTime   time.Time
+    built     time.Time
+}
+
+// pageSummary 从城市页面提取的标题和摘要
+type pageSummary struct {
+    modTime     time.Time
+    title       string
+    description string
+}
+
+type rssFeed struct {
+    XMLName xml.Name   `xml:"rss"`
+    Version string     `xml:"version,attr"`
+    Atom    string     `xml:"xmlns:atom,attr"`
+    Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+    Title         string    `xml:"title"`
+    Link          string    `xml:"link"`
+    Description   string    `xml:"description"`
+    Language      string    `xml:"language"`
+    LastBuildDate string    `xml:"lastBuildDate"`
+    AtomLink      rssLink   `xml:"atom:link"`
+    Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+    Href string `xml:"href,attr"`
+    Rel  string `xml:"rel,attr"`
+    Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+    Title       string  `xml:"title"`
+    Link        string  `xml:"link"`
+    GUID        rssGUID `xml:"guid"`
+    Description string  `xml:"description"`
+    PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+    Value       string `xml:",chardata"`
+    IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type atomFeed struct {
+    XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+    Title   string      `xml:"title"`
+    ID      string      `xml:"id"`
+    Updated string      `xml:"updated"`
+    Links   []atomLink  `xml:"link"`
+    Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+    Href string `xml:"href,attr"`
+    Rel  string `xml:"rel,attr,omitempty"`
+    Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+    Title     string      `xml:"title"`
+    ID        string      `xml:"id"`
+    Link      atomLink    `xml:"link"`
+    Published string      `xml:"published"`
+    Updated   string      `xml:"updated"`
+    Author    *atomAuthor `xml:"author,omitempty"`
+    Summary   string      `xml:"summary,omitempty"`
+    Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+    Name string `xml:"name"`
+}
+
+type atomContent struct {
+    Type  string `xml:"type,attr"`
+    Value string `xml:",chardata"`
+}
+
+// RenderConfig 城市页面渲染配置
+type RenderConfig struct {
+    // Markdown 日记目录，文件名为 {城市缩写}.md
+    DiaryDir     string `json:"diary_dir"`
+    // 自定义页面布局模板，为空时使用内置布局
+    LayoutFile   string `json:"layout_file"`
+    // 动态渲染页面的路由前缀，页面地址为 /city/{城市缩写}
+    RoutePrefix  string `json:"route_prefix"`
+    // 使用 -render-static 预生成页面时的输出目录
+    OutputDir    string `json:"output_dir"`
+    AMapKey      string `json:"amap_key"`
+}
+
+// DiaryFrontMatter 日记文件头部的元数据
+type DiaryFrontMatter struct {
+    Title   string
+    Start   string
+    End     string
+    Gallery string
+    Music   string
+    Cover   string
+}
+
+// cityPageData 城市页面模板数据
+type cityPageData struct {
+    City        CityInfo
+    Cities      []CityInfo
+    RoutePrefix string
+    Title       string
+    Start       string
+    End         string
+    Cover       string
+    Diary       template.HTML
+    Entries     []diaryEntryView
+    Gallery     []GalleryItem
+    MusicURL    string
+    AMapKey     string
+    Meta        template.HTML
+    // Feeds 配置了站点地址、订阅源可用时为 true
+    Feeds       bool
+}
+
+// diaryEntryView 日记条目的展示数据，正文已渲染为 HTML
+type diaryEntryView struct {
+    *DiaryEntry
+    HTML template.HTML
+}
+
+// renderedPage 渲染结果缓存，日记、布局或相册变化后失效
+type renderedPage struct {
+    html      []byte
+    key       string
+    modTime   time.Time
+}
+
+// markdownOptions 控制 Markdown 渲染允许的语法
+type markdownOptions struct {
+    AllowImages   bool
+    AllowHeadings bool
+    LinkRel       string
+    // 将 :smile: 这类短代码替换为 emoji
+    Emoji         bool
+}
+
+// CityInfo 城市登记信息
+type CityInfo struct {
+    Abbr     string   `json:"abbr"`
+    Name     string   `json:"name"`
+    NameEn   string   `json:"name_en"`
+    Page     string   `json:"page"`
+    ImageDir string   `json:"image_dir,omitempty"`
+    // 分享卡片使用的封面，相对静态目录；为空时使用相册第一张照片
+    Cover    string   `json:"cover,omitempty"`
+    Music    []string `json:"music,omitempty"`
+    Lat      float64  `json:"lat"`
+    Lon      float64  `json:"lon"`
+}
+
+// CacheConfig 静态资源缓存策略，时间单位为秒
+type CacheConfig struct {
+    AssetMaxAge      int    `json:"asset_max_age"`
+    // 指纹地址 /static/<hash>/... 的缓存时间，内容变化后地址随之变化
+    ImmutableMaxAge  int    `json:"immutable_max_age"`
+    // HTML 的 Cache-Control。开启 CSP nonce 时每次响应内容不同，HTML 仍使用 no-store
+    HTMLCacheControl string `json:"html_cache_control"`
+}
+
+// assetHash 静态文件内容哈希
+type assetHash struct {
+    hash    string
+    modTime time.Time
+    size    int64
+}
+
+// CompressionConfig 静态资源压缩配置。
+// 标准库没有 brotli 编码器，br 只使用预压缩的 .br 文件；gzip 在没有 .gz 文件时实时压缩并缓存。
+type CompressionConfig struct {
+    Enabled              bool     `json:"enabled"`
+    Precompressed        bool     `json:"precompressed"`
+    CompressibleExts     []string `json:"compressible_extensions"`
+    MinSize              int64    `json:"min_size"`
+    CacheMaxBytes        int64    `json:"cache_max_bytes"`
+    Level                int      `json:"level"`
+}
+
+// compressedEntry 实时压缩结果缓存项
+type compressedEntry struct {
+    modTime time.Time
+    size    int64
+    data    []byte
+}
+
+// StaticConfig 静态文件对外提供策略
+type StaticConfig struct {
+    Dir               string   `json:"dir"`
+    // 允许对外提供的扩展名，为空表示不限制
+    AllowedExtensions []string `json:"allowed_extensions"`
+    // 允许对外提供的一级子目录，根目录下的文件不受此限制；为空表示不限制
+    AllowedDirs       []string `json:"allowed_dirs"`
+    // 始终拒绝的文件或目录名，以及扩展名（优先于允许列表）
+    DeniedNames       []string `json:"denied_names"`
+    DeniedExtensions  []string `json:"denied_extensions"`
+    DirectoryListing  bool     `json:"directory_listing"`
+    // 自定义错误页模板目录（相对于静态目录），其中的 {状态码}.html 或 error.html 优先于内置模板
+    ErrorPagesDir     string   `json:"error_pages_dir"`
+}
+
+// errorPageData 错误页模板数据
+type errorPageData struct {
+    Status   int
+    Lang     string
+    Title    string
+    Message  string
+    Detail   string
+    Path     string
+    HomeText string
+}
+
+// errorText 错误页文案
+type errorText struct {
+    Title   string
+    Message string
+}
+
+// ServerLimitsConfig 服务器超时与请求大小限制，超时单位为秒
+type ServerLimitsConfig struct {
+    Addr                     string           `json:"addr"`
+    ReadHeaderTimeoutSeconds int              `json:"read_header_timeout_seconds"`
+    // 读取请求体的时限，由 bodyLimitMiddleware 按请求设置，不作用于整个连接
+    ReadTimeoutSeconds       int              `json:"read_timeout_seconds"`
+    WriteTimeoutSeconds      int              `json:"write_timeout_seconds"`
+    IdleTimeoutSeconds       int              `json:"idle_timeout_seconds"`
+    MaxHeaderBytes           int              `json:"max_header_bytes"`
+    MaxBodyBytes             int64            `json:"max_body_bytes"`
+    // 按路由前缀覆盖请求体上限，取最长匹配前缀
+    RouteBodyLimits          map[string]int64 `json:"route_body_limits"`
+    // 按路由前缀覆盖请求体读取时限（秒），取最长匹配前缀
+    RouteReadTimeouts        map[string]int   `json:"route_read_timeouts"`
+    // 每个 IP 同时保持的最大连接数，0 表示不限制
+    MaxConnsPerIP            int              `json:"max_conns_per_ip"`
+}
+
+// SecurityHeadersConfig 安全响应头配置
+type SecurityHeadersConfig struct {
+    ContentSecurityPolicy     string                       `json:"content_security_policy"`
+    CSPReportOnly             bool                         `json:"csp_report_only"`
+    UseNonce                  bool                         `json:"use_nonce"`
+    PermissionsPolicy         string                       `json:"permissions_policy"`
+    CrossOriginOpenerPolicy   string                       `json:"cross_origin_opener_policy"`
+    CrossOriginResourcePolicy string                       `json:"cross_origin_resource_policy"`
+    ReferrerPolicy            string                       `json:"referrer_policy"`
+    FrameOptions              string                       `json:"frame_options"`
+    StrictTransportSecurity   string                       `json:"strict_transport_security"`
+    RouteOverrides            map[string]map[string]string `json:"route_overrides"`
+}
+
+// CORSConfig 跨域配置
+type CORSConfig struct {
+    // 允许的来源，支持精确匹配（http://example.com:9099）、子域名通配（https://*.example.com）和 "*"
+    AllowedOrigins   []string `json:"allowed_origins"`
+    AllowedMethods   []string `json:"allowed_methods"`
+    AllowedHeaders   []string `json:"allowed_headers"`
+    ExposedHeaders   []string `json:"exposed_headers"`
+    AllowCredentials bool     `json:"allow_credentials"`
+    MaxAge           int      `json:"max_age"`
+    // 需要跨域处理的 API 路由前缀
+    Routes           []string `json:"routes"`
+}
+
+// ImageConfig 缩略图服务配置
+type ImageConfig struct {
+    // 允许缩放的图片目录（静态目录下的一级子目录）
+    SourceDirs    []string `json:"source_dirs"`
+    CacheDir      string   `json:"cache_dir"`
+    // 缓存目录的容量上限，超出后删除最久未使用的缩略图
+    CacheMaxBytes int64    `json:"cache_max_bytes"`
+    // 允许生成的宽度，请求的宽度会向上取整到列表中的值，避免任意尺寸撑爆缓存
+    AllowedWidths []int    `json:"allowed_widths"`
+    Quality       int      `json:"quality"`
+    // 同时进行的缩放任务数
+    MaxConcurrent int      `json:"max_concurrent"`
+}
+
+// PhotoConfig 照片 EXIF 索引配置，城市与图片目录的对应关系来自城市登记表
+type PhotoConfig struct {
+    // 对外提供 JPEG 原图时去掉其中的 GPS 信息
+    StripGPS            bool              `json:"strip_gps"`
+    RescanIntervalSeconds int             `json:"rescan_interval_seconds"`
+}
+
+// PhotoInfo 照片 EXIF 索引项
+type PhotoInfo struct {
+    URL      string     `json:"url"`
+    File     string     `json:"file"`
+    TakenAt  *time.Time `json:"taken_at,omitempty"`
+    Camera   string     `json:"camera,omitempty"`
+    Lat      *float64   `json:"lat,omitempty"`
+    Lon      *float64   `json:"lon,omitempty"`
+    Width    int        `json:"width,omitempty"`
+    Height   int        `json:"height,omitempty"`
+    modTime  time.Time
+    size     int64
+}
+
+// exifData 从 JPEG 中解析出的 EXIF 字段
+type exifData struct {
+    Orientation int
+    TakenAt     time.Time
+    Make        string
+    Model       string
+    HasGPS      bool
+    Lat         float64
+    Lon         float64
+}
+
+// ifdEntry TIFF 目录项
+type ifdEntry struct {
+    pos   int
+    typ   uint16
+    count uint32
+}
+
+// GalleryConfig 相册清单配置
+type GalleryConfig struct {
+    // 以这些前缀开头的一级目录视为相册目录，如 imgnj、imagesxjp
+    DirPrefixes         []string `json:"dir_prefixes"`
+    PollIntervalSeconds int      `json:"poll_interval_seconds"`
+    ThumbWidth          int      `json:"thumb_width"`
+}
+
+// GalleryItem 相册清单中的一张图片
+type GalleryItem struct {
+    File    string    `json:"file"`
+    URL     string    `json:"url"`
+    Thumb   string    `json:"thumb"`
+    Width   int       `json:"width"`
+    Height  int       `json:"height"`
+    Size    int64     `json:"size"`
+    Caption string    `json:"caption,omitempty"`
+    ModTime time.Time `json:"mod_time"`
+}
+
+// GalleryManifest 一个相册目录的清单
+type GalleryManifest struct {
+    City      string        `json:"city"`
+    Dir       string        `json:"dir"`
+    Version   string        `json:"version"`
+    UpdatedAt time.Time     `json:"updated_at"`
+    Items     []GalleryItem `json:"items"`
+    signature string
+}
+
+// AdminConfig 管理接口认证配置
+type AdminConfig struct {
+    // 管理员名称 -> X-Admin-Token，名称会记录在上传审计日志中
+    Tokens map[string]string `json:"tokens"`
+}
+
+// UploadConfig 管理员照片上传配置
+type UploadConfig struct {
+    MaxFileBytes  int64  `json:"max_file_bytes"`
+    MaxFiles      int    `json:"max_files"`
+    MaxPixels     int    `json:"max_pixels"`
+    // 文件命名方式：sequence 使用目录中的下一个编号，hash 使用内容哈希
+    Naming        string `json:"naming"`
+    AuditLogFile  string `json:"audit_log_file"`
+}
+
+// UploadAuditEntry 上传审计记录
+type UploadAuditEntry struct {
+    Time         time.Time `json:"time"`
+    Uploader     string    `json:"uploader"`
+    IP           string    `json:"ip"`
+    City         string    `json:"city"`
+    File         string    `json:"file"`
+    OriginalName string    `json:"original_name"`
+    Size         int64     `json:"size"`
+    SHA256       string    `json:"sha256"`
+}
+
+// MusicConfig 背景音乐配置
+type MusicConfig struct {
+    // 音乐文件所在目录（相对于静态目录）
+    Dir    string              `json:"dir"`
+    // 非城市页面（如首页）的曲目，城市页面的曲目在城市登记表中配置
+    Tracks map[string][]string `json:"tracks"`
+    // 未配置曲目的页面使用此页面的曲目，为空时返回 404
+    Default string             `json:"default"`
+}
+
+// MusicTrack 播放列表中的一首曲目
+type MusicTrack struct {
+    Title       string `json:"title"`
+    Artist      string `json:"artist,omitempty"`
+    URL         string `json:"url"`
+    ContentType string `json:"content_type"`
+    Size        int64  `json:"size"`
+}
+
+type contextKey string
+
+const cspNonceKey contextKey = "csp-nonce"
+const botInfoKey contextKey = "bot-info"
+
 // 全局变量
 var (
+    serverConfig  = defaultServerConfig()
     accessRecords = make(map[string]*AccessRecord)
     recordsMutex  = sync.RWMutex{}
     comments      = make(map[string][]Comment)
     commentsMutex = sync.RWMutex{}
+    diaries       = diaryStore{NextID: 1, Revisions: make(map[int][]DiaryRevision)}
+    diariesMutex  = sync.RWMutex{}
     logFile       *os.File
     blacklistedIPs = []string{}
     rateLimitPerMinute = 60
+    // 缩略图、背景音乐和分段请求单独计数：一个相册页面就会并发请求几十张缩略图
+    mediaRateLimitPerMinute = 600
     requestCounts     = make(map[string][]time.Time)
     requestMutex      = sync.RWMutex{}
+
+    errPathForbidden = errors.New("禁止访问的路径")
+    errPathNotFound  = errors.New("文件不存在")
+
+    gzipCache      = make(map[string]*compressedEntry)
+    gzipCacheBytes int64
+    gzipCacheMutex = sync.RWMutex{}
+
+    assetHashes     = make(map[string]*assetHash)
+    assetHashMutex  = sync.RWMutex{}
+
+    imageResizeSlots chan struct{}
+    imageKeyLocks    = make(map[string]*imageKeyLock)
+    imageKeyMutex    = sync.Mutex{}
+    imageCachePruneMutex = sync.Mutex{}
+
+    photoIndex      = make(map[string][]*PhotoInfo)
+    photoIndexMutex = sync.RWMutex{}
+
+    galleries      = make(map[string]*GalleryManifest)
+    galleriesMutex = sync.RWMutex{}
+
+    uploadMutex = sync.Mutex{}
+
+    renderedPages      = make(map[string]*renderedPage)
+    renderedPagesMutex = sync.RWMutex{}
+
+    feedCache          = make(map[string]*feedDocument)
+    feedCacheMutex     = sync.Mutex{}
+    pageSummaries      = make(map[string]*pageSummary)
+    pageSummariesMutex = sync.Mutex{}
+
+    botPatterns       []compiledBotPattern
+    botVerdicts       = make(map[string]*botVerdict)
+    botVerdictsMutex  = sync.Mutex{}
+    botActivity       = make(map[string][]time.Time)
+    botActivityMutex  = sync.Mutex{}
+    botResolver       dnsResolver = net.DefaultResolver
+
+    searchDocs     = make(map[string]*searchDoc)
+    searchPostings = make(map[string]map[string]int)
+    searchSources  = make(map[string]*searchSource)
+    searchLength   int
+    searchMutex    = sync.RWMutex{}
+
+    notifyQueue  chan commentEvent
+
+    identities       = identityStore{Accounts: make(map[string]*NickAccount)}
+    identitiesMutex  = sync.RWMutex{}
+    magicLinks       = make(map[string]*magicLink)
+    loginFailures    = make(map[string][]time.Time)
+    identityAttempts = make(map[string][]time.Time)
+    errPermanent = errors.New("永久失败")
+
+    // 挑战签名密钥只保存在内存中，重启后未使用的挑战失效
+    challengeKey        = randomChallengeKey()
+    challengeUsed       = make(map[string]time.Time)
+    // challengeUsedOrder 按使用顺序记录已用的挑战，过期的从头部清理
+    challengeUsedOrder  []usedChallenge
+    commentAttempts     []time.Time
+    challengeDifficulty int
+    challengeMutex      = sync.Mutex{}
+    cityPageTemplate   = template.Must(template.New("city").Parse(defaultCityLayout))
 )
 
 func main() {
+    renderStatic := flag.Bool("render-static", false, "预生成所有城市页面到 render.output_dir 后退出")
+    flag.Parse()
+
     initLogFile()
     defer logFile.Close()
 
+    loadConfig()
+    if !adminEnabled() {
+        log.Println("⚠  未配置管理员令牌 admin.tokens，/admin/ 接口已停用")
+    }
+    if configuredBaseURL() == "" {
+        log.Println("⚠  未配置站点地址 feed.base_url，订阅源已停用")
+    }
+
     loadAccessRecords()
     loadComments()
+    loadDiaryEntries()
+    loadBotPatterns()
+    loadIdentities()
 
     go periodicSave()
 
-    staticDir := "./MyTravelDiary"
+    staticDir := serverConfig.Static.Dir
     if _, err := os.Stat(staticDir); os.IsNotExist(err) {
         log.Fatal("静态文件目录不存在:", staticDir)
     }
 
     checkCriticalFiles(staticDir)
+    auditStaticDir(staticDir)
+    loadErrorTemplates(staticDir)
+
+    staticRoot, err := realPath(staticDir)
+    if err != nil {
+        log.Fatal("无法解析静态文件目录:", err)
+    }
+    loadCityLayout()
+    if *renderStatic {
+        refreshGalleries(staticRoot)
+        if err := renderAllCityPages(serverConfig.Render.OutputDir); err != nil {
+            log.Fatal("❌ 预生成城市页面失败:", err)
+        }
+        return
+    }
+    go warmAssetHashes(staticRoot)
+    go periodicPhotoScan(staticRoot)
+    go watchGalleries(staticRoot)
+    go periodicSearchIndex(staticRoot)
+    startNotifier()
 
     fs := http.FileServer(http.Dir(staticDir))
 
     http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
         clientIP := getRealIP(r)
+        go recordAccess(clientIP, r)
 
-        if !securityCheck(clientIP, r) {
-            logSecurityEvent(clientIP, r, "BLOCKED")
-            http.Error(w, "访问被拒绝", http.StatusForbidden)
+        log.Printf("请求: %s %s 来自 %s [%s]", r.Method, r.URL.Path, clientIP, r.UserAgent())
+
+        if r.URL.Path == "/" {
+            log.Printf("重定向到首页: /homepage.html")
+            http.Redirect(w, r, "/homepage.html", http.StatusFound)
             return
         }
 
-        if !rateLimitCheck(clientIP) {
-            logSecurityEvent(clientIP, r, "RATE_LIMITED")
-            http.Error(w, "请求过多", http.StatusTooManyRequests)
+        // 指纹地址 /static/<hash>/<path>：去掉前缀后按普通静态文件处理
+        fingerprint := ""
+        if strings.HasPrefix(r.URL.Path, "/static/") {
+            var assetPath string
+            fingerprint, assetPath = splitFingerprintPath(r.URL.Path)
+            r = r.Clone(r.Context())
+            r.URL.Path = assetPath
+        }
+
+        filePath, err := resolveStaticPath(staticRoot, r.URL.Path)
+        if err == errPathForbidden {
+            logSecurityEvent(clientIP, r, "FORBIDDEN_PATH")
+            writeError(w, r, http.StatusForbidden, "")
             return
         }
 
-        go recordAccess(clientIP, r)
+        if err == nil && !staticServeAllowed(staticRoot, filePath) {
+            err = errPathNotFound
+        }
 
-        log.Printf("请求: %s %s 来自 %s [%s]", r.Method, r.URL.Path, clientIP, r.UserAgent())
+        if err == errPathNotFound {
+            log.Printf("文件不存在或不允许访问: %s - IP: %s", r.URL.Path, clientIP)
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
 
-        if r.URL.Path == "/" {
-            log.Printf("重定向到首页: /homepage.html")
-            http.Redirect(w, r, "/homepage.html", http.StatusFound)
+        // 只有指纹与当前内容哈希一致时才按不可变资源缓存
+        fingerprinted := false
+        if fingerprint != "" {
+            current := assetHashFor(filePath)
+            if current != "" && current != fingerprint {
+                // 内容已更新或指纹是猜测的，跳转到当前版本
+                w.Header().Set("Cache-Control", "no-cache")
+                http.Redirect(w, r, fingerprintURL(r.URL.Path, current), http.StatusFound)
+                return
+            }
+            fingerprinted = current != ""
+        }
+
+        setContentType(w, r.URL.Path)
+        setCacheHeaders(w, r, filePath, fingerprinted)
+
+        log.Printf("成功服务文件: %s - IP: %s", filePath, clientIP)
+        if strings.HasSuffix(r.URL.Path, ".html") {
+            nonce := cspNonce(r)
+            city := cityForPage(r.URL.Path)
+            if nonce != "" || (city != nil && serverConfig.SEO.OpenGraph) {
+                serveHTMLPage(w, r, filePath, nonce, city)
+                return
+            }
+        }
+        if serveCompressedStatic(w, r, filePath) {
+            return
+        }
+        if serverConfig.Photos.StripGPS && isJPEGPath(filePath) && serveJPEGWithoutGPS(w, r, filePath) {
+            return
+        }
+        fs.ServeHTTP(w, r)
+    })
+
+    http.HandleFunc("/comments/", serveComments)
+    http.HandleFunc("/admin/comments/", serveAdminComments)
+
+    http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(`{"status":"ok","service":"MyTravelDiary"}`))
+    })
+
+    http.HandleFunc("/api/assets", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-cache")
+        if p := r.URL.Query().Get("path"); p != "" {
+            filePath, err := resolveStaticPath(staticRoot, p)
+            if err != nil || !staticServeAllowed(staticRoot, filePath) {
+                writeError(w, r, http.StatusNotFound, "资源不存在")
+                return
+            }
+            json.NewEncoder(w).Encode(map[string]string{"path": p, "url": fingerprintURL(p, assetHashFor(filePath))})
+            return
+        }
+        json.NewEncoder(w).Encode(assetManifest(staticRoot))
+    })
+
+    imageResizeSlots = make(chan struct{}, maxInt(serverConfig.Images.MaxConcurrent, 1))
+    if err := os.MkdirAll(serverConfig.Images.CacheDir, 0755); err != nil {
+        log.Printf("⚠  无法创建缩略图缓存目录: %v", err)
+    }
+    go pruneImageCache(serverConfig.Images)
+    if serverConfig.Attachments.Enabled {
+        if err := os.MkdirAll(serverConfig.Attachments.Dir, 0700); err != nil {
+            log.Printf("⚠  无法创建留言图片目录: %v", err)
+        }
+        sweepCommentImages()
+    }
+
+    http.HandleFunc("/img/", func(w http.ResponseWriter, r *http.Request) {
+        clientIP := getRealIP(r)
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+
+        assetPath := strings.TrimPrefix(r.URL.Path, "/img")
+        filePath, err := resolveImageSource(staticRoot, assetPath)
+        if err == errPathForbidden {
+            logSecurityEvent(clientIP, r, "FORBIDDEN_PATH")
+            writeError(w, r, http.StatusForbidden, "")
+            return
+        }
+        if err != nil {
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+
+        width := 0
+        if v := r.URL.Query().Get("w"); v != "" {
+            width, err = strconv.Atoi(v)
+            if err != nil || width <= 0 {
+                writeError(w, r, http.StatusBadRequest, "无效的图片宽度")
+                return
+            }
+        }
+        width = snapImageWidth(width)
+
+        cachedPath, contentType, err := resizedImage(filePath, width)
+        if err != nil {
+            log.Printf("⚠  生成缩略图失败: %s (w=%d): %v", filePath, width, err)
+            writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+            return
+        }
+        f, err := os.Open(cachedPath)
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
             return
         }
+        defer f.Close()
+        info, err := f.Stat()
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+            return
+        }
+        w.Header().Set("Content-Type", contentType)
+        w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", serverConfig.Cache.AssetMaxAge))
+        w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(cachedPath), filepath.Ext(cachedPath))+`"`)
+        http.ServeContent(w, r, "", info.ModTime(), f)
+    })
+
+    http.HandleFunc("/api/images/srcset", func(w http.ResponseWriter, r *http.Request) {
+        assetPath := r.URL.Query().Get("path")
+        filePath, err := resolveImageSource(staticRoot, assetPath)
+        if err != nil {
+            writeError(w, r, http.StatusNotFound, "图片不存在")
+            return
+        }
+        srcWidth, _, err := imageDisplaySize(filePath)
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, "无法读取图片尺寸")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(imageSrcset(assetPath, srcWidth))
+    })
+
+    http.HandleFunc("/api/photos/", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        city := strings.TrimPrefix(r.URL.Path, "/api/photos/")
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        photoIndexMutex.RLock()
+        defer photoIndexMutex.RUnlock()
+        if city == "" {
+            counts := make(map[string]int, len(photoIndex))
+            for c, photos := range photoIndex {
+                counts[c] = len(photos)
+            }
+            json.NewEncoder(w).Encode(counts)
+            return
+        }
+        photos, ok := photoIndex[city]
+        if !ok {
+            writeError(w, r, http.StatusNotFound, "未知的城市")
+            return
+        }
+        json.NewEncoder(w).Encode(photos)
+    })
+
+    http.HandleFunc("/api/gallery/", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        city := strings.TrimPrefix(r.URL.Path, "/api/gallery/")
+        galleriesMutex.RLock()
+        defer galleriesMutex.RUnlock()
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-cache")
+        if city == "" {
+            summary := make(map[string]int, len(galleries))
+            for c, g := range galleries {
+                summary[c] = len(g.Items)
+            }
+            json.NewEncoder(w).Encode(summary)
+            return
+        }
+        gallery, ok := galleries[city]
+        if !ok {
+            writeError(w, r, http.StatusNotFound, "未知的城市")
+            return
+        }
+        etag := `"` + gallery.Version + `"`
+        w.Header().Set("ETag", etag)
+        if r.Header.Get("If-None-Match") == etag {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+        json.NewEncoder(w).Encode(gallery)
+    })
+
+    http.HandleFunc("/admin/upload/", func(w http.ResponseWriter, r *http.Request) {
+        serveAdminUpload(w, r, staticRoot)
+    })
+
+    http.HandleFunc("/music/", func(w http.ResponseWriter, r *http.Request) {
+        serveMusicTrack(w, r, staticRoot)
+    })
+
+    http.HandleFunc("/api/music/", func(w http.ResponseWriter, r *http.Request) {
+        serveMusicPlaylist(w, r, staticRoot)
+    })
+
+    http.HandleFunc("/api/cities", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(serverConfig.Cities)
+    })
+
+    http.HandleFunc(serverConfig.Render.RoutePrefix, func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        abbr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, serverConfig.Render.RoutePrefix), ".html")
+        if _, ok := findCity(abbr); !ok {
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+        page, err := cityPage(abbr)
+        if err != nil {
+            log.Printf("⚠  渲染城市页面失败: %s: %v", abbr, err)
+            writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+            return
+        }
+        data := page.html
+        if nonce := cspNonce(r); nonce != "" {
+            data = addScriptNonce(data, nonce)
+            w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+        } else {
+            w.Header().Set("Cache-Control", serverConfig.Cache.HTMLCacheControl)
+            w.Header().Set("ETag", `"`+page.key+`"`)
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        http.ServeContent(w, r, abbr+".html", page.modTime, bytes.NewReader(data))
+    })
+
+    http.HandleFunc("/api/diaries", serveDiaryList)
+    http.HandleFunc("/api/diaries/", serveDiary)
+    http.HandleFunc("/admin/diaries", serveAdminDiaries)
+    http.HandleFunc("/admin/diaries/", serveAdminDiary)
+
+    for _, name := range []string{"/feed.xml", "/feed.atom", "/feed.json"} {
+        format := feedFormat(strings.TrimPrefix(name, "/"))
+        http.HandleFunc(name, func(w http.ResponseWriter, r *http.Request) {
+            serveFeed(w, r, "site", format, func(base string) (string, string, []feedItem) {
+                return serverConfig.Feed.Title, base + "/homepage.html", siteFeedItems(staticRoot, base)
+            })
+        })
+    }
+
+    http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        q := r.URL.Query()
+        query := strings.TrimSpace(q.Get("q"))
+        if query == "" {
+            writeError(w, r, http.StatusBadRequest, "缺少搜索关键词")
+            return
+        }
+        if utf8.RuneCountInString(query) > serverConfig.Search.MaxQueryRunes {
+            writeError(w, r, http.StatusBadRequest, "搜索关键词过长")
+            return
+        }
+        city := q.Get("city")
+        if city != "" {
+            if _, ok := findCity(city); !ok {
+                writeError(w, r, http.StatusNotFound, "未知的城市")
+                return
+            }
+        }
+        kind := q.Get("type")
+        if kind != "" && kind != "page" && kind != "diary" && kind != "comment" {
+            writeError(w, r, http.StatusBadRequest, "type 只能是 page、diary 或 comment")
+            return
+        }
+        page, perPage, ok := parsePagination(q)
+        if !ok {
+            writeError(w, r, http.StatusBadRequest, "无效的分页参数")
+            return
+        }
+        results := searchIndexQuery(query, city, kind)
+        start := (page - 1) * perPage
+        if start > len(results) {
+            start = len(results)
+        }
+        end := start + perPage
+        if end > len(results) {
+            end = len(results)
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-cache")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "query":    query,
+            "results":  results[start:end],
+            "page":     page,
+            "per_page": perPage,
+            "total":    len(results),
+        })
+    })
+
+    http.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Header().Set("Cache-Control", "public, max-age=3600")
+        io.WriteString(w, robotsTxt(configuredBaseURL()))
+    })
+
+    http.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        // 站点地图必须使用完整地址，没有配置站点地址时不提供
+        base := configuredBaseURL()
+        if base == "" {
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+        urls, modTime := sitemapURLs(staticRoot, base)
+        data, err := xml.MarshalIndent(sitemapURLSet{URLs: urls}, "", "  ")
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+            return
+        }
+        data = append([]byte(xml.Header), data...)
+        sum := sha256.Sum256(data)
+        w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+        w.Header().Set("Cache-Control", "public, max-age=3600")
+        w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+        http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+    })
+
+    http.HandleFunc("/api/identity/", serveIdentity)
+
+    http.HandleFunc("/admin/notify/test", func(w http.ResponseWriter, r *http.Request) {
+        user, ok := adminUser(r)
+        if !ok {
+            writeError(w, r, http.StatusUnauthorized, "未授权")
+            return
+        }
+        if r.Method != http.MethodPost {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        if notifyQueue == nil {
+            writeError(w, r, http.StatusConflict, "通知功能未启用")
+            return
+        }
+        // 直接同步发送到所有渠道（忽略城市订阅和汇总设置），便于检查配置
+        event := commentEvent{City: "test", CityName: "测试", Nick: user, Text: "这是一条测试通知", Date: time.Now()}
+        results := make(map[string]string)
+        for _, sub := range notifySubscriptions() {
+            if err := sub.channel.Send([]commentEvent{event}, false); err != nil {
+                results[sub.channel.Name()] = err.Error()
+            } else {
+                results[sub.channel.Name()] = "ok"
+            }
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(results)
+    })
+
+    http.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+        if _, ok := adminUser(r); !ok {
+            writeError(w, r, http.StatusUnauthorized, "未授权")
+            return
+        }
+        // 访客统计默认排除爬虫，include_bots=1 时返回全部记录
+        includeBots := r.URL.Query().Get("include_bots") == "1"
+        recordsMutex.RLock()
+        defer recordsMutex.RUnlock()
+        visitors := make(map[string]*AccessRecord, len(accessRecords))
+        for ip, record := range accessRecords {
+            if includeBots || record.BotClass == "" || record.BotClass == "human" {
+                visitors[ip] = record
+            }
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(visitors)
+    })
+
+    http.HandleFunc("/admin/export", func(w http.ResponseWriter, r *http.Request) {
+        if _, ok := adminUser(r); !ok {
+            writeError(w, r, http.StatusUnauthorized, "未授权")
+            return
+        }
+        w.Header().Set("Content-Type", "application/octet-stream")
+        w.Header().Set("Content-Disposition", "attachment; filename=access_records.json")
+        recordsMutex.RLock()
+        data, _ := json.MarshalIndent(accessRecords, "", "  ")
+        recordsMutex.RUnlock()
+        w.Write(data)
+    })
+
+    log.Println("🌍 MyTravelDiary 增强版服务器已启动")
+    log.Println("📍 主页访问地址：http://1.95.203.92:9099")
+    log.Println("📍 或直接访问：http://1.95.203.92:9099/homepage.html")
+    log.Println("🔍 健康检查：http://1.95.203.92:9099/health")
+    log.Println("📊 管理统计：http://1.95.203.92:9099/admin/stats (需要认证)")
+    log.Println("📁 导出数据：http://1.95.203.92:9099/admin/export (需要认证)")
+    log.Println("🔐 安全特性：IP黑名单、速率限制、地理位置记录、安全响应头、爬虫识别已启用")
+    log.Println("===========================================")
+
+    server := newHTTPServer(securityHeadersMiddleware(accessControlMiddleware(botMiddleware(corsMiddleware(bodyLimitMiddleware(http.DefaultServeMux))))))
+    listener, err := net.Listen("tcp", server.Addr)
+    if err != nil {
+        log.Fatal("❌ 服务器启动失败:", err)
+    }
+    err = server.Serve(newPerIPLimitListener(listener, serverConfig.Server.MaxConnsPerIP))
+    if err != nil {
+        log.Fatal("❌ 服务器启动失败:", err)
+    }
+}
+
+func newHTTPServer(handler http.Handler) *http.Server {
+    cfg := serverConfig.Server
+    return &http.Server{
+        Addr:              cfg.Addr,
+        Handler:           handler,
+        // 请求体的读取时限和响应的写入时限由 bodyLimitMiddleware 按路由设置
+        ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeoutSeconds) * time.Second,
+        WriteTimeout:      time.Duration(cfg.WriteTimeoutSeconds) * time.Second,
+        IdleTimeout:       time.Duration(cfg.IdleTimeoutSeconds) * time.Second,
+        MaxHeaderBytes:    cfg.MaxHeaderBytes,
+    }
+}
+
+func loadComments() {
+    data, err := os.ReadFile("comments.json")
+    if err != nil {
+        log.Println("💾 没有找到评论记录文件，将创建新的记录")
+        return
+    }
+    if err := json.Unmarshal(data, &comments); err != nil {
+        log.Printf("⚠  加载评论记录失败: %v", err)
+        return
+    }
+    // 早期的留言没有渲染结果，加载时补齐
+    for _, list := range comments {
+        for i := range list {
+            if list[i].HTML == "" {
+                list[i].HTML = renderCommentHTML(list[i].Text)
+            }
+        }
+    }
+    log.Printf("📊 已加载 %d 个城市的评论记录", len(comments))
+}
+
+// loadDiaryEntries 加载日记条目和历史版本
+func loadDiaryEntries() {
+    data, err := os.ReadFile("diary_entries.json")
+    if err != nil {
+        log.Println("💾 没有找到日记记录文件，将创建新的记录")
+        return
+    }
+    var store diaryStore
+    if err := json.Unmarshal(data, &store); err != nil {
+        log.Printf("⚠  加载日记记录失败: %v", err)
+        return
+    }
+    if store.Revisions == nil {
+        store.Revisions = make(map[int][]DiaryRevision)
+    }
+    for _, e := range store.Entries {
+        if e.ID >= store.NextID {
+            store.NextID = e.ID + 1
+        }
+    }
+    if store.NextID < 1 {
+        store.NextID = 1
+    }
+    diaries = store
+    log.Printf("📊 已加载 %d 篇日记", len(diaries.Entries))
+}
+
+// saveDiaryEntries 保存日记记录，调用方需持有 diariesMutex
+func saveDiaryEntries() error {
+    data, err := json.MarshalIndent(diaries, "", "  ")
+    if err != nil {
+        return err
+    }
+    // 先写临时文件再改名，避免写入中断导致记录损坏
+    tmp := "diary_entries.json.tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, "diary_entries.json")
+}
+
+func periodicSave() {
+    ticker := time.NewTicker(5 * time.Minute)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            saveAccessRecords()
+            saveComments()
+            pruneRequestWindows()
+        }
+    }
+}
+
+// serveComments 处理 /comments/{city} 的读取和发表，以及留言订阅源、图片和人机验证挑战
+func serveComments(w http.ResponseWriter, r *http.Request) {
+    // CORS 头和 OPTIONS 预检请求由 corsMiddleware 统一处理
+    city := strings.TrimPrefix(r.URL.Path, "/comments/")
+    if abbr, feedFile, ok := strings.Cut(city, "/"); ok {
+        if name, isImage := strings.CutPrefix(feedFile, "images/"); isImage {
+            serveCommentImage(w, r, abbr, name)
+            return
+        }
+        format := feedFormat(feedFile)
+        if _, known := findCity(abbr); !known || format == "" {
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+        serveFeed(w, r, "comments:"+abbr, format, func(base string) (string, string, []feedItem) {
+            city, _ := findCity(abbr)
+            return city.Name + "的留言", base + "/" + city.Page, commentFeedItems(abbr, base)
+        })
+        return
+    }
+    if city == "" {
+        writeError(w, r, http.StatusBadRequest, "无效的城市标识")
+        return
+    }
+    if city == "challenge" {
+        serveCommentChallenge(w, r)
+        return
+    }
+    if _, ok := findCity(city); !ok {
+        writeError(w, r, http.StatusNotFound, "未知的城市")
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        commentsMutex.RLock()
+        defer commentsMutex.RUnlock()
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        // 待审核的留言只对管理员可见
+        _, isAdmin := adminUser(r)
+        list := []Comment{}
+        for _, c := range comments[city] {
+            if c.Pending && !isAdmin {
+                continue
+            }
+            list = append(list, c)
+        }
+        json.NewEncoder(w).Encode(list)
+    case http.MethodPost:
+        var newComment commentSubmission
+        var uploads [][]byte
+        if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+            if !serverConfig.Attachments.Enabled {
+                writeError(w, r, http.StatusBadRequest, "不支持上传图片")
+                return
+            }
+            var err error
+            newComment, uploads, err = readCommentForm(r)
+            if err != nil {
+                var maxErr *http.MaxBytesError
+                if errors.As(err, &maxErr) {
+                    writeError(w, r, http.StatusRequestEntityTooLarge, "请求体过大")
+                    return
+                }
+                writeError(w, r, http.StatusBadRequest, err.Error())
+                return
+            }
+        } else {
+            r.Body = http.MaxBytesReader(w, r.Body, commentTextLimit)
+            if err := json.NewDecoder(r.Body).Decode(&newComment); err != nil {
+                var maxErr *http.MaxBytesError
+                if errors.As(err, &maxErr) {
+                    writeError(w, r, http.StatusRequestEntityTooLarge, "请求体过大")
+                    return
+                }
+                writeError(w, r, http.StatusBadRequest, "无效的请求体")
+                return
+            }
+        }
+        newComment.Nick = strings.TrimSpace(newComment.Nick)
+        if newComment.Nick == "" || (newComment.Text == "" && len(uploads) == 0) {
+            writeError(w, r, http.StatusBadRequest, "昵称和内容不能为空")
+            return
+        }
+        verified, owner, allowed := commentIdentity(r, newComment.Nick)
+        if !allowed {
+            writeError(w, r, http.StatusForbidden, "该昵称已被认证，请先登录")
+            return
+        }
+        // 已认证的昵称不需要人机验证
+        if serverConfig.Challenge.Enabled && !verified {
+            if err := verifyChallenge(newComment.Challenge, newComment.Nonce); err != nil {
+                log.Printf("🛡  留言人机验证失败: %s (%v), IP: %s", city, err, getRealIP(r))
+                writeError(w, r, http.StatusForbidden, err.Error())
+                return
+            }
+            recordCommentAttempt()
+        }
+        // 图片在加锁前处理，解码和重新编码比较耗时
+        var images []CommentImage
+        for _, data := range uploads {
+            img, err := saveCommentImage(city, data)
+            if err != nil {
+                removeUnusedCommentImages(images)
+                writeError(w, r, http.StatusBadRequest, err.Error())
+                return
+            }
+            images = append(images, img)
+        }
+        commentsMutex.Lock()
+        commentList := comments[city]
+        newID := 1
+        if len(commentList) > 0 {
+            newID = commentList[len(commentList)-1].ID + 1
+        }
+        comment := Comment{
+            ID:    newID,
+            Nick:  newComment.Nick,
+            Text:  newComment.Text,
+            HTML:  renderCommentHTML(newComment.Text),
+            Date:  time.Now(),
+            Verified: verified,
+            Owner:    owner,
+            Images:   images,
+            Pending:  len(images) > 0 && serverConfig.Attachments.HoldForModeration && !owner,
+        }
+        comments[city] = append(commentList, comment)
+        if !comment.Pending {
+            indexComment(city, comment)
+        }
+        notifyComment(city, comment)
+        commentsMutex.Unlock()
+        // 图片文件已经写入，立即保存留言，避免重启后图片失去引用
+        if len(images) > 0 {
+            saveComments()
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        if comment.Pending {
+            w.WriteHeader(http.StatusAccepted)
+        }
+        json.NewEncoder(w).Encode(comment)
+    default:
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+    }
+}
+
+// serveAdminComments 处理 /admin/comments/：列出待审核的留言，通过或删除留言
+func serveAdminComments(w http.ResponseWriter, r *http.Request) {
+    moderator, ok := adminUser(r)
+    if !ok {
+        writeError(w, r, http.StatusUnauthorized, "未授权")
+        return
+    }
+    rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/comments/"), "/")
+    if rest == "" {
+        // 各城市待审核的留言
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        commentsMutex.RLock()
+        defer commentsMutex.RUnlock()
+        pending := make(map[string][]Comment)
+        for city, list := range comments {
+            for _, c := range list {
+                if c.Pending {
+                    pending[city] = append(pending[city], c)
+                }
+            }
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(pending)
+        return
+    }
+    city, idPart, _ := strings.Cut(rest, "/")
+    if _, ok := findCity(city); !ok {
+        writeError(w, r, http.StatusNotFound, "未知的城市")
+        return
+    }
+    idStr, action, _ := strings.Cut(idPart, "/")
+    id, err := strconv.Atoi(idStr)
+    if err != nil || id <= 0 {
+        writeError(w, r, http.StatusNotFound, "留言不存在")
+        return
+    }
+    switch {
+    case action == "approve" && r.Method == http.MethodPost:
+        commentsMutex.Lock()
+        var approved *Comment
+        for i := range comments[city] {
+            if comments[city][i].ID == id {
+                comments[city][i].Pending = false
+                approved = &comments[city][i]
+                break
+            }
+        }
+        if approved == nil {
+            commentsMutex.Unlock()
+            writeError(w, r, http.StatusNotFound, "留言不存在")
+            return
+        }
+        comment := *approved
+        commentsMutex.Unlock()
+        saveComments()
+        indexComment(city, comment)
+        log.Printf("✅ %s 通过了留言 %s #%d", moderator, city, id)
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(comment)
+    case action == "" && r.Method == http.MethodDelete:
+        commentsMutex.Lock()
+        list := comments[city]
+        index := -1
+        for i, c := range list {
+            if c.ID == id {
+                index = i
+                break
+            }
+        }
+        if index < 0 {
+            commentsMutex.Unlock()
+            writeError(w, r, http.StatusNotFound, "留言不存在")
+            return
+        }
+        images := list[index].Images
+        comments[city] = append(list[:index], list[index+1:]...)
+        commentsMutex.Unlock()
+        saveComments()
+        removeSearchDoc(fmt.Sprintf("comment:%s:%d", city, id))
+        removeUnusedCommentImages(images)
+        log.Printf("🗑  %s 删除了留言 %s #%d", moderator, city, id)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+    }
+}
+
+func saveComments() {
+    commentsMutex.RLock()
+    data, err := json.MarshalIndent(comments, "", "  ")
+    commentsMutex.RUnlock()
+    if err != nil {
+        log.Printf("⚠  序列化评论记录失败: %v", err)
+        return
+    }
+    if err := os.WriteFile("comments.json", data, 0644); err != nil {
+        log.Printf("⚠  保存评论记录失败: %v", err)
+        return
+    }
+    log.Println("💾 评论记录已保存")
+}
+
+// commentTextLimit 纯文本留言的请求体上限，multipart 中的文本字段也使用此上限
+const commentTextLimit = 16 << 10
+
+var commentImagePattern = regexp.MustCompile(`^[0-9a-f]{24}\.(jpg|png)$`)
+
+// commentSubmission 留言提交内容，JSON 和 multipart 表单使用相同的字段名
+type commentSubmission struct {
+    Nick      string `json:"nick"`
+    Text      string `json:"text"`
+    Challenge string `json:"challenge"`
+    Nonce     string `json:"nonce"`
+}
+
+// readCommentForm 读取 multipart 留言表单，返回表单字段和未经处理的图片数据
+func readCommentForm(r *http.Request) (commentSubmission, [][]byte, error) {
+    cfg := serverConfig.Attachments
+    var sub commentSubmission
+    reader, err := r.MultipartReader()
+    if err != nil {
+        return sub, nil, errors.New("无效的请求体")
+    }
+    var files [][]byte
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return sub, nil, commentFormError(err)
+        }
+        if part.FileName() == "" {
+            value, err := io.ReadAll(io.LimitReader(part, commentTextLimit+1))
+            part.Close()
+            if err != nil {
+                return sub, nil, commentFormError(err)
+            }
+            if len(value) > commentTextLimit {
+                return sub, nil, errors.New("留言内容过长")
+            }
+            switch part.FormName() {
+            case "nick":
+                sub.Nick = string(value)
+            case "text":
+                sub.Text = string(value)
+            case "challenge":
+                sub.Challenge = string(value)
+            case "nonce":
+                sub.Nonce = string(value)
+            }
+            continue
+        }
+        if len(files) >= cfg.MaxImages {
+            part.Close()
+            return sub, nil, fmt.Errorf("每条留言最多附带 %d 张图片", cfg.MaxImages)
+        }
+        data, err := io.ReadAll(io.LimitReader(part, cfg.MaxFileBytes+1))
+        part.Close()
+        if err != nil {
+            return sub, nil, commentFormError(err)
+        }
+        if int64(len(data)) > cfg.MaxFileBytes {
+            return sub, nil, fmt.Errorf("图片超过 %d MB 上限", cfg.MaxFileBytes>>20)
+        }
+        files = append(files, data)
+    }
+    return sub, files, nil
+}
+
+// commentFormError 保留请求体超限错误，其他读取错误统一为无效请求
+func commentFormError(err error) error {
+    var maxErr *http.MaxBytesError
+    if errors.As(err, &maxErr) {
+        return err
+    }
+    return errors.New("无效的请求体")
+}
+
+// saveCommentImage 校验留言图片，摆正方向并缩小后重新编码保存，同时生成缩略图
+func saveCommentImage(city string, data []byte) (CommentImage, error) {
+    cfg := serverConfig.Attachments
+    // 按文件内容判断真实类型，不信任文件名和客户端声明的 Content-Type
+    var ext string
+    switch http.DetectContentType(data) {
+    case "image/jpeg":
+        ext = ".jpg"
+    case "image/png":
+        ext = ".png"
+    default:
+        return CommentImage{}, errors.New("只支持 JPEG 和 PNG 图片")
+    }
+    imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return CommentImage{}, errors.New("图片已损坏或无法解析")
+    }
+    if imgCfg.Width <= 0 || imgCfg.Height <= 0 || imgCfg.Width*imgCfg.Height > cfg.MaxPixels {
+        return CommentImage{}, errors.New("图片尺寸超出限制")
+    }
+
+    // 先写入临时文件，以便复用按 EXIF 方向摆正的解码逻辑
+    tmp, err := os.CreateTemp(cfg.Dir, "incoming-*"+ext)
+    if err != nil {
+        return CommentImage{}, errors.New("保存图片失败")
+    }
+    defer os.Remove(tmp.Name())
+    _, err = tmp.Write(data)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return CommentImage{}, errors.New("保存图片失败")
+    }
+    displayW, displayH, err := imageDisplaySize(tmp.Name())
+    if err != nil {
+        return CommentImage{}, errors.New("图片已损坏或无法解析")
+    }
+    width := 0
+    if cfg.MaxDimension > 0 && (displayW > cfg.MaxDimension || displayH > cfg.MaxDimension) {
+        width = cfg.MaxDimension
+        if displayH > displayW {
+            width = maxInt(1, displayW*cfg.MaxDimension/displayH)
+        }
+    }
+    imageResizeSlots <- struct{}{}
+    img, err := loadOrientedImage(tmp.Name(), width)
+    <-imageResizeSlots
+    if err != nil {
+        return CommentImage{}, errors.New("图片已损坏或无法解析")
+    }
+
+    // 重新编码只写入像素数据，EXIF、GPS 等元数据不会保留
+    var buf bytes.Buffer
+    if ext == ".png" {
+        err = png.Encode(&buf, img)
+    } else {
+        err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: cfg.Quality})
+    }
+    if err != nil {
+        return CommentImage{}, errors.New("保存图片失败")
+    }
+    sum := sha256.Sum256(buf.Bytes())
+    name := hex.EncodeToString(sum[:12]) + ext
+    filePath := filepath.Join(cfg.Dir, name)
+    // 内容相同的图片共用一个文件
+    f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+    if err == nil {
+        _, err = f.Write(buf.Bytes())
+        if closeErr := f.Close(); err == nil {
+            err = closeErr
+        }
+        if err != nil {
+            os.Remove(filePath)
+            return CommentImage{}, errors.New("保存图片失败")
+        }
+    } else if !os.IsExist(err) {
+        return CommentImage{}, errors.New("保存图片失败")
+    }
+
+    if _, _, err := resizedImage(filePath, cfg.ThumbWidth); err != nil {
+        log.Printf("⚠  生成留言图片缩略图失败: %s: %v", filePath, err)
+    }
+    b := img.Bounds()
+    url := "/comments/" + city + "/images/" + name
+    return CommentImage{Name: name, URL: url, Thumb: url + "?size=thumb", Width: b.Dx(), Height: b.Dy()}, nil
+}
+
+// removeUnusedCommentImages 删除不再被任何留言引用的图片文件
+func removeUnusedCommentImages(images []CommentImage) {
+    if len(images) == 0 {
+        return
+    }
+    inUse := make(map[string]bool)
+    commentsMutex.RLock()
+    for _, list := range comments {
+        for _, c := range list {
+            for _, img := range c.Images {
+                inUse[img.Name] = true
+            }
+        }
+    }
+    commentsMutex.RUnlock()
+    for _, img := range images {
+        if inUse[img.Name] || !commentImagePattern.MatchString(img.Name) {
+            continue
+        }
+        if err := os.Remove(filepath.Join(serverConfig.Attachments.Dir, img.Name)); err != nil && !os.IsNotExist(err) {
+            log.Printf("⚠  删除留言图片失败: %s: %v", img.Name, err)
+        }
+    }
+}
+
+// sweepCommentImages 启动时删除没有被任何留言引用的图片，例如写入图片后、保存留言前进程退出留下的文件
+func sweepCommentImages() {
+    entries, err := os.ReadDir(serverConfig.Attachments.Dir)
+    if err != nil {
+        return
+    }
+    var orphans []CommentImage
+    for _, entry := range entries {
+        if !entry.IsDir() && commentImagePattern.MatchString(entry.Name()) {
+            orphans = append(orphans, CommentImage{Name: entry.Name()})
+        }
+    }
+    removeUnusedCommentImages(orphans)
+}
+
+func randomChallengeKey() []byte {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        log.Fatalf("❌ 生成挑战密钥失败: %v", err)
+    }
+    return b
+}
+
+// serveCommentChallenge 签发工作量证明挑战：客户端需找到 nonce，
+// 使 SHA-256(challenge + ":" + nonce) 的前导零比特数不少于 difficulty
+func serveCommentChallenge(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    cfg := serverConfig.Challenge
+    if !cfg.Enabled {
+        writeError(w, r, http.StatusNotFound, "")
+        return
+    }
+    difficulty := currentChallengeDifficulty()
+    b := make([]byte, 12)
+    if _, err := rand.Read(b); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+        return
+    }
+    now := time.Now()
+    payload := fmt.Sprintf("v1.%d.%d.%s", now.Unix(), difficulty, hex.EncodeToString(b))
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-store")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "challenge":  payload + "." + signChallenge(payload),
+        "difficulty": difficulty,
+        "algorithm":  "sha256",
+        "expires":    now.Add(time.Duration(cfg.TTLSeconds) * time.Second),
+    })
+}
+
+func signChallenge(payload string) string {
+    mac := hmac.New(sha256.New, challengeKey)
+    mac.Write([]byte(payload))
+    return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verifyChallenge 校验挑战的签名、有效期和工作量，每个挑战只能使用一次
+func verifyChallenge(challenge, nonce string) error {
+    if challenge == "" || nonce == "" {
+        return errors.New("请先完成人机验证")
+    }
+    parts := strings.Split(challenge, ".")
+    if len(parts) != 5 || parts[0] != "v1" || len(nonce) > 64 {
+        return errors.New("人机验证无效")
+    }
+    payload := strings.Join(parts[:4], ".")
+    if !hmac.Equal([]byte(parts[4]), []byte(signChallenge(payload))) {
+        return errors.New("人机验证无效")
+    }
+    issued, err1 := strconv.ParseInt(parts[1], 10, 64)
+    difficulty, err2 := strconv.Atoi(parts[2])
+    if err1 != nil || err2 != nil {
+        return errors.New("人机验证无效")
+    }
+    expires := time.Unix(issued, 0).Add(time.Duration(serverConfig.Challenge.TTLSeconds) * time.Second)
+    if time.Now().After(expires) {
+        return errors.New("人机验证已过期，请重试")
+    }
+    sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+    if leadingZeroBits(sum[:]) < difficulty {
+        return errors.New("人机验证未通过")
+    }
+
+    challengeMutex.Lock()
+    defer challengeMutex.Unlock()
+    // 有效期都是签发时间加 TTL，头部未过期的记录最多挡住后面的记录一个 TTL
+    now := time.Now()
+    i := 0
+    for i < len(challengeUsedOrder) && now.After(challengeUsedOrder[i].expires) {
+        delete(challengeUsed, challengeUsedOrder[i].key)
+        i++
+    }
+    challengeUsedOrder = challengeUsedOrder[i:]
+    if _, used := challengeUsed[challenge]; used {
+        return errors.New("人机验证已被使用，请重试")
+    }
+    challengeUsed[challenge] = expires
+    challengeUsedOrder = append(challengeUsedOrder, usedChallenge{key: challenge, expires: expires})
+    return nil
+}
+
+// usedChallenge 已使用的挑战及其过期时间
+type usedChallenge struct {
+    key     string
+    expires time.Time
+}
+
+func leadingZeroBits(sum []byte) int {
+    n := 0
+    for _, b := range sum {
+        if b != 0 {
+            return n + bits.LeadingZeros8(b)
+        }
+        n += 8
+    }
+    return n
+}
+
+// recordCommentAttempt 记录一次通过人机验证的匿名留言或认领登录提交，用于按提交量调整难度。
+// 未通过验证的请求不计数，否则不做计算就能把所有人的难度推到上限
+func recordCommentAttempt() {
+    challengeMutex.Lock()
+    defer challengeMutex.Unlock()
+    commentAttempts = append(commentAttempts, time.Now())
+    // 只需要知道是否超过难度上限，多余的记录不必保留
+    cfg := serverConfig.Challenge
+    if limit := maxInt(cfg.StepComments, 1) * maxInt(cfg.MaxDifficulty-cfg.Difficulty+1, 1); len(commentAttempts) > limit {
+        commentAttempts = commentAttempts[len(commentAttempts)-limit:]
+    }
+}
+
+// currentChallengeDifficulty 按统计窗口内的提交量计算当前难度
+func currentChallengeDifficulty() int {
+    cfg := serverConfig.Challenge
+    challengeMutex.Lock()
+    defer challengeMutex.Unlock()
+    cutoff := time.Now().Add(-time.Duration(cfg.WindowMinutes) * time.Minute)
+    i := 0
+    for i < len(commentAttempts) && commentAttempts[i].Before(cutoff) {
+        i++
+    }
+    commentAttempts = commentAttempts[i:]
+    difficulty := cfg.Difficulty + len(commentAttempts)/maxInt(cfg.StepComments, 1)
+    if difficulty > cfg.MaxDifficulty {
+        difficulty = cfg.MaxDifficulty
+    }
+    if difficulty != challengeDifficulty {
+        if challengeDifficulty != 0 {
+            log.Printf("🛡  留言验证难度调整为 %d（%d 分钟内 %d 次提交）", difficulty, cfg.WindowMinutes, len(commentAttempts))
+        }
+        challengeDifficulty = difficulty
+    }
+    return difficulty
+}
+
+// serveCommentImage 提供留言图片：只公开已审核留言中的图片，待审核的图片仅管理员可见
+func serveCommentImage(w http.ResponseWriter, r *http.Request, city, name string) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    if !commentImagePattern.MatchString(name) {
+        writeError(w, r, http.StatusNotFound, "")
+        return
+    }
+    public, pending := false, false
+    commentsMutex.RLock()
+    for _, c := range comments[city] {
+        for _, img := range c.Images {
+            if img.Name == name {
+                if c.Pending {
+                    pending = true
+                } else {
+                    public = true
+                }
+            }
+        }
+    }
+    commentsMutex.RUnlock()
+    if !public {
+        if _, isAdmin := adminUser(r); !isAdmin || !pending {
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+    }
+
+    cfg := serverConfig.Attachments
+    filePath := filepath.Join(cfg.Dir, name)
+    contentType := "image/jpeg"
+    if strings.HasSuffix(name, ".png") {
+        contentType = "image/png"
+    }
+    if r.URL.Query().Get("size") == "thumb" {
+        var err error
+        filePath, contentType, err = resizedImage(filePath, cfg.ThumbWidth)
+        if err != nil {
+            log.Printf("⚠  生成留言图片缩略图失败: %s: %v", name, err)
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+    }
+    f, err := os.Open(filePath)
+    if err != nil {
+        writeError(w, r, http.StatusNotFound, "")
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+        return
+    }
+    w.Header().Set("Content-Type", contentType)
+    if public {
+        w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", serverConfig.Cache.AssetMaxAge))
+    } else {
+        w.Header().Set("Cache-Control", "private, no-store")
+    }
+    w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))+`"`)
+    http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func getRealIP(r *http.Request) string {
+    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+        ips := strings.Split(xff, ",")
+        if len(ips) > 0 {
+            return strings.TrimSpace(ips[0])
+        }
+    }
+    if xri := r.Header.Get("X-Real-IP"); xri != "" {
+        return xri
+    }
+    ip, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return ip
+}
+
+func securityCheck(clientIP string, r *http.Request) bool {
+    for _, blockedIP := range blacklistedIPs {
+        if clientIP == blockedIP {
+            return false
+        }
+    }
+    // User-Agent 的识别和处理由 botMiddleware 负责
+    return true
+}
+
+// resolveStaticPath 将 URL 路径规范化并解析为静态目录中的真实文件路径。
+// 逃逸出静态目录（包括经由符号链接）、点文件以及服务器自身文件返回 errPathForbidden。
+func resolveStaticPath(root string, urlPath string) (string, error) {
+    if !utf8.ValidString(urlPath) || strings.ContainsAny(urlPath, "\x00\\") {
+        return "", errPathForbidden
+    }
+    cleaned := path.Clean("/" + urlPath)
+    for _, segment := range strings.Split(cleaned, "/") {
+        if segment == "" {
+            continue
+        }
+        if strings.HasPrefix(segment, ".") || isDeniedStaticName(segment) {
+            return "", errPathForbidden
+        }
+    }
+    resolved, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(cleaned)))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return "", errPathNotFound
+        }
+        return "", errPathForbidden
+    }
+    if !isWithinDir(root, resolved) {
+        return "", errPathForbidden
+    }
+    return resolved, nil
+}
+
+func isDeniedStaticName(name string) bool {
+    cfg := serverConfig.Static
+    return containsFold(cfg.DeniedNames, name) || containsFold(cfg.DeniedExtensions, filepath.Ext(name))
+}
+
+// staticServeAllowed 按允许列表判断已解析的文件能否对外提供，目录仅在开启目录列表时允许
+func staticServeAllowed(root string, resolved string) bool {
+    cfg := serverConfig.Static
+    info, err := os.Stat(resolved)
+    if err != nil {
+        return false
+    }
+    if info.IsDir() {
+        return cfg.DirectoryListing
+    }
+    rel, err := filepath.Rel(root, resolved)
+    if err != nil {
+        return false
+    }
+    segments := strings.Split(filepath.ToSlash(rel), "/")
+    if len(segments) > 1 && len(cfg.AllowedDirs) > 0 && !containsFold(cfg.AllowedDirs, segments[0]) {
+        return false
+    }
+    if len(cfg.AllowedExtensions) > 0 && !containsFold(cfg.AllowedExtensions, filepath.Ext(resolved)) {
+        return false
+    }
+    return true
+}
+
+// auditStaticDir 启动时检查公开目录，提示其中存在的敏感文件和不会被提供的文件
+func auditStaticDir(staticDir string) {
+    log.Println("🔍 审计公开目录...")
+    sensitive := 0
+    hidden := 0
+    root, err := realPath(staticDir)
+    if err != nil {
+        log.Printf("⚠  无法审计公开目录: %v", err)
+        return
+    }
+    filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+        if err != nil || p == root {
+            return nil
+        }
+        name := d.Name()
+        if strings.HasPrefix(name, ".") || isDeniedStaticName(name) {
+            sensitive++
+            rel, _ := filepath.Rel(root, p)
+            log.Printf("⚠  公开目录中存在敏感文件（已拒绝访问，建议移出）: %s", rel)
+            if d.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !d.IsDir() && !staticServeAllowed(root, p) {
+            hidden++
+        }
+        return nil
+    })
+    if hidden > 0 {
+        log.Printf("💡 有 %d 个文件不在允许列表中，不会对外提供", hidden)
+    }
+    if sensitive == 0 {
+        log.Println("✅ 公开目录中没有发现敏感文件")
+    }
+}
+
+func realPath(dir string) (string, error) {
+    abs, err := filepath.Abs(dir)
+    if err != nil {
+        return "", err
+    }
+    return filepath.EvalSymlinks(abs)
+}
+
+func isWithinDir(root string, target string) bool {
+    rel, err := filepath.Rel(root, target)
+    if err != nil {
+        return false
+    }
+    return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// rateLimitCheck 按 key 统计最近一分钟的请求数，达到 limit 时拒绝
+func rateLimitCheck(key string, limit int) bool {
+    requestMutex.Lock()
+    defer requestMutex.Unlock()
+    now := time.Now()
+    cutoff := now.Add(-time.Minute)
+    if _, exists := requestCounts[key]; !exists {
+        requestCounts[key] = []time.Time{}
+    }
+    var validRequests []time.Time
+    for _, reqTime := range requestCounts[key] {
+        if reqTime.After(cutoff) {
+            validRequests = append(validRequests, reqTime)
+        }
+    }
+    if len(validRequests) >= limit {
+        return false
+    }
+    validRequests = append(validRequests, now)
+    requestCounts[key] = validRequests
+    return true
+}
+
+// isMediaRequest 判断请求是否为缩略图、背景音乐或分段下载，这类请求使用单独的频率限制
+func isMediaRequest(r *http.Request) bool {
+    return strings.HasPrefix(r.URL.Path, "/img/") || strings.HasPrefix(r.URL.Path, "/music/") || r.Header.Get("Range") != ""
+}
+
+func recordAccess(clientIP string, r *http.Request) {
+    recordsMutex.Lock()
+    defer recordsMutex.Unlock()
+    record, exists := accessRecords[clientIP]
+    bot := botInfoOf(r)
+    if !exists {
+        // 爬虫不计入访客统计，也不查询地理位置
+        geoInfo := &IPGeolocation{}
+        if bot.Class == "human" {
+            geoInfo = getGeoLocation(clientIP)
+        }
+        record = &AccessRecord{
+            IP:           clientIP,
+            UserAgent:    r.UserAgent(),
+            FirstVisit:   time.Now(),
+            LastVisit:    time.Now(),
+            VisitCount:   1,
+            Country:      geoInfo.Country,
+            Region:       geoInfo.RegionName,
+            City:         geoInfo.City,
+            ISP:          geoInfo.ISP,
+            PagesVisited: []string{r.URL.Path},
+            Blocked:      false,
+            BotClass:     bot.Class,
+            BotName:      bot.Name,
+            BotVerified:  bot.Verified,
+        }
+        log.Printf("🆕 新访客: IP %s, 地区: %s %s %s, ISP: %s", 
+            clientIP, geoInfo.Country, geoInfo.RegionName, geoInfo.City, geoInfo.ISP)
+    } else {
+        record.LastVisit = time.Now()
+        record.VisitCount++
+        found := false
+        for _, page := range record.PagesVisited {
+            if page == r.URL.Path {
+                found = true
+                break
+            }
+        }
+        if !found {
+            record.PagesVisited = append(record.PagesVisited, r.URL.Path)
+        }
+    }
+    if bot.Class != "human" || record.BotClass == "" {
+        // 同一 IP 的普通访问不覆盖之前识别出的爬虫类别
+        record.BotClass = bot.Class
+        record.BotName = bot.Name
+        record.BotVerified = bot.Verified
+    }
+    accessRecords[clientIP] = record
+    logEntry := fmt.Sprintf("[%s] IP: %s | Path: %s | Agent: %s | Visits: %d | Location: %s %s %s\n",
+        time.Now().Format("2006-01-02 15:04:05"),
+        clientIP,
+        r.URL.Path,
+        r.UserAgent(),
+        record.VisitCount,
+        record.Country,
+        record.Region,
+        record.City,
+    )
+    logFile.WriteString(logEntry)
+    logFile.Sync()
+}
+
+func getGeoLocation(ip string) *IPGeolocation {
+    if isLocalIP(ip) {
+        return &IPGeolocation{
+            IP:      ip,
+            Country: "Local",
+            Region:  "Local",
+            City:    "Local",
+            ISP:     "Local Network",
+        }
+    }
+    url := fmt.Sprintf("http://ip-api.com/json/%s?fields=status,message,country,countryCode,region,regionName,city,zip,lat,lon,timezone,isp,org,as,query", ip)
+    resp, err := http.Get(url)
+    if err != nil {
+        log.Printf("获取地理位置信息失败: %v", err)
+        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        log.Printf("读取地理位置响应失败: %v", err)
+        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    }
+    var geoInfo IPGeolocation
+    if err := json.Unmarshal(body, &geoInfo); err != nil {
+        log.Printf("解析地理位置信息失败: %v", err)
+        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    }
+    if geoInfo.Status != "success" {
+        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    }
+    return &geoInfo
+}
+
+func isLocalIP(ip string) bool {
+    localRanges := []string{"127.", "192.168.", "10.", "172.16.", "172.17.", "172.18.", "172.19.", 
+                          "172.20.", "172.21.", "172.22.", "172.23.", "172.24.", "172.25.", 
+                          "172.26.", "172.27.", "172.28.", "172.29.", "172.30.", "172.31.", "::1"}
+    for _, localRange := range localRanges {
+        if strings.HasPrefix(ip, localRange) {
+            return true
+        }
+    }
+    return false
+}
+
+func logSecurityEvent(clientIP string, r *http.Request, eventType string) {
+    log.Printf("🚨 安全事件 [%s]: IP %s | Path: %s | Agent: %s", 
+        eventType, clientIP, r.URL.Path, r.UserAgent())
+    recordsMutex.Lock()
+    if record, exists := accessRecords[clientIP]; exists {
+        record.Blocked = true
+        record.BlockReason = eventType
+    }
+    recordsMutex.Unlock()
+}
+
+// accessControlMiddleware 对所有路由统一执行 IP 黑名单和频率限制，媒体请求单独计数；
+// 未配置管理员令牌时 /admin/ 接口一律返回 404
+func accessControlMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasPrefix(r.URL.Path, "/admin/") && !adminEnabled() {
+            writeError(w, r, http.StatusNotFound, "管理接口未启用")
+            return
+        }
+        clientIP := getRealIP(r)
+        if !securityCheck(clientIP, r) {
+            logSecurityEvent(clientIP, r, "BLOCKED")
+            writeError(w, r, http.StatusForbidden, "访问被拒绝")
+            return
+        }
+        key, limit := clientIP, rateLimitPerMinute
+        if isMediaRequest(r) {
+            key, limit = "media|"+clientIP, mediaRateLimitPerMinute
+        }
+        if !rateLimitCheck(key, limit) {
+            logSecurityEvent(clientIP, r, "RATE_LIMITED")
+            writeError(w, r, http.StatusTooManyRequests, "请求过多")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// botMiddleware 识别爬虫并按类别策略处理：block 直接拒绝，throttle 使用更严格的频率限制，
+// cached 只允许读取并跳过逐请求的 nonce 渲染，使页面走共享的压缩缓存
+func botMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !serverConfig.Bots.Enabled {
+            next.ServeHTTP(w, r)
+            return
+        }
+        clientIP := getRealIP(r)
+        info := classifyRequest(clientIP, r)
+        r = r.WithContext(context.WithValue(r.Context(), botInfoKey, info))
+
+        switch botPolicy(info.Class) {
+        case "block":
+            logSecurityEvent(clientIP, r, "BOT_BLOCKED")
+            writeError(w, r, http.StatusForbidden, "访问被拒绝")
+            return
+        case "throttle":
+            if botRequestRate(clientIP) > serverConfig.Bots.ThrottlePerMinute {
+                logSecurityEvent(clientIP, r, "BOT_THROTTLED")
+                w.Header().Set("Retry-After", "60")
+                writeError(w, r, http.StatusTooManyRequests, "请求过多")
+                return
+            }
+        case "cached":
+            if r.Method != http.MethodGet && r.Method != http.MethodHead {
+                writeError(w, r, http.StatusForbidden, "访问被拒绝")
+                return
+            }
+            r = r.WithContext(context.WithValue(r.Context(), cspNonceKey, ""))
+            setSecurityHeaders(w, r.URL.Path, "")
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// botInfoOf 返回 botMiddleware 的识别结果，未识别时视为普通访客
+func botInfoOf(r *http.Request) BotInfo {
+    if info, ok := r.Context().Value(botInfoKey).(BotInfo); ok {
+        return info
+    }
+    return BotInfo{Class: "human"}
+}
+
+// botPolicy 返回类别对应的处理策略，未配置的类别放行
+func botPolicy(class string) string {
+    if policy, ok := serverConfig.Bots.Policies[class]; ok {
+        return policy
+    }
+    return "allow"
+}
+
+// loadBotPatterns 编译配置中的规则，并追加规则文件中的条目
+func loadBotPatterns() {
+    cfg := serverConfig.Bots
+    patterns := append([]BotPattern{}, cfg.Patterns...)
+    if cfg.PatternsFile != "" {
+        data, err := os.ReadFile(cfg.PatternsFile)
+        if err != nil {
+            log.Printf("⚠  读取爬虫规则文件失败: %v", err)
+        } else {
+            var extra []struct {
+                Pattern string `json:"pattern"`
+            }
+            if err := json.Unmarshal(data, &extra); err != nil {
+                log.Printf("⚠  解析爬虫规则文件失败: %v", err)
+            }
+            for _, e := range extra {
+                patterns = append(patterns, BotPattern{Name: e.Pattern, Pattern: e.Pattern, Class: "bot"})
+            }
+        }
+    }
+    compiled := make([]compiledBotPattern, 0, len(patterns))
+    for _, p := range patterns {
+        re, err := regexp.Compile("(?i)" + p.Pattern)
+        if err != nil {
+            log.Printf("⚠  忽略无效的爬虫规则 %q: %v", p.Pattern, err)
+            continue
+        }
+        compiled = append(compiled, compiledBotPattern{BotPattern: p, re: re})
+    }
+    botPatterns = compiled
+    log.Printf("🤖 已加载 %d 条爬虫识别规则", len(botPatterns))
+}
+
+// classifyRequest 结合 User-Agent 和请求频率识别请求来源
+func classifyRequest(clientIP string, r *http.Request) BotInfo {
+    info := classifyUserAgent(clientIP, r.UserAgent())
+    rate := botRecordRequest(clientIP)
+    if info.Class == "human" && serverConfig.Bots.AggressivePerMinute > 0 && rate > serverConfig.Bots.AggressivePerMinute {
+        info = BotInfo{Class: "aggressive", Name: "high request rate"}
+    }
+    return info
+}
+
+// classifyUserAgent 按规则匹配 User-Agent，需要验证的爬虫做反向 DNS 校验，结果按 IP 和 UA 缓存
+func classifyUserAgent(clientIP, userAgent string) BotInfo {
+    key := clientIP + "|" + userAgent
+    botVerdictsMutex.Lock()
+    verdict, ok := botVerdicts[key]
+    botVerdictsMutex.Unlock()
+    if ok && time.Now().Before(verdict.expires) {
+        return verdict.info
+    }
+
+    info := BotInfo{Class: "human"}
+    ttl := time.Duration(serverConfig.Bots.VerifyCacheMinutes) * time.Minute
+    if strings.TrimSpace(userAgent) == "" {
+        info = BotInfo{Class: "tool", Name: "empty user agent"}
+    }
+    for _, p := range botPatterns {
+        if info.Class != "human" {
+            break
+        }
+        if !p.re.MatchString(userAgent) {
+            continue
+        }
+        info = BotInfo{Class: p.Class, Name: p.Name}
+        if len(p.VerifyDomains) > 0 {
+            verified, err := verifyCrawlerIP(clientIP, p.VerifyDomains)
+            switch {
+            case err != nil:
+                // DNS 查询失败时不能判定真假，按普通爬虫处理并尽快重试
+                log.Printf("⚠  验证爬虫 %s 失败: IP %s: %v", p.Name, clientIP, err)
+                info.Class = "bot"
+                ttl = time.Minute
+            case verified:
+                info.Verified = true
+            default:
+                info.Class = "fake"
+            }
+        }
+    }
+    if info.Class != "human" && !ok {
+        log.Printf("🤖 识别到爬虫: IP %s, 类别: %s, 名称: %s, 已验证: %v", clientIP, info.Class, info.Name, info.Verified)
+    }
+
+    botVerdictsMutex.Lock()
+    if len(botVerdicts) > 10000 {
+        now := time.Now()
+        for k, v := range botVerdicts {
+            if now.After(v.expires) {
+                delete(botVerdicts, k)
+            }
+        }
+    }
+    botVerdicts[key] = &botVerdict{info: info, expires: time.Now().Add(ttl)}
+    botVerdictsMutex.Unlock()
+    return info
+}
+
+// verifyCrawlerIP 反向解析 IP 得到主机名，确认属于爬虫的域名后再正向解析回原 IP
+func verifyCrawlerIP(clientIP string, domains []string) (bool, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), time.Duration(serverConfig.Bots.VerifyTimeoutMs)*time.Millisecond)
+    defer cancel()
+    names, err := botResolver.LookupAddr(ctx, clientIP)
+    if err != nil {
+        var dnsErr *net.DNSError
+        if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+            return false, nil
+        }
+        return false, err
+    }
+    for _, name := range names {
+        host := strings.ToLower(strings.TrimSuffix(name, "."))
+        matched := false
+        for _, domain := range domains {
+            if host == domain || strings.HasSuffix(host, "."+domain) {
+                matched = true
+                break
+            }
+        }
+        if !matched {
+            continue
+        }
+        addrs, err := botResolver.LookupHost(ctx, host)
+        if err != nil {
+            continue
+        }
+        for _, addr := range addrs {
+            if addr == clientIP {
+                return true, nil
+            }
+        }
+    }
+    return false, nil
+}
+
+// botRecordRequest 记录一次请求并返回该 IP 最近一分钟的请求数
+func botRecordRequest(clientIP string) int {
+    botActivityMutex.Lock()
+    defer botActivityMutex.Unlock()
+    cutoff := time.Now().Add(-time.Minute)
+    var recent []time.Time
+    for _, t := range botActivity[clientIP] {
+        if t.After(cutoff) {
+            recent = append(recent, t)
+        }
+    }
+    recent = append(recent, time.Now())
+    botActivity[clientIP] = recent
+    return len(recent)
+}
+
+// pruneRequestWindows 删除最近一分钟没有请求的 IP，避免限流和爬虫计数表无限增长
+func pruneRequestWindows() {
+    cutoff := time.Now().Add(-time.Minute)
+    prune := func(windows map[string][]time.Time) {
+        for ip, times := range windows {
+            if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+                delete(windows, ip)
+            }
+        }
+    }
+    requestMutex.Lock()
+    prune(requestCounts)
+    requestMutex.Unlock()
+    botActivityMutex.Lock()
+    prune(botActivity)
+    botActivityMutex.Unlock()
+}
+
+// botRequestRate 返回该 IP 最近一分钟的请求数（包含当前请求）
+func botRequestRate(clientIP string) int {
+    botActivityMutex.Lock()
+    defer botActivityMutex.Unlock()
+    return len(botActivity[clientIP])
+}
+
+func defaultServerConfig() *ServerConfig {
+    return &ServerConfig{
+        SecurityHeaders: SecurityHeadersConfig{
+            // 城市页面使用高德地图 JS API，需要放行 amap/autonavi 的脚本、瓦片和接口
+            ContentSecurityPolicy: "default-src 'self'; " +
+                "script-src 'self' 'nonce-{nonce}' https://*.amap.com; " +
+                "style-src 'self' 'unsafe-inline' https://*.amap.com; " +
+                "img-src 'self' data: blob: https://*.amap.com https://*.is.autonavi.com; " +
+                "connect-src 'self' https://*.amap.com; " +
+                "font-src 'self' data:; media-src 'self'; worker-src 'self' blob:; " +
+                "object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'",
+            UseNonce:                  true,
+            PermissionsPolicy:         "camera=(), microphone=(), geolocation=(), payment=(), usb=(), interest-cohort=()",
+            CrossOriginOpenerPolicy:   "same-origin",
+            CrossOriginResourcePolicy: "same-origin",
+            ReferrerPolicy:            "strict-origin-when-cross-origin",
+            FrameOptions:              "DENY",
+            RouteOverrides: map[string]map[string]string{
+                "/comments/": {
+                    "Content-Security-Policy":      "default-src 'none'; frame-ancestors 'none'",
+                    "Cross-Origin-Resource-Policy": "cross-origin",
+                },
+                "/admin/": {
+                    "Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+                    "Cache-Control":           "no-store",
+                },
+                "/api/": {
+                    "Content-Security-Policy":      "default-src 'none'; frame-ancestors 'none'",
+                    "Cross-Origin-Resource-Policy": "cross-origin",
+                },
+                "/health": {
+                    "Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+                },
+            },
+        },
+        CORS: CORSConfig{
+            AllowedOrigins: []string{
+                "http://1.95.203.92:9099",
+                "http://localhost:9099",
+                "http://127.0.0.1:9099",
+                "http://localhost:3000",
+            },
+            AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+            AllowedHeaders: []string{"Content-Type"},
+            MaxAge:         600,
+            Routes:         []string{"/comments/", "/api/"},
+        },
+        Server: ServerLimitsConfig{
+            Addr:                     ":9099",
+            ReadHeaderTimeoutSeconds: 5,
+            ReadTimeoutSeconds:       15,
+            // 背景音乐等大文件需要较长的写超时
+            WriteTimeoutSeconds:      120,
+            IdleTimeoutSeconds:       60,
+            MaxHeaderBytes:           16 << 10,
+            MaxBodyBytes:             1 << 20,
+            RouteBodyLimits: map[string]int64{
+                // 留言可以附带图片，纯文本留言在处理函数中另有 16KB 上限
+                "/comments/":     32 << 20,
+                "/admin/upload/": 200 << 20,
+            },
+            // 大请求体在慢速网络上需要更长的读取时间
+            RouteReadTimeouts: map[string]int{
+                "/comments/":     120,
+                "/admin/upload/": 900,
+            },
+            MaxConnsPerIP: 32,
+        },
+        Static: StaticConfig{
+            Dir: "./MyTravelDiary",
+            AllowedExtensions: []string{
+                ".html", ".css", ".js", ".jpg", ".jpeg", ".png", ".gif", ".svg", ".ico", ".webp",
+                ".mp3", ".ogg", ".m4a", ".flac", ".txt",
+            },
+            AllowedDirs: []string{"images", "imagesxjp", "imggz", "imgnj", "imgszc", "imgzjj", "bgm", "city"},
+            DeniedNames: []string{
+                "server.js", "comments.json", "node_modules", "package.json", "package-lock.json",
+                "config.json", "access.log", "access_records.json",
+            },
+            DeniedExtensions: []string{".json", ".md", ".log", ".bak", ".env", ".go", ".sh", ".py", ".lock"},
+            ErrorPagesDir:    "errors",
+        },
+        Compression: CompressionConfig{
+            Enabled:          true,
+            Precompressed:    true,
+            CompressibleExts: []string{".html", ".css", ".js", ".svg", ".txt", ".json", ".xml", ".ico"},
+            MinSize:          1024,
+            CacheMaxBytes:    32 << 20,
+            Level:            gzip.BestCompression,
+        },
+        Cache: CacheConfig{
+            AssetMaxAge:      3600,
+            ImmutableMaxAge:  31536000,
+            HTMLCacheControl: "no-cache",
+        },
+        Images: ImageConfig{
+            SourceDirs:    []string{"images", "imagesxjp", "imggz", "imgnj", "imgszc", "imgzjj"},
+            CacheDir:      "./image_cache",
+            CacheMaxBytes: 512 << 20,
+            AllowedWidths: []int{160, 320, 480, 640, 800, 1024, 1280, 1600},
+            Quality:       80,
+            MaxConcurrent: 2,
+        },
+        Photos: PhotoConfig{
+            StripGPS:              false,
+            RescanIntervalSeconds: 600,
+        },
+        Gallery: GalleryConfig{
+            DirPrefixes:         []string{"img", "images"},
+            PollIntervalSeconds: 10,
+            ThumbWidth:          320,
+        },
+        Admin: AdminConfig{
+            Tokens: map[string]string{},
+        },
+        Upload: UploadConfig{
+            MaxFileBytes: 15 << 20,
+            MaxFiles:     20,
+            MaxPixels:    50000000,
+            Naming:       "sequence",
+            AuditLogFile: "upload_audit.log",
+        },
+        Music: MusicConfig{
+            Dir: "bgm",
+            Tracks: map[string][]string{
+                "homepage": {"belinda carlisle - Heaven Is A Place On Earth.mp3"},
+            },
+            Default: "homepage",
+        },
+        Cities: []CityInfo{
+            {Abbr: "nj", Name: "南京", NameEn: "Nanjing", Page: "nj.html", ImageDir: "imgnj",
+                Music: []string{"M2M - The Day You Went Away.mp3"}, Lat: 32.0603, Lon: 118.7969},
+            {Abbr: "szc", Name: "深圳", NameEn: "Shenzhen", Page: "szc.html", ImageDir: "imgszc",
+                Music: []string{"陈冠希、MC仁、厨房仔、应采儿 - Everywhere We Go.mp3"}, Lat: 22.5431, Lon: 114.0579},
+            {Abbr: "sz", Name: "苏州", NameEn: "Suzhou", Page: "sz.html", Lat: 31.2990, Lon: 120.5853},
+            {Abbr: "jj", Name: "九江", NameEn: "Jiujiang", Page: "jj.html", Lat: 29.7050, Lon: 116.0019},
+            {Abbr: "nc", Name: "南昌", NameEn: "Nanchang", Page: "nc.html", Lat: 28.6829, Lon: 115.8579},
+            {Abbr: "xjp", Name: "新加坡", NameEn: "Singapore", Page: "xjp.html", ImageDir: "imagesxjp",
+                Music: []string{"Sweetbox - Every Step.mp3"}, Lat: 1.3521, Lon: 103.8198},
+            {Abbr: "mlxy", Name: "马来西亚", NameEn: "Malaysia", Page: "mlxy.html", ImageDir: "images",
+                Music: []string{"Green Day - Basket Case.mp3"}, Lat: 3.1390, Lon: 101.6869},
+            {Abbr: "zjj", Name: "张家界", NameEn: "Zhangjiajie", Page: "zjj.html", ImageDir: "imgzjj",
+                Music: []string{"Toby Fox - His Theme.mp3"}, Lat: 29.1170, Lon: 110.4792},
+            {Abbr: "gz", Name: "广州", NameEn: "Guangzhou", Page: "gz.html", ImageDir: "imggz", Lat: 23.1291, Lon: 113.2644},
+        },
+        Render: RenderConfig{
+            DiaryDir:    "./diaries",
+            RoutePrefix: "/city/",
+            OutputDir:   "./MyTravelDiary/city",
+            AMapKey:     "d8d3465a5f9be7e0036b5e7606968a33",
+        },
+        Feed: FeedConfig{
+            Title:           "MyTravelDiary",
+            Description:     "我们的旅行日记和留言",
+            MaxItems:        50,
+            IncludeComments: true,
+            CacheSeconds:    300,
+        },
+        Bots: BotConfig{
+            Enabled: true,
+            Patterns: []BotPattern{
+                {Name: "Googlebot", Pattern: `googlebot|google-inspectiontool|adsbot-google|mediapartners-google`, Class: "search", VerifyDomains: []string{"googlebot.com", "google.com"}},
+                {Name: "Bingbot", Pattern: `bingbot|msnbot|bingpreview`, Class: "search", VerifyDomains: []string{"search.msn.com"}},
+                {Name: "Baiduspider", Pattern: `baiduspider`, Class: "search", VerifyDomains: []string{"baidu.com", "baidu.jp"}},
+                {Name: "YandexBot", Pattern: `yandex(bot|images|mobilebot)`, Class: "search", VerifyDomains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+                {Name: "Sogou", Pattern: `sogou (web|inst) spider`, Class: "search", VerifyDomains: []string{"sogou.com"}},
+                {Name: "Applebot", Pattern: `applebot`, Class: "search", VerifyDomains: []string{"applebot.apple.com"}},
+                {Name: "DuckDuckBot", Pattern: `duckduckbot`, Class: "search"},
+                {Name: "360Spider", Pattern: `360spider|haosouspider`, Class: "search"},
+                {Name: "AI crawler", Pattern: `gptbot|chatgpt-user|oai-searchbot|ccbot|claudebot|claude-web|anthropic-ai|bytespider|perplexitybot|amazonbot|google-extended|cohere-ai|diffbot`, Class: "ai"},
+                {Name: "Link preview", Pattern: `facebookexternalhit|facebot|twitterbot|slackbot|telegrambot|whatsapp|discordbot|linkedinbot|embedly|redditbot|skypeuripreview|pinterest|vkshare|iframely`, Class: "preview"},
+                {Name: "Monitor", Pattern: `uptimerobot|pingdom|statuscake|site24x7|better ?uptime|freshping`, Class: "monitor"},
+                {Name: "HTTP tool", Pattern: `^curl/|^wget/|python-requests|python-urllib|aiohttp|go-http-client|okhttp|^java/|libwww-perl|scrapy|headlesschrome|phantomjs|httpclient|node-fetch|axios`, Class: "tool"},
+                {Name: "Generic bot", Pattern: `bot\b|crawl|spider|scraper|slurp|fetcher`, Class: "bot"},
+            },
+            Policies: map[string]string{
+                "human":      "allow",
+                "search":     "allow",
+                "preview":    "cached",
+                "monitor":    "allow",
+                "ai":         "throttle",
+                "tool":       "throttle",
+                "bot":        "throttle",
+                "aggressive": "throttle",
+                "fake":       "block",
+            },
+            ThrottlePerMinute:   20,
+            AggressivePerMinute: 120,
+            VerifyTimeoutMs:     2000,
+            VerifyCacheMinutes:  1440,
+        },
+        Search: SearchConfig{
+            RefreshSeconds: 60,
+            MaxQueryRunes:  64,
+            SnippetRunes:   120,
+        },
+        Notify: NotifyConfig{
+            DigestIntervalMinutes: 60,
+            MaxRetries:            5,
+            RetryBaseSeconds:      30,
+            QueueSize:             1000,
+        },
+        Identity: IdentityConfig{
+            Enabled:           true,
+            CookieName:        "td_identity",
+            CookieMaxAgeDays:  90,
+            ReservedNicks:     []string{"admin", "administrator", "root", "管理员", "站长", "博主", "MyTravelDiary"},
+            MinPasswordLength: 8,
+            MagicLinkMinutes:  15,
+            MaxAttemptsPerIP:  20,
+        },
+        Attachments: AttachmentConfig{
+            Enabled:           true,
+            Dir:               "./comment_uploads",
+            MaxImages:         3,
+            MaxFileBytes:      8 << 20,
+            MaxPixels:         40000000,
+            MaxDimension:      2048,
+            ThumbWidth:        320,
+            Quality:           85,
+            HoldForModeration: true,
+        },
+        Challenge: ChallengeConfig{
+            Enabled:       true,
+            Difficulty:    16,
+            MaxDifficulty: 20,
+            TTLSeconds:    300,
+            WindowMinutes: 10,
+            StepComments:  30,
+        },
+        SEO: SEOConfig{
+            SiteName:  "MyTravelDiary",
+            OpenGraph: true,
+            Robots: []RobotsRule{
+                {UserAgent: "*", Allow: []string{"/"}, Disallow: []string{"/admin/", "/api/", "/comments/", "/music/"}},
+            },
+        },
+    }
+}
+
+// findCity 按缩写查找城市登记信息
+func findCity(abbr string) (*CityInfo, bool) {
+    for i := range serverConfig.Cities {
+        if serverConfig.Cities[i].Abbr == abbr {
+            return &serverConfig.Cities[i], true
+        }
+    }
+    return nil, false
+}
+
+// cityImageDirs 返回 城市缩写 -> 图片目录 的映射
+func cityImageDirs() map[string]string {
+    dirs := make(map[string]string)
+    for _, city := range serverConfig.Cities {
+        if city.ImageDir != "" {
+            dirs[city.Abbr] = city.ImageDir
+        }
+    }
+    return dirs
+}
+
+func loadConfig() {
+    data, err := os.ReadFile("config.json")
+    if err != nil {
+        log.Println("⚙  没有找到配置文件 config.json，使用默认配置")
+        return
+    }
+    if err := json.Unmarshal(data, serverConfig); err != nil {
+        log.Printf("⚠  加载配置文件失败，使用默认配置: %v", err)
+        serverConfig = defaultServerConfig()
+        return
+    }
+    log.Println("⚙  已加载配置文件 config.json")
+}
+
+// securityHeadersMiddleware 为所有路由（包括 404 和错误响应）统一设置安全响应头
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        cfg := serverConfig.SecurityHeaders
+        nonce := ""
+        if cfg.UseNonce && strings.Contains(cfg.ContentSecurityPolicy, "{nonce}") {
+            nonce = generateNonce()
+            r = r.WithContext(context.WithValue(r.Context(), cspNonceKey, nonce))
+        }
+        setSecurityHeaders(w, r.URL.Path, nonce)
+        next.ServeHTTP(w, r)
+    })
+}
+
+func setSecurityHeaders(w http.ResponseWriter, path string, nonce string) {
+    cfg := serverConfig.SecurityHeaders
+    h := w.Header()
+    h.Set("X-Content-Type-Options", "nosniff")
+    setHeaderIfNotEmpty(h, "X-Frame-Options", cfg.FrameOptions)
+    setHeaderIfNotEmpty(h, "Referrer-Policy", cfg.ReferrerPolicy)
+    setHeaderIfNotEmpty(h, "Permissions-Policy", cfg.PermissionsPolicy)
+    setHeaderIfNotEmpty(h, "Cross-Origin-Opener-Policy", cfg.CrossOriginOpenerPolicy)
+    setHeaderIfNotEmpty(h, "Cross-Origin-Resource-Policy", cfg.CrossOriginResourcePolicy)
+    setHeaderIfNotEmpty(h, "Strict-Transport-Security", cfg.StrictTransportSecurity)
+
+    cspHeader := "Content-Security-Policy"
+    if cfg.CSPReportOnly {
+        cspHeader = "Content-Security-Policy-Report-Only"
+    }
+    setHeaderIfNotEmpty(h, cspHeader, expandCSP(cfg.ContentSecurityPolicy, nonce))
+
+    // 路由覆盖：取最长匹配前缀，值为空表示删除该响应头
+    if overrides := matchRouteOverrides(cfg.RouteOverrides, path); overrides != nil {
+        for name, value := range overrides {
+            if name == "Content-Security-Policy" {
+                name = cspHeader
+                value = expandCSP(value, nonce)
+            }
+            if value == "" {
+                h.Del(name)
+            } else {
+                h.Set(name, value)
+            }
+        }
+    }
+}
+
+func setHeaderIfNotEmpty(h http.Header, name, value string) {
+    if value != "" {
+        h.Set(name, value)
+    }
+}
+
+func matchRouteOverrides(overrides map[string]map[string]string, path string) map[string]string {
+    best := ""
+    for prefix := range overrides {
+        if strings.HasPrefix(path, prefix) && len(prefix) > len(best) {
+            best = prefix
+        }
+    }
+    if best == "" {
+        return nil
+    }
+    return overrides[best]
+}
+
+func expandCSP(policy string, nonce string) string {
+    if nonce == "" {
+        return strings.ReplaceAll(policy, " 'nonce-{nonce}'", "")
+    }
+    return strings.ReplaceAll(policy, "{nonce}", nonce)
+}
+
+// corsMiddleware 为 API 路由处理跨域请求：匹配来源后回显该来源，并统一应答预检请求
+func corsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        cfg := serverConfig.CORS
+        if !isCORSRoute(cfg, r.URL.Path) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        h := w.Header()
+        h.Add("Vary", "Origin")
+        origin := r.Header.Get("Origin")
+        allowed := origin != "" && originAllowed(cfg.AllowedOrigins, origin)
+        if allowed {
+            h.Set("Access-Control-Allow-Origin", origin)
+            if cfg.AllowCredentials {
+                h.Set("Access-Control-Allow-Credentials", "true")
+            }
+            if len(cfg.ExposedHeaders) > 0 {
+                h.Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+            }
+        }
+
+        if r.Method != http.MethodOptions {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        // 预检请求
+        h.Add("Vary", "Access-Control-Request-Method")
+        h.Add("Vary", "Access-Control-Request-Headers")
+        h.Set("Allow", strings.Join(cfg.AllowedMethods, ", "))
+        reqMethod := r.Header.Get("Access-Control-Request-Method")
+        if reqMethod == "" {
+            // 普通的 OPTIONS 请求，不是预检
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        if !allowed || !containsFold(cfg.AllowedMethods, reqMethod) || !headersAllowed(cfg.AllowedHeaders, r.Header.Get("Access-Control-Request-Headers")) {
+            log.Printf("🚫 拒绝跨域预检: Origin %s, Method %s, Path %s", origin, reqMethod, r.URL.Path)
+            h.Del("Access-Control-Allow-Origin")
+            h.Del("Access-Control-Allow-Credentials")
+            h.Del("Access-Control-Expose-Headers")
+            w.WriteHeader(http.StatusForbidden)
+            return
+        }
+        h.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+        if len(cfg.AllowedHeaders) > 0 {
+            h.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+        }
+        if cfg.MaxAge > 0 {
+            h.Set("Access-Control-Max-Age", fmt.Sprint(cfg.MaxAge))
+        }
+        w.WriteHeader(http.StatusNoContent)
+    })
+}
+
+func isCORSRoute(cfg CORSConfig, path string) bool {
+    for _, prefix := range cfg.Routes {
+        if strings.HasPrefix(path, prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+func originAllowed(allowedOrigins []string, origin string) bool {
+    origin = strings.ToLower(origin)
+    for _, pattern := range allowedOrigins {
+        pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+        if pattern == "*" || pattern == origin {
+            return true
+        }
+        // 子域名通配：https://*.example.com 匹配 https://a.example.com、https://a.b.example.com
+        idx := strings.Index(pattern, "://*.")
+        if idx < 0 {
+            continue
+        }
+        prefix := pattern[:idx+3]
+        suffix := pattern[idx+4:]
+        if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+            continue
+        }
+        sub := origin[len(prefix) : len(origin)-len(suffix)]
+        if sub != "" && !strings.ContainsAny(sub, "/:@?#") {
+            return true
+        }
+    }
+    return false
+}
+
+func headersAllowed(allowedHeaders []string, requested string) bool {
+    for _, name := range strings.Split(requested, ",") {
+        name = strings.TrimSpace(name)
+        if name != "" && !containsFold(allowedHeaders, name) {
+            return false
+        }
+    }
+    return true
+}
+
+func containsFold(list []string, value string) bool {
+    for _, item := range list {
+        if strings.EqualFold(item, value) {
+            return true
+        }
+    }
+    return false
+}
+
+// bodyLimitMiddleware 限制请求体大小：声明的 Content-Length 超限直接拒绝，其余由 MaxBytesReader 截断
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        limit := bodyLimitFor(r.URL.Path)
+        if limit > 0 {
+            if r.ContentLength > limit {
+                log.Printf("🚫 请求体过大: %d 字节 (上限 %d), Path: %s, IP: %s", r.ContentLength, limit, r.URL.Path, getRealIP(r))
+                writeError(w, r, http.StatusRequestEntityTooLarge, "请求体过大")
+                return
+            }
+            r.Body = http.MaxBytesReader(w, r.Body, limit)
+        }
+        // 写入时限从读完请求体算起，否则慢速上传会占用响应的写入时间
+        if timeout := readTimeoutFor(r.URL.Path); timeout > 0 {
+            rc := http.NewResponseController(w)
+            readDeadline := time.Now().Add(timeout)
+            rc.SetReadDeadline(readDeadline)
+            if write := serverConfig.Server.WriteTimeoutSeconds; write > 0 {
+                rc.SetWriteDeadline(readDeadline.Add(time.Duration(write) * time.Second))
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// readTimeoutFor 返回路由的请求体读取时限，0 表示不限制
+func readTimeoutFor(path string) time.Duration {
+    cfg := serverConfig.Server
+    best := ""
+    for prefix := range cfg.RouteReadTimeouts {
+        if strings.HasPrefix(path, prefix) && len(prefix) > len(best) {
+            best = prefix
+        }
+    }
+    if best != "" {
+        return time.Duration(cfg.RouteReadTimeouts[best]) * time.Second
+    }
+    return time.Duration(cfg.ReadTimeoutSeconds) * time.Second
+}
+
+func bodyLimitFor(path string) int64 {
+    cfg := serverConfig.Server
+    best := ""
+    for prefix := range cfg.RouteBodyLimits {
+        if strings.HasPrefix(path, prefix) && len(prefix) > len(best) {
+            best = prefix
+        }
+    }
+    if best != "" {
+        return cfg.RouteBodyLimits[best]
+    }
+    return cfg.MaxBodyBytes
+}
+
+// perIPLimitListener 限制每个远端 IP 的并发连接数，防止单个客户端用慢速连接占满服务器
+type perIPLimitListener struct {
+    net.Listener
+    max    int
+    mu     sync.Mutex
+    counts map[string]int
+}
+
+type perIPConn struct {
+    net.Conn
+    ip       string
+    listener *perIPLimitListener
+    once     sync.Once
+}
+
+func newPerIPLimitListener(l net.Listener, max int) net.Listener {
+    if max <= 0 {
+        return l
+    }
+    return &perIPLimitListener{Listener: l, max: max, counts: make(map[string]int)}
+}
+
+func (l *perIPLimitListener) Accept() (net.Conn, error) {
+    for {
+        conn, err := l.Listener.Accept()
+        if err != nil {
+            return nil, err
+        }
+        ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+        if err != nil {
+            ip = conn.RemoteAddr().String()
+        }
+        l.mu.Lock()
+        if l.counts[ip] >= l.max {
+            l.mu.Unlock()
+            log.Printf("🚫 连接数超限: IP %s 已有 %d 个连接", ip, l.max)
+            conn.Close()
+            continue
+        }
+        l.counts[ip]++
+        l.mu.Unlock()
+        return &perIPConn{Conn: conn, ip: ip, listener: l}, nil
+    }
+}
+
+func (l *perIPLimitListener) release(ip string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.counts[ip]--
+    if l.counts[ip] <= 0 {
+        delete(l.counts, ip)
+    }
+}
+
+func (c *perIPConn) Close() error {
+    c.once.Do(func() { c.listener.release(c.ip) })
+    return c.Conn.Close()
+}
+
+func generateNonce() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        log.Printf("⚠  生成 CSP nonce 失败: %v", err)
+        return ""
+    }
+    return base64.StdEncoding.EncodeToString(b)
+}
+
+func cspNonce(r *http.Request) string {
+    nonce, _ := r.Context().Value(cspNonceKey).(string)
+    return nonce
+}
+
+var (
+    scriptTagPattern = regexp.MustCompile(`(?i)<script\b[^>]*>`)
+    scriptSrcPattern = regexp.MustCompile(`(?i)\ssrc\s*=`)
+)
+
+// addScriptNonce 只为内联脚本加 nonce，外部脚本仍由 CSP 的来源列表约束
+func addScriptNonce(data []byte, nonce string) []byte {
+    return scriptTagPattern.ReplaceAllFunc(data, func(tag []byte) []byte {
+        if scriptSrcPattern.Match(tag) {
+            return tag
+        }
+        return append([]byte(`<script nonce="`+nonce+`"`), tag[len("<script"):]...)
+    })
+}
+
+// serveHTMLPage 为页面中的内联脚本注入 nonce 使其满足 CSP，并为城市页面注入分享卡片元数据
+func serveHTMLPage(w http.ResponseWriter, r *http.Request, filePath string, nonce string, city *CityInfo) {
+    info, err := os.Stat(filePath)
+    if err != nil || info.IsDir() {
+        http.ServeFile(w, r, filePath)
+        return
+    }
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        log.Printf("⚠  读取页面失败: %s: %v", filePath, err)
+        writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+        return
+    }
+    if nonce != "" {
+        data = addScriptNonce(data, nonce)
+    }
+    if city != nil && serverConfig.SEO.OpenGraph && !bytes.Contains(data, []byte(`property="og:title"`)) {
+        title, description := city.Name, ""
+        if summary := cityPageSummary(filePath); summary != nil {
+            if summary.title != "" {
+                title = summary.title
+            }
+            description = summary.description
+        }
+        tags := cityMetaTags(configuredBaseURL(), "/"+city.Page, title, description, cityShareImage(city))
+        data = injectHeadTags(data, tags)
+    }
+    // 每个请求的 nonce 不同，压缩结果不能缓存
+    if isCompressible(filePath, int64(len(data))) {
+        w.Header().Add("Vary", "Accept-Encoding")
+        if acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+            if gz, err := gzipBytes(data); err == nil {
+                w.Header().Set("Content-Encoding", "gzip")
+                data = gz
+            }
+        }
+    }
+    http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), bytes.NewReader(data))
+}
+
+// serveCompressedStatic 按 Accept-Encoding 协商压缩：优先使用 .br/.gz 预压缩文件，
+// 否则对文本类型实时 gzip 并缓存。JPEG、MP3 等已压缩格式不处理，返回 false 交给文件服务器。
+func serveCompressedStatic(w http.ResponseWriter, r *http.Request, filePath string) bool {
+    info, err := os.Stat(filePath)
+    if err != nil || info.IsDir() || !isCompressible(filePath, info.Size()) {
+        return false
+    }
+    w.Header().Add("Vary", "Accept-Encoding")
+    acceptEncoding := r.Header.Get("Accept-Encoding")
+    name := filepath.Base(filePath)
+
+    if serverConfig.Compression.Precompressed {
+        for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+            if !acceptsEncoding(acceptEncoding, enc.name) {
+                continue
+            }
+            sibling, err := os.Stat(filePath + enc.ext)
+            // 预压缩文件比原文件旧时视为过期
+            if err != nil || sibling.IsDir() || sibling.ModTime().Before(info.ModTime()) {
+                continue
+            }
+            f, err := os.Open(filePath + enc.ext)
+            if err != nil {
+                continue
+            }
+            defer f.Close()
+            w.Header().Set("Content-Encoding", enc.name)
+            suffixETag(w.Header(), enc.name)
+            http.ServeContent(w, r, name, info.ModTime(), f)
+            return true
+        }
+    }
+
+    if !acceptsEncoding(acceptEncoding, "gzip") {
+        return false
+    }
+    data, err := cachedGzip(filePath, info)
+    if err != nil {
+        log.Printf("⚠  压缩文件失败: %s: %v", filePath, err)
+        return false
+    }
+    w.Header().Set("Content-Encoding", "gzip")
+    suffixETag(w.Header(), "gzip")
+    http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+    return true
+}
+
+// suffixETag 为压缩后的表示生成不同的 ETag，避免与未压缩版本混用
+func suffixETag(h http.Header, encoding string) {
+    if etag := h.Get("ETag"); etag != "" {
+        h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+    }
+}
+
+// setCacheHeaders 设置缓存策略和内容哈希 ETag，If-None-Match 由 ServeContent 根据 ETag 处理
+func setCacheHeaders(w http.ResponseWriter, r *http.Request, filePath string, fingerprinted bool) {
+    cfg := serverConfig.Cache
+    h := w.Header()
+    if strings.HasSuffix(filePath, ".html") {
+        if cspNonce(r) != "" {
+            h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+            return
+        }
+        h.Set("Cache-Control", cfg.HTMLCacheControl)
+    } else if fingerprinted {
+        h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", cfg.ImmutableMaxAge))
+    } else {
+        h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.AssetMaxAge))
+    }
+    if hash := assetHashFor(filePath); hash != "" {
+        h.Set("ETag", `"`+hash+`"`)
+    }
+}
+
+// assetHashFor 返回文件内容哈希，文件修改时间或大小变化时重新计算
+func assetHashFor(filePath string) string {
+    info, err := os.Stat(filePath)
+    if err != nil || info.IsDir() {
+        return ""
+    }
+    assetHashMutex.RLock()
+    entry, ok := assetHashes[filePath]
+    assetHashMutex.RUnlock()
+    if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+        return entry.hash
+    }
+    hash, err := hashFile(filePath)
+    if err != nil {
+        log.Printf("⚠  计算文件哈希失败: %s: %v", filePath, err)
+        return ""
+    }
+    assetHashMutex.Lock()
+    assetHashes[filePath] = &assetHash{hash: hash, modTime: info.ModTime(), size: info.Size()}
+    assetHashMutex.Unlock()
+    return hash
+}
+
+func hashFile(filePath string) (string, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// warmAssetHashes 启动时预先计算所有可对外提供文件的哈希
+func warmAssetHashes(root string) {
+    start := time.Now()
+    count := 0
+    filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+        if err != nil {
+            return nil
+        }
+        if d.IsDir() {
+            if p != root && (strings.HasPrefix(d.Name(), ".") || isDeniedStaticName(d.Name())) {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if staticServeAllowed(root, p) && assetHashFor(p) != "" {
+            count++
+        }
+        return nil
+    })
+    log.Printf("🔑 已计算 %d 个静态文件的内容哈希，用时 %v", count, time.Since(start).Round(time.Millisecond))
+}
+
+// assetManifest 返回 URL 路径到指纹地址的映射，供页面生成长期缓存的资源链接
+func assetManifest(root string) map[string]string {
+    assetHashMutex.RLock()
+    defer assetHashMutex.RUnlock()
+    manifest := make(map[string]string, len(assetHashes))
+    for filePath, entry := range assetHashes {
+        rel, err := filepath.Rel(root, filePath)
+        if err != nil || !isWithinDir(root, filePath) {
+            continue
+        }
+        urlPath := "/" + filepath.ToSlash(rel)
+        manifest[urlPath] = fingerprintURL(urlPath, entry.hash)
+    }
+    return manifest
+}
+
+// splitFingerprintPath 将 /static/<hash>/imgnj/1.jpg 拆分为哈希和 /imgnj/1.jpg
+func splitFingerprintPath(urlPath string) (string, string) {
+    rest := strings.TrimPrefix(urlPath, "/static/")
+    idx := strings.Index(rest, "/")
+    if idx < 0 {
+        return "", "/" + rest
+    }
+    return rest[:idx], rest[idx:]
+}
+
+func fingerprintURL(urlPath string, hash string) string {
+    return "/static/" + hash + "/" + strings.TrimPrefix(urlPath, "/")
+}
+
+func isCompressible(filePath string, size int64) bool {
+    cfg := serverConfig.Compression
+    return cfg.Enabled && size >= cfg.MinSize && containsFold(cfg.CompressibleExts, filepath.Ext(filePath))
+}
+
+// acceptsEncoding 判断 Accept-Encoding 是否接受指定编码（q=0 表示拒绝，支持 *）
+func acceptsEncoding(header string, encoding string) bool {
+    wildcard := false
+    for _, part := range strings.Split(header, ",") {
+        fields := strings.Split(strings.TrimSpace(part), ";")
+        name := strings.ToLower(strings.TrimSpace(fields[0]))
+        q := 1.0
+        for _, param := range fields[1:] {
+            param = strings.TrimSpace(param)
+            if strings.HasPrefix(param, "q=") {
+                if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+                    q = v
+                }
+            }
+        }
+        if name == encoding {
+            return q > 0
+        }
+        if name == "*" && q > 0 {
+            wildcard = true
+        }
+    }
+    return wildcard
+}
+
+func cachedGzip(filePath string, info os.FileInfo) ([]byte, error) {
+    gzipCacheMutex.RLock()
+    entry, ok := gzipCache[filePath]
+    gzipCacheMutex.RUnlock()
+    if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+        return entry.data, nil
+    }
+
+    raw, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil, err
+    }
+    data, err := gzipBytes(raw)
+    if err != nil {
+        return nil, err
+    }
+
+    gzipCacheMutex.Lock()
+    defer gzipCacheMutex.Unlock()
+    if old, ok := gzipCache[filePath]; ok {
+        gzipCacheBytes -= int64(len(old.data))
+    }
+    // 缓存超出上限时整体清空，静态文件数量有限，重新压缩的代价可以接受
+    if gzipCacheBytes+int64(len(data)) > serverConfig.Compression.CacheMaxBytes {
+        gzipCache = make(map[string]*compressedEntry)
+        gzipCacheBytes = 0
+    }
+    gzipCache[filePath] = &compressedEntry{modTime: info.ModTime(), size: info.Size(), data: data}
+    gzipCacheBytes += int64(len(data))
+    return data, nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+    var buf bytes.Buffer
+    zw, err := gzip.NewWriterLevel(&buf, serverConfig.Compression.Level)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := zw.Write(data); err != nil {
+        return nil, err
+    }
+    if err := zw.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// resolveImageSource 解析 /img/ 后的图片路径，只允许配置中的图片目录
+func resolveImageSource(root string, assetPath string) (string, error) {
+    filePath, err := resolveStaticPath(root, assetPath)
+    if err != nil {
+        return "", err
+    }
+    if !staticServeAllowed(root, filePath) {
+        return "", errPathNotFound
+    }
+    rel, err := filepath.Rel(root, filePath)
+    if err != nil {
+        return "", errPathNotFound
+    }
+    segments := strings.Split(filepath.ToSlash(rel), "/")
+    if len(segments) < 2 || !containsFold(serverConfig.Images.SourceDirs, segments[0]) {
+        return "", errPathNotFound
+    }
+    switch strings.ToLower(filepath.Ext(filePath)) {
+    case ".jpg", ".jpeg", ".png", ".gif":
+        return filePath, nil
+    }
+    return "", errPathNotFound
+}
+
+// snapImageWidth 将请求宽度向上取整到允许的宽度，0 或超过最大值时使用最大宽度
+func snapImageWidth(width int) int {
+    widths := serverConfig.Images.AllowedWidths
+    largest := 0
+    for _, allowed := range widths {
+        if allowed > largest {
+            largest = allowed
+        }
+    }
+    best := largest
+    for _, allowed := range widths {
+        if allowed >= width && allowed < best {
+            best = allowed
+        }
+    }
+    return best
+}
+
+// imageSrcset 生成适用于 <img srcset> 的候选列表，不包含超过原图宽度的尺寸
+func imageSrcset(assetPath string, srcWidth int) map[string]interface{} {
+    base := "/img/" + strings.TrimPrefix(assetPath, "/")
+    widths := []int{}
+    candidates := []string{}
+    for _, width := range serverConfig.Images.AllowedWidths {
+        if width > srcWidth && len(widths) > 0 {
+            continue
+        }
+        widths = append(widths, width)
+        candidates = append(candidates, fmt.Sprintf("%s?w=%d %dw", base, width, width))
+    }
+    src := base
+    if len(widths) > 0 {
+        src = fmt.Sprintf("%s?w=%d", base, widths[len(widths)-1])
+    }
+    return map[string]interface{}{
+        "src":    src,
+        "srcset": strings.Join(candidates, ", "),
+        "widths": widths,
+    }
+}
+
+// resizedImage 返回缩放后的缓存文件路径，不存在时生成。缓存键包含原图修改时间，原图更新后自动失效。
+func resizedImage(filePath string, width int) (string, string, error) {
+    info, err := os.Stat(filePath)
+    if err != nil {
+        return "", "", err
+    }
+    cfg := serverConfig.Images
+    // 只生成允许列表中的宽度，每张原图的缓存数量有上限
+    width = snapImageWidth(width)
+    outExt, contentType := ".jpg", "image/jpeg"
+    if ext := strings.ToLower(filepath.Ext(filePath)); ext == ".png" || ext == ".gif" {
+        outExt, contentType = ".png", "image/png"
+    }
+    key := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d", filePath, info.ModTime().UnixNano(), info.Size(), width, cfg.Quality)))
+    cachedPath := filepath.Join(cfg.CacheDir, hex.EncodeToString(key[:12])+outExt)
+    if touchCachedImage(cachedPath) {
+        return cachedPath, contentType, nil
+    }
+
+    // 同一缩略图只生成一次，其他请求等待结果
+    unlock := lockImageKey(cachedPath)
+    defer unlock()
+    if touchCachedImage(cachedPath) {
+        return cachedPath, contentType, nil
+    }
+
+    imageResizeSlots <- struct{}{}
+    defer func() { <-imageResizeSlots }()
+
+    img, err := loadOrientedImage(filePath, width)
+    if err != nil {
+        return "", "", err
+    }
+    tmp, err := os.CreateTemp(cfg.CacheDir, "resize-*")
+    if err != nil {
+        return "", "", err
+    }
+    defer os.Remove(tmp.Name())
+    // 重新编码只写入像素数据，原图中的 EXIF 等元数据不会保留
+    if outExt == ".png" {
+        err = png.Encode(tmp, img)
+    } else {
+        err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: cfg.Quality})
+    }
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return "", "", err
+    }
+    if err := os.Rename(tmp.Name(), cachedPath); err != nil {
+        return "", "", err
+    }
+    log.Printf("🖼  已生成缩略图: %s (w=%d)", filePath, width)
+    go pruneImageCache(cfg)
+    return cachedPath, contentType, nil
+}
+
+// imageKeyLock 按缓存文件加锁，没有请求等待时从表中删除
+type imageKeyLock struct {
+    sync.Mutex
+    waiters int
+}
+
+func lockImageKey(key string) func() {
+    imageKeyMutex.Lock()
+    lock, ok := imageKeyLocks[key]
+    if !ok {
+        lock = &imageKeyLock{}
+        imageKeyLocks[key] = lock
+    }
+    lock.waiters++
+    imageKeyMutex.Unlock()
+
+    lock.Lock()
+    return func() {
+        lock.Unlock()
+        imageKeyMutex.Lock()
+        lock.waiters--
+        if lock.waiters == 0 {
+            delete(imageKeyLocks, key)
+        }
+        imageKeyMutex.Unlock()
+    }
+}
+
+// touchCachedImage 判断缓存文件是否存在，并更新修改时间作为最近使用时间（每小时最多一次）
+func touchCachedImage(cachedPath string) bool {
+    info, err := os.Stat(cachedPath)
+    if err != nil {
+        return false
+    }
+    if now := time.Now(); now.Sub(info.ModTime()) > time.Hour {
+        os.Chtimes(cachedPath, now, now)
+    }
+    return true
+}
+
+// pruneImageCache 缓存目录超过容量上限时，按修改时间删除最旧的文件，直到降到上限的九成
+func pruneImageCache(cfg ImageConfig) {
+    if cfg.CacheMaxBytes <= 0 || !imageCachePruneMutex.TryLock() {
+        return
+    }
+    defer imageCachePruneMutex.Unlock()
+    entries, err := os.ReadDir(cfg.CacheDir)
+    if err != nil {
+        return
+    }
+    type cachedFile struct {
+        path    string
+        size    int64
+        modTime time.Time
+    }
+    var files []cachedFile
+    var total int64
+    for _, entry := range entries {
+        // 生成中的临时文件不计入
+        if entry.IsDir() || strings.HasPrefix(entry.Name(), "resize-") {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        files = append(files, cachedFile{filepath.Join(cfg.CacheDir, entry.Name()), info.Size(), info.ModTime()})
+        total += info.Size()
+    }
+    if total <= cfg.CacheMaxBytes {
+        return
+    }
+    sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+    target := cfg.CacheMaxBytes / 10 * 9
+    removed := 0
+    for _, f := range files {
+        if total <= target {
+            break
+        }
+        if err := os.Remove(f.path); err == nil || os.IsNotExist(err) {
+            total -= f.size
+            removed++
+        }
+    }
+    log.Printf("🧹 缩略图缓存超过上限，已删除 %d 个最久未使用的文件", removed)
+}
+
+// loadOrientedImage 解码图片，按 EXIF 方向摆正，并缩放到显示宽度不超过 width（不放大）
+func loadOrientedImage(filePath string, width int) (image.Image, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    src, _, err := image.Decode(f)
+    if err != nil {
+        return nil, err
+    }
+    orientation := 1
+    if isJPEGPath(filePath) {
+        orientation = jpegOrientation(filePath)
+    }
+    rotated := orientation >= 5 && orientation <= 8
+
+    b := src.Bounds()
+    displayW, displayH := b.Dx(), b.Dy()
+    if rotated {
+        displayW, displayH = displayH, displayW
+    }
+    targetW, targetH := displayW, displayH
+    if width > 0 && width < displayW {
+        targetW = width
+        targetH = maxInt(1, int(float64(displayH)*float64(width)/float64(displayW)+0.5))
+    }
+    if rotated {
+        targetW, targetH = targetH, targetW
+    }
+
+    rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+    draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+    return orientImage(resizeRGBA(rgba, targetW, targetH), orientation), nil
+}
+
+// imageDisplaySize 读取图片头部得到摆正后的宽高，不解码像素
+func imageDisplaySize(filePath string) (int, int, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer f.Close()
+    cfg, _, err := image.DecodeConfig(f)
+    if err != nil {
+        return 0, 0, err
+    }
+    if o := jpegOrientation(filePath); o >= 5 && o <= 8 {
+        return cfg.Height, cfg.Width, nil
+    }
+    return cfg.Width, cfg.Height, nil
+}
+
+// resizeRGBA 使用区域平均（box filter）缩小图片，目标尺寸不小于原图时直接返回
+func resizeRGBA(src *image.RGBA, dstW, dstH int) *image.RGBA {
+    srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+    if dstW >= srcW && dstH >= srcH {
+        return src
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+    for dy := 0; dy < dstH; dy++ {
+        y0 := dy * srcH / dstH
+        y1 := maxInt((dy+1)*srcH/dstH, y0+1)
+        for dx := 0; dx < dstW; dx++ {
+            x0 := dx * srcW / dstW
+            x1 := maxInt((dx+1)*srcW/dstW, x0+1)
+            var r, g, b, a, n uint32
+            for y := y0; y < y1; y++ {
+                off := y*src.Stride + x0*4
+                for x := x0; x < x1; x++ {
+                    r += uint32(src.Pix[off])
+                    g += uint32(src.Pix[off+1])
+                    b += uint32(src.Pix[off+2])
+                    a += uint32(src.Pix[off+3])
+                    off += 4
+                    n++
+                }
+            }
+            o := dy*dst.Stride + dx*4
+            dst.Pix[o] = uint8(r / n)
+            dst.Pix[o+1] = uint8(g / n)
+            dst.Pix[o+2] = uint8(b / n)
+            dst.Pix[o+3] = uint8(a / n)
+        }
+    }
+    return dst
+}
+
+// orientImage 按 EXIF Orientation（1-8）翻转或旋转图片
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+    if orientation < 2 || orientation > 8 {
+        return src
+    }
+    w, h := src.Bounds().Dx(), src.Bounds().Dy()
+    dstW, dstH := w, h
+    if orientation >= 5 {
+        dstW, dstH = h, w
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            var nx, ny int
+            switch orientation {
+            case 2:
+                nx, ny = w-1-x, y
+            case 3:
+                nx, ny = w-1-x, h-1-y
+            case 4:
+                nx, ny = x, h-1-y
+            case 5:
+                nx, ny = y, x
+            case 6:
+                nx, ny = h-1-y, x
+            case 7:
+                nx, ny = h-1-y, w-1-x
+            case 8:
+                nx, ny = y, w-1-x
+            }
+            copy(dst.Pix[ny*dst.Stride+nx*4:ny*dst.Stride+nx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+        }
+    }
+    return dst
+}
+
+// jpegOrientation 读取 JPEG 中 EXIF 的方向标记，读取失败时返回 1（正常方向）
+func jpegOrientation(filePath string) int {
+    exif, err := readJPEGExif(filePath)
+    if err != nil || exif.Orientation < 1 || exif.Orientation > 8 {
+        return 1
+    }
+    return exif.Orientation
+}
+
+func isJPEGPath(filePath string) bool {
+    ext := strings.ToLower(filepath.Ext(filePath))
+    return ext == ".jpg" || ext == ".jpeg"
+}
+
+// readJPEGExif 读取 JPEG 文件头部的 APP1 段并解析 EXIF
+func readJPEGExif(filePath string) (*exifData, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    header := make([]byte, 128<<10)
+    n, _ := io.ReadFull(f, header)
+    start, end := findExifSegment(header[:n])
+    if start < 0 {
+        return nil, errors.New("没有 EXIF 信息")
+    }
+    return parseExif(header[start:end])
+}
+
+// findExifSegment 返回 JPEG 数据中 EXIF TIFF 数据的起止位置，找不到时返回 -1
+func findExifSegment(data []byte) (int, int) {
+    if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+        return -1, -1
+    }
+    pos := 2
+    for pos+4 <= len(data) {
+        if data[pos] != 0xFF {
+            return -1, -1
+        }
+        marker := data[pos+1]
+        segLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+        if marker == 0xDA || segLen < 2 {
+            return -1, -1
+        }
+        end := pos + 2 + segLen
+        if marker == 0xE1 && end <= len(data) && bytes.HasPrefix(data[pos+4:end], []byte("Exif\x00\x00")) {
+            return pos + 10, end
+        }
+        pos = end
+    }
+    return -1, -1
+}
+
+func tiffByteOrder(tiff []byte) binary.ByteOrder {
+    if len(tiff) < 8 {
+        return nil
+    }
+    switch string(tiff[:2]) {
+    case "II":
+        return binary.LittleEndian
+    case "MM":
+        return binary.BigEndian
+    }
+    return nil
+}
+
+// readIFD 读取 offset 处的 TIFF 目录，返回 标签 -> 目录项
+func readIFD(tiff []byte, order binary.ByteOrder, offset int) map[uint16]ifdEntry {
+    entries := make(map[uint16]ifdEntry)
+    if offset <= 0 || offset+2 > len(tiff) {
+        return entries
+    }
+    count := int(order.Uint16(tiff[offset : offset+2]))
+    for i := 0; i < count; i++ {
+        pos := offset + 2 + i*12
+        if pos+12 > len(tiff) {
+            break
+        }
+        entries[order.Uint16(tiff[pos:pos+2])] = ifdEntry{
+            pos:   pos,
+            typ:   order.Uint16(tiff[pos+2 : pos+4]),
+            count: order.Uint32(tiff[pos+4 : pos+8]),
+        }
+    }
+    return entries
+}
+
+// ifdValue 返回目录项的原始数据，数据不超过 4 字节时保存在目录项内部
+func ifdValue(tiff []byte, order binary.ByteOrder, e ifdEntry) []byte {
+    sizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+    size := sizes[e.typ] * int(e.count)
+    if size == 0 || e.count > 1<<16 {
+        return nil
+    }
+    if size <= 4 {
+        return tiff[e.pos+8 : e.pos+8+size]
+    }
+    offset := int(order.Uint32(tiff[e.pos+8 : e.pos+12]))
+    if offset < 0 || offset+size > len(tiff) {
+        return nil
+    }
+    return tiff[offset : offset+size]
+}
+
+func ifdString(tiff []byte, order binary.ByteOrder, e ifdEntry) string {
+    return strings.TrimSpace(strings.TrimRight(string(ifdValue(tiff, order, e)), "\x00"))
+}
+
+func ifdUint(tiff []byte, order binary.ByteOrder, e ifdEntry) int {
+    v := ifdValue(tiff, order, e)
+    switch {
+    case e.typ == 3 && len(v) >= 2:
+        return int(order.Uint16(v))
+    case e.typ == 4 && len(v) >= 4:
+        return int(order.Uint32(v))
+    }
+    return 0
+}
+
+// ifdRationals 读取 RATIONAL 数组（GPS 度分秒）
+func ifdRationals(tiff []byte, order binary.ByteOrder, e ifdEntry) []float64 {
+    v := ifdValue(tiff, order, e)
+    if e.typ != 5 || v == nil {
+        return nil
+    }
+    values := make([]float64, 0, e.count)
+    for i := 0; i+8 <= len(v); i += 8 {
+        num, den := order.Uint32(v[i:i+4]), order.Uint32(v[i+4:i+8])
+        if den == 0 {
+            return nil
+        }
+        values = append(values, float64(num)/float64(den))
+    }
+    return values
+}
+
+// parseExif 解析 TIFF 格式的 EXIF 数据：方向、拍摄时间、相机型号和 GPS 坐标
+func parseExif(tiff []byte) (*exifData, error) {
+    order := tiffByteOrder(tiff)
+    if order == nil {
+        return nil, errors.New("无效的 TIFF 头")
+    }
+    exif := &exifData{Orientation: 1}
+    ifd0 := readIFD(tiff, order, int(order.Uint32(tiff[4:8])))
+    if e, ok := ifd0[0x0112]; ok {
+        exif.Orientation = ifdUint(tiff, order, e)
+    }
+    if e, ok := ifd0[0x010F]; ok {
+        exif.Make = ifdString(tiff, order, e)
+    }
+    if e, ok := ifd0[0x0110]; ok {
+        exif.Model = ifdString(tiff, order, e)
+    }
+    dateTime := ""
+    if e, ok := ifd0[0x0132]; ok {
+        dateTime = ifdString(tiff, order, e)
+    }
+    if e, ok := ifd0[0x8769]; ok {
+        sub := readIFD(tiff, order, ifdUint(tiff, order, e))
+        if e, ok := sub[0x9003]; ok {
+            dateTime = ifdString(tiff, order, e)
+        }
+    }
+    if t, err := time.ParseInLocation("2006:01:02 15:04:05", dateTime, time.Local); err == nil {
+        exif.TakenAt = t
+    }
+    if e, ok := ifd0[0x8825]; ok {
+        gps := readIFD(tiff, order, ifdUint(tiff, order, e))
+        lat := ifdRationals(tiff, order, gps[0x0002])
+        lon := ifdRationals(tiff, order, gps[0x0004])
+        if len(lat) == 3 && len(lon) == 3 {
+            exif.HasGPS = true
+            exif.Lat = lat[0] + lat[1]/60 + lat[2]/3600
+            exif.Lon = lon[0] + lon[1]/60 + lon[2]/3600
+            if e, ok := gps[0x0001]; ok && ifdString(tiff, order, e) == "S" {
+                exif.Lat = -exif.Lat
+            }
+            if e, ok := gps[0x0003]; ok && ifdString(tiff, order, e) == "W" {
+                exif.Lon = -exif.Lon
+            }
+        }
+    }
+    return exif, nil
+}
+
+// stripExifGPS 原地清空 EXIF 中的 GPS 目录（保持长度不变，其他字段如方向不受影响），返回是否做了修改
+func stripExifGPS(data []byte) bool {
+    start, end := findExifSegment(data)
+    if start < 0 {
+        return false
+    }
+    tiff := data[start:end]
+    order := tiffByteOrder(tiff)
+    if order == nil {
+        return false
+    }
+    ifd0 := readIFD(tiff, order, int(order.Uint32(tiff[4:8])))
+    e, ok := ifd0[0x8825]
+    if !ok {
+        return false
+    }
+    // GPS 目录的偏移来自文件本身，越界或类型不对（ifdUint 返回 0）时不做修改，避免破坏 TIFF 头
+    gpsOffset := ifdUint(tiff, order, e)
+    if gpsOffset < 8 || gpsOffset+2 > len(tiff) {
+        return false
+    }
+    gps := readIFD(tiff, order, gpsOffset)
+    for _, entry := range gps {
+        if v := ifdValue(tiff, order, entry); v != nil {
+            for i := range v {
+                v[i] = 0
+            }
+        }
+        for i := entry.pos; i < entry.pos+12; i++ {
+            tiff[i] = 0
+        }
+    }
+    order.PutUint16(tiff[gpsOffset:gpsOffset+2], 0)
+    return true
+}
+
+// serveJPEGWithoutGPS 去掉 GPS 信息后提供 JPEG，文件没有 GPS 信息时返回 false
+func serveJPEGWithoutGPS(w http.ResponseWriter, r *http.Request, filePath string) bool {
+    exif, err := readJPEGExif(filePath)
+    if err != nil || !exif.HasGPS {
+        return false
+    }
+    info, err := os.Stat(filePath)
+    if err != nil {
+        return false
+    }
+    data, err := os.ReadFile(filePath)
+    if err != nil || !stripExifGPS(data) {
+        return false
+    }
+    // 内容与原文件不同，ETag 按去掉 GPS 后的数据计算
+    sum := sha256.Sum256(data)
+    w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+    http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), bytes.NewReader(data))
+    return true
+}
+
+// periodicPhotoScan 启动时扫描照片 EXIF，之后定期重新扫描以发现新照片
+func periodicPhotoScan(root string) {
+    scanPhotos(root)
+    interval := serverConfig.Photos.RescanIntervalSeconds
+    if interval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(time.Duration(interval) * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        scanPhotos(root)
+    }
+}
+
+// scanPhotos 扫描各城市图片目录中的 JPEG，未变化的文件沿用上次的解析结果
+func scanPhotos(root string) {
+    photoIndexMutex.RLock()
+    previous := make(map[string]*PhotoInfo)
+    for _, photos := range photoIndex {
+        for _, p := range photos {
+            previous[p.File] = p
+        }
+    }
+    photoIndexMutex.RUnlock()
+
+    index := make(map[string][]*PhotoInfo)
+    total, withGPS := 0, 0
+    for city, dir := range cityImageDirs() {
+        entries, err := os.ReadDir(filepath.Join(root, dir))
+        if err != nil {
+            log.Printf("⚠  无法读取图片目录 %s: %v", dir, err)
+            continue
+        }
+        photos := []*PhotoInfo{}
+        for _, entry := range entries {
+            if entry.IsDir() || !isJPEGPath(entry.Name()) {
+                continue
+            }
+            info, err := entry.Info()
+            if err != nil {
+                continue
+            }
+            file := dir + "/" + entry.Name()
+            if p, ok := previous[file]; ok && p.modTime.Equal(info.ModTime()) && p.size == info.Size() {
+                photos = append(photos, p)
+            } else {
+                photos = append(photos, buildPhotoInfo(filepath.Join(root, dir, entry.Name()), file, info))
+            }
+            if photos[len(photos)-1].Lat != nil {
+                withGPS++
+            }
+        }
+        sortPhotos(photos)
+        index[city] = photos
+        total += len(photos)
+    }
+
+    photoIndexMutex.Lock()
+    photoIndex = index
+    photoIndexMutex.Unlock()
+    log.Printf("📷 照片索引已更新: %d 个城市, %d 张照片, 其中 %d 张带 GPS 坐标", len(index), total, withGPS)
+}
+
+func buildPhotoInfo(filePath string, file string, info os.FileInfo) *PhotoInfo {
+    p := &PhotoInfo{URL: "/" + file, File: file, modTime: info.ModTime(), size: info.Size()}
+    if w, h, err := imageDisplaySize(filePath); err == nil {
+        p.Width, p.Height = w, h
+    }
+    exif, err := readJPEGExif(filePath)
+    if err != nil {
+        return p
+    }
+    if !exif.TakenAt.IsZero() {
+        t := exif.TakenAt
+        p.TakenAt = &t
+    }
+    p.Camera = strings.TrimSpace(exif.Make + " " + strings.TrimPrefix(exif.Model, exif.Make))
+    if exif.HasGPS {
+        lat, lon := exif.Lat, exif.Lon
+        p.Lat, p.Lon = &lat, &lon
+    }
+    return p
+}
+
+// sortPhotos 按拍摄时间排序，没有拍摄时间的照片按文件编号排在最后
+func sortPhotos(photos []*PhotoInfo) {
+    sort.SliceStable(photos, func(i, j int) bool {
+        a, b := photos[i], photos[j]
+        if a.TakenAt != nil && b.TakenAt != nil && !a.TakenAt.Equal(*b.TakenAt) {
+            return a.TakenAt.Before(*b.TakenAt)
+        }
+        if (a.TakenAt == nil) != (b.TakenAt == nil) {
+            return a.TakenAt != nil
+        }
+        return naturalLess(a.File, b.File)
+    })
+}
+
+// adminEnabled 判断是否配置了至少一个管理员令牌，未配置时所有 /admin/ 接口停用
+func adminEnabled() bool {
+    for _, token := range serverConfig.Admin.Tokens {
+        if token != "" {
+            return true
+        }
+    }
+    return false
+}
+
+// adminUser 校验 X-Admin-Token，返回对应的管理员名称
+func adminUser(r *http.Request) (string, bool) {
+    token := r.Header.Get("X-Admin-Token")
+    if token == "" {
+        return "", false
+    }
+    for name, expected := range serverConfig.Admin.Tokens {
+        if expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+            return name, true
+        }
+    }
+    return "", false
+}
+
+// serveAdminUpload 处理 /admin/upload/{city}：逐个校验 multipart 中的照片，保存成功的写入审计日志
+func serveAdminUpload(w http.ResponseWriter, r *http.Request, root string) {
+    uploader, ok := adminUser(r)
+    if !ok {
+        writeError(w, r, http.StatusUnauthorized, "未授权")
+        return
+    }
+    if r.Method != http.MethodPost {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    city := strings.TrimPrefix(r.URL.Path, "/admin/upload/")
+    dir, ok := cityImageDirs()[city]
+    if !ok {
+        writeError(w, r, http.StatusNotFound, "未知的城市")
+        return
+    }
+    reader, err := r.MultipartReader()
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, "需要 multipart/form-data 请求")
+        return
+    }
+
+    type uploadResult struct {
+        OriginalName string `json:"original_name"`
+        File         string `json:"file,omitempty"`
+        URL          string `json:"url,omitempty"`
+        Thumb        string `json:"thumb,omitempty"`
+        Size         int64  `json:"size,omitempty"`
+        Error        string `json:"error,omitempty"`
+    }
+    results := []uploadResult{}
+    saved := 0
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            var maxErr *http.MaxBytesError
+            if errors.As(err, &maxErr) {
+                writeError(w, r, http.StatusRequestEntityTooLarge, "请求体过大")
+                return
+            }
+            writeError(w, r, http.StatusBadRequest, "无效的请求体")
+            return
+        }
+        if part.FileName() == "" {
+            part.Close()
+            continue
+        }
+        if len(results) >= serverConfig.Upload.MaxFiles {
+            part.Close()
+            results = append(results, uploadResult{OriginalName: part.FileName(), Error: "超过单次上传的文件数量上限"})
+            continue
+        }
+        result := uploadResult{OriginalName: part.FileName()}
+        entry, err := saveUploadedPhoto(root, dir, part)
+        part.Close()
+        if err != nil {
+            result.Error = err.Error()
+            log.Printf("⚠  照片上传被拒绝: %s (%s) 来自 %s: %v", part.FileName(), city, uploader, err)
+            results = append(results, result)
+            continue
+        }
+        entry.Uploader = uploader
+        entry.OriginalName = part.FileName()
+        entry.IP = getRealIP(r)
+        entry.City = city
+        writeUploadAudit(entry)
+        result.File = entry.File
+        result.URL = "/" + entry.File
+        result.Thumb = fmt.Sprintf("/img/%s?w=%d", entry.File, serverConfig.Gallery.ThumbWidth)
+        result.Size = entry.Size
+        results = append(results, result)
+        saved++
+        log.Printf("📤 照片已上传: %s (%s) by %s", entry.File, entry.OriginalName, uploader)
+    }
+    if saved > 0 {
+        go func() {
+            refreshGalleries(root)
+            scanPhotos(root)
+        }()
+    }
+    status := http.StatusCreated
+    if saved == 0 {
+        status = http.StatusBadRequest
+    }
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{"saved": saved, "results": results})
+}
+
+// saveUploadedPhoto 校验并保存一张上传的照片，按配置命名后生成缩略图
+func saveUploadedPhoto(root string, dir string, part io.Reader) (*UploadAuditEntry, error) {
+    cfg := serverConfig.Upload
+    data, err := io.ReadAll(io.LimitReader(part, cfg.MaxFileBytes+1))
+    if err != nil {
+        return nil, errors.New("读取文件失败")
+    }
+    if int64(len(data)) > cfg.MaxFileBytes {
+        return nil, fmt.Errorf("文件超过 %d MB 上限", cfg.MaxFileBytes>>20)
+    }
+
+    // 按文件内容判断真实类型，不信任文件名和客户端声明的 Content-Type
+    var ext string
+    switch http.DetectContentType(data) {
+    case "image/jpeg":
+        ext = ".jpg"
+    case "image/png":
+        ext = ".png"
+    default:
+        return nil, errors.New("只支持 JPEG 和 PNG 图片")
+    }
+    imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, errors.New("图片已损坏或无法解析")
+    }
+    if imgCfg.Width <= 0 || imgCfg.Height <= 0 || imgCfg.Width*imgCfg.Height > cfg.MaxPixels {
+        return nil, errors.New("图片尺寸超出限制")
+    }
+
+    sum := sha256.Sum256(data)
+    hash := hex.EncodeToString(sum[:])
+    dirPath := filepath.Join(root, dir)
+
+    uploadMutex.Lock()
+    defer uploadMutex.Unlock()
+    name := hash[:16] + ext
+    if cfg.Naming != "hash" {
+        name = strconv.Itoa(nextPhotoNumber(dirPath)) + ext
+    }
+    filePath := filepath.Join(dirPath, name)
+    f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+    if err != nil {
+        if os.IsExist(err) {
+            return nil, errors.New("相同内容的图片已存在")
+        }
+        return nil, errors.New("保存文件失败")
+    }
+    _, err = f.Write(data)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(filePath)
+        return nil, errors.New("保存文件失败")
+    }
+
+    if _, _, err := resizedImage(filePath, serverConfig.Gallery.ThumbWidth); err != nil {
+        log.Printf("⚠  生成上传照片缩略图失败: %s: %v", filePath, err)
+    }
+    return &UploadAuditEntry{
+        Time:   time.Now(),
+        File:   dir + "/" + name,
+        Size:   int64(len(data)),
+        SHA256: hash,
+    }, nil
+}
+
+// nextPhotoNumber 返回目录中最大数字文件名加一
+func nextPhotoNumber(dirPath string) int {
+    entries, _ := os.ReadDir(dirPath)
+    next := 1
+    for _, entry := range entries {
+        name := entry.Name()
+        if n, err := strconv.Atoi(strings.TrimSuffix(name, filepath.Ext(name))); err == nil && n >= next {
+            next = n + 1
+        }
+    }
+    return next
+}
+
+func writeUploadAudit(entry *UploadAuditEntry) {
+    f, err := os.OpenFile(serverConfig.Upload.AuditLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        log.Printf("⚠  无法写入上传审计日志: %v", err)
+        return
+    }
+    defer f.Close()
+    data, _ := json.Marshal(entry)
+    f.Write(append(data, '\n'))
+}
+
+// musicTracks 返回页面的曲目列表：优先使用城市登记表，其次是音乐配置，
+// 登记过的城市都没有配置时使用默认页面的曲目，未知城市返回 nil
+func musicTracks(city string) []string {
+    cfg := serverConfig.Music
+    info, known := findCity(city)
+    if known && len(info.Music) > 0 {
+        return info.Music
+    }
+    if tracks, ok := cfg.Tracks[city]; ok && len(tracks) > 0 {
+        return tracks
+    }
+    if known && cfg.Default != "" && cfg.Default != city {
+        return musicTracks(cfg.Default)
+    }
+    return nil
+}
+
+// musicTrackPath 解析曲目文件的真实路径，沿用静态文件的路径检查
+func musicTrackPath(root string, city string, index int) (string, error) {
+    tracks := musicTracks(city)
+    if index < 0 || index >= len(tracks) {
+        return "", errPathNotFound
+    }
+    filePath, err := resolveStaticPath(root, "/"+serverConfig.Music.Dir+"/"+tracks[index])
+    if err != nil {
+        return "", err
+    }
+    if info, err := os.Stat(filePath); err != nil || info.IsDir() {
+        return "", errPathNotFound
+    }
+    return filePath, nil
+}
+
+// serveMusicTrack 提供 /music/{city}.{ext}（第一首）和 /music/{city}/{序号}，
+// 扩展名必须与曲目文件一致，Range/If-Range 请求由 ServeContent 返回 206 或 416
+func serveMusicTrack(w http.ResponseWriter, r *http.Request, root string) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    name := strings.TrimPrefix(r.URL.Path, "/music/")
+    ext := filepath.Ext(name)
+    city, index := strings.TrimSuffix(name, ext), 0
+    if i := strings.Index(name, "/"); i >= 0 {
+        n, err := strconv.Atoi(name[i+1:])
+        if err != nil || n < 1 {
+            writeError(w, r, http.StatusNotFound, "")
+            return
+        }
+        city, index, ext = name[:i], n-1, ""
+    }
+    filePath, err := musicTrackPath(root, city, index)
+    if err != nil || (ext != "" && !strings.EqualFold(ext, filepath.Ext(filePath))) {
+        writeError(w, r, http.StatusNotFound, "")
+        return
+    }
+    f, err := os.Open(filePath)
+    if err != nil {
+        writeError(w, r, http.StatusNotFound, "")
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+        return
+    }
+    setContentType(w, filePath)
+    w.Header().Set("Accept-Ranges", "bytes")
+    w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", serverConfig.Cache.AssetMaxAge))
+    if hash := assetHashFor(filePath); hash != "" {
+        w.Header().Set("ETag", `"`+hash+`"`)
+    }
+    http.ServeContent(w, r, filepath.Base(filePath), info.ModTime(), f)
+}
+
+// serveMusicPlaylist 返回城市的播放列表
+func serveMusicPlaylist(w http.ResponseWriter, r *http.Request, root string) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    city := strings.TrimPrefix(r.URL.Path, "/api/music/")
+    tracks := musicPlaylist(root, city)
+    if len(tracks) == 0 {
+        writeError(w, r, http.StatusNotFound, "没有可播放的曲目")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    json.NewEncoder(w).Encode(tracks)
+}
+
+func musicPlaylist(root string, city string) []MusicTrack {
+    playlist := []MusicTrack{}
+    for i, track := range musicTracks(city) {
+        filePath, err := musicTrackPath(root, city, i)
+        if err != nil {
+            log.Printf("⚠  曲目不存在: %s (%s)", track, city)
+            continue
+        }
+        info, err := os.Stat(filePath)
+        if err != nil {
+            continue
+        }
+        // 文件名格式为 “歌手 - 歌名.mp3”
+        title := strings.TrimSuffix(track, filepath.Ext(track))
+        artist := ""
+        if parts := strings.SplitN(title, " - ", 2); len(parts) == 2 {
+            artist, title = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+        }
+        playlist = append(playlist, MusicTrack{
+            Title:       title,
+            Artist:      artist,
+            URL:         fmt.Sprintf("/music/%s/%d", city, i+1),
+            ContentType: audioContentType(filePath),
+            Size:        info.Size(),
+        })
+    }
+    return playlist
+}
+
+func audioContentType(path string) string {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".mp3":
+        return "audio/mpeg"
+    case ".ogg", ".oga":
+        return "audio/ogg"
+    case ".m4a":
+        return "audio/mp4"
+    case ".flac":
+        return "audio/flac"
+    case ".wav":
+        return "audio/wav"
+    }
+    return ""
+}
+
+// discoverGalleryDirs 找出静态目录下所有相册目录
+func discoverGalleryDirs(root string) []string {
+    entries, err := os.ReadDir(root)
+    if err != nil {
+        return nil
+    }
+    dirs := []string{}
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        for _, prefix := range serverConfig.Gallery.DirPrefixes {
+            if strings.HasPrefix(strings.ToLower(entry.Name()), prefix) {
+                dirs = append(dirs, entry.Name())
+                break
+            }
+        }
+    }
+    return dirs
+}
+
+// galleryCity 返回相册目录对应的城市缩写：优先使用照片配置中的映射，否则去掉目录前缀
+func galleryCity(dir string) string {
+    for city, cityDir := range cityImageDirs() {
+        if cityDir == dir {
+            return city
+        }
+    }
+    city := dir
+    for _, prefix := range []string{"images", "img"} {
+        if strings.HasPrefix(strings.ToLower(city), prefix) && len(city) > len(prefix) {
+            city = city[len(prefix):]
+            break
+        }
+    }
+    return city
+}
+
+// gallerySignature 用文件名、大小和修改时间生成目录签名，用于轮询时判断目录是否变化
+func gallerySignature(dirPath string) (string, []os.DirEntry, error) {
+    entries, err := os.ReadDir(dirPath)
+    if err != nil {
+        return "", nil, err
+    }
+    h := sha256.New()
+    for _, entry := range entries {
+        info, err := entry.Info()
+        if err != nil {
+            continue
+        }
+        fmt.Fprintf(h, "%s|%d|%d\n", entry.Name(), info.Size(), info.ModTime().UnixNano())
+    }
+    return hex.EncodeToString(h.Sum(nil))[:16], entries, nil
+}
+
+func buildGalleryManifest(root string, dir string, signature string, entries []os.DirEntry) *GalleryManifest {
+    manifest := &GalleryManifest{
+        City:      galleryCity(dir),
+        Dir:       dir,
+        Version:   signature,
+        UpdatedAt: time.Now(),
+        Items:     []GalleryItem{},
+        signature: signature,
+    }
+    for _, entry := range entries {
+        name := entry.Name()
+        switch strings.ToLower(filepath.Ext(name)) {
+        case ".jpg", ".jpeg", ".png", ".gif":
+        default:
+            continue
+        }
+        filePath := filepath.Join(root, dir, name)
+        info, err := entry.Info()
+        if err != nil || !staticServeAllowed(root, filePath) {
+            continue
+        }
+        file := dir + "/" + name
+        item := GalleryItem{
+            File:    file,
+            URL:     "/" + file,
+            Thumb:   fmt.Sprintf("/img/%s?w=%d", file, serverConfig.Gallery.ThumbWidth),
+            Size:    info.Size(),
+            ModTime: info.ModTime(),
+        }
+        if w, h, err := imageDisplaySize(filePath); err == nil {
+            item.Width, item.Height = w, h
+        }
+        // 说明文字来自同名的 .txt 文件，如 1.jpg 对应 1.txt
+        sidecar := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".txt"
+        if caption, err := os.ReadFile(sidecar); err == nil {
+            item.Caption = strings.TrimSpace(string(caption))
+        }
+        manifest.Items = append(manifest.Items, item)
+    }
+    sort.SliceStable(manifest.Items, func(i, j int) bool {
+        return naturalLess(manifest.Items[i].File, manifest.Items[j].File)
+    })
+    return manifest
+}
+
+// refreshGalleries 重新扫描相册目录，只重建签名变化的目录，返回是否有变化
+func refreshGalleries(root string) bool {
+    changed := false
+    seen := make(map[string]bool)
+    for _, dir := range discoverGalleryDirs(root) {
+        city := galleryCity(dir)
+        seen[city] = true
+        signature, entries, err := gallerySignature(filepath.Join(root, dir))
+        if err != nil {
+            continue
+        }
+        galleriesMutex.RLock()
+        current, ok := galleries[city]
+        galleriesMutex.RUnlock()
+        if ok && current.signature == signature {
+            continue
+        }
+        manifest := buildGalleryManifest(root, dir, signature, entries)
+        galleriesMutex.Lock()
+        galleries[city] = manifest
+        galleriesMutex.Unlock()
+        changed = true
+        log.Printf("🖼  相册已更新: %s (%s), %d 张图片", city, dir, len(manifest.Items))
+    }
+    galleriesMutex.Lock()
+    for city := range galleries {
+        if !seen[city] {
+            delete(galleries, city)
+            changed = true
+        }
+    }
+    galleriesMutex.Unlock()
+    return changed
+}
+
+// watchGalleries 轮询相册目录，新上传的图片无需修改页面即可出现在清单中
+func watchGalleries(root string) {
+    refreshGalleries(root)
+    interval := serverConfig.Gallery.PollIntervalSeconds
+    if interval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(time.Duration(interval) * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        if refreshGalleries(root) {
+            scanPhotos(root)
+        }
+    }
+}
+
+// naturalLess 按自然顺序比较文件名，使 2.jpg 排在 10.jpg 之前
+func naturalLess(a, b string) bool {
+    na, errA := strconv.Atoi(strings.TrimSuffix(filepath.Base(a), filepath.Ext(a)))
+    nb, errB := strconv.Atoi(strings.TrimSuffix(filepath.Base(b), filepath.Ext(b)))
+    if errA == nil && errB == nil && filepath.Dir(a) == filepath.Dir(b) {
+        return na < nb
+    }
+    return a < b
+}
+
+func maxInt(a, b int) int {
+    if a > b {
+        return a
+    }
+    return b
+}
+
+// feedFormat 根据文件名返回订阅源格式：rss、atom 或 json
+func feedFormat(name string) string {
+    switch name {
+    case "feed.xml", "feed.rss":
+        return "rss"
+    case "feed.atom":
+        return "atom"
+    case "feed.json":
+        return "json"
+    }
+    return ""
+}
+
+// configuredBaseURL 返回配置的站点地址，未配置时为空。
+// 订阅源、站点地图和分享卡片中的完整地址只取自这里，不信任请求的 Host。
+func configuredBaseURL() string {
+    return strings.TrimRight(serverConfig.Feed.BaseURL, "/")
+}
+
+// serveFeed 生成并返回订阅源，内容没有变化时使用缓存，支持条件请求。
+// 订阅源中的链接和 id 必须是完整地址，未配置站点地址时返回 404
+func serveFeed(w http.ResponseWriter, r *http.Request, name, format string, build func(base string) (string, string, []feedItem)) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    // 站点地址只取配置，不使用请求的 Host，缓存数量只与订阅源种类有关
+    base := configuredBaseURL()
+    if base == "" {
+        writeError(w, r, http.StatusNotFound, "订阅源未启用")
+        return
+    }
+    key := name + "|" + format
+
+    feedCacheMutex.Lock()
+    doc := feedCache[key]
+    feedCacheMutex.Unlock()
+    fresh := doc != nil && time.Since(doc.built) < time.Duration(serverConfig.Feed.CacheSeconds)*time.Second
+
+    if !fresh {
+        title, link, items := build(base)
+        sort.SliceStable(items, func(i, j int) bool { return items[i].Updated.After(items[j].Updated) })
+        if max := serverConfig.Feed.MaxItems; max > 0 && len(items) > max {
+            items = items[:max]
+        }
+        // 签名覆盖每一条的 id 和更新时间，删除一条再新增一条也能发现变化
+        var modTime time.Time
+        hash := sha256.New()
+        for _, item := range items {
+            if item.Updated.After(modTime) {
+                modTime = item.Updated
+            }
+            fmt.Fprintf(hash, "%s|%d\n", item.ID, item.Updated.UnixNano())
+        }
+        signature := hex.EncodeToString(hash.Sum(nil))
+        if doc == nil || doc.signature != signature {
+            selfURL := base + r.URL.Path
+            body, err := encodeFeed(format, title, link, selfURL, modTime, items)
+            if err != nil {
+                log.Printf("⚠  生成订阅源失败: %s: %v", name, err)
+                writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+                return
+            }
+            sum := sha256.Sum256(body)
+            doc = &feedDocument{signature: signature, body: body, etag: `"` + hex.EncodeToString(sum[:8]) + `"`, modTime: modTime}
+        } else {
+            // 缓存中的文档可能正被其他请求读取，复制后再更新
+            copied := *doc
+            doc = &copied
+        }
+        doc.built = time.Now()
+        feedCacheMutex.Lock()
+        feedCache[key] = doc
+        feedCacheMutex.Unlock()
+    }
+
+    switch format {
+    case "rss":
+        w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+    case "atom":
+        w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+    default:
+        w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+    }
+    w.Header().Set("ETag", doc.etag)
+    w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", serverConfig.Feed.CacheSeconds))
+    http.ServeContent(w, r, "", doc.modTime, bytes.NewReader(doc.body))
+}
+
+// encodeFeed 按格式输出 RSS 2.0、Atom 或 JSON Feed 1.1
+func encodeFeed(format, title, link, selfURL string, updated time.Time, items []feedItem) ([]byte, error) {
+    if updated.IsZero() {
+        updated = time.Unix(0, 0)
+    }
+    switch format {
+    case "rss":
+        feed := rssFeed{
+            Version: "2.0",
+            Atom:    "http://www.w3.org/2005/Atom",
+            Channel: rssChannel{
+                Title:         title,
+                Link:          link,
+                Description:   serverConfig.Feed.Description,
+                Language:      "zh-CN",
+                LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+                AtomLink:      rssLink{Href: selfURL, Rel: "self", Type: "application/rss+xml"},
+            },
+        }
+        for _, item := range items {
+            feed.Channel.Items = append(feed.Channel.Items, rssItem{
+                Title:       item.Title,
+                Link:        item.Link,
+                GUID:        rssGUID{Value: item.ID, IsPermaLink: false},
+                Description: item.Content,
+                PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+            })
+        }
+        data, err := xml.MarshalIndent(feed, "", "  ")
+        if err != nil {
+            return nil, err
+        }
+        return append([]byte(xml.Header), data...), nil
+    case "atom":
+        feed := atomFeed{
+            Title:   title,
+            ID:      selfURL,
+            Updated: updated.UTC().Format(time.RFC3339),
+            Links:   []atomLink{{Href: link}, {Href: selfURL, Rel: "self", Type: "application/atom+xml"}},
+        }
+        for _, item := range items {
+            entry := atomEntry{
+                Title:     item.Title,
+                ID:        item.ID,
+                Link:      atomLink{Href: item.Link},
+                Published: item.Published.UTC().Format(time.RFC3339),
+                Updated:   item.Updated.UTC().Format(time.RFC3339),
+                Summary:   item.Summary,
+                Content:   atomContent{Type: "html", Value: item.Content},
+            }
+            if item.Author != "" {
+                entry.Author = &atomAuthor{Name: item.Author}
+            }
+            feed.Entries = append(feed.Entries, entry)
+        }
+        data, err := xml.MarshalIndent(feed, "", "  ")
+        if err != nil {
+            return nil, err
+        }
+        return append([]byte(xml.Header), data...), nil
+    }
+
+    type jsonFeedAuthor struct {
+        Name string `json:"name"`
+    }
+    type jsonFeedItem struct {
+        ID            string           `json:"id"`
+        URL           string           `json:"url"`
+        Title         string           `json:"title"`
+        ContentHTML   string           `json:"content_html"`
+        Summary       string           `json:"summary,omitempty"`
+        DatePublished string           `json:"date_published"`
+        DateModified  string           `json:"date_modified"`
+        Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+    }
+    feed := struct {
+        Version     string         `json:"version"`
+        Title       string         `json:"title"`
+        HomePageURL string         `json:"home_page_url"`
+        FeedURL     string         `json:"feed_url"`
+        Description string         `json:"description,omitempty"`
+        Language    string         `json:"language"`
+        Items       []jsonFeedItem `json:"items"`
+    }{
+        Version:     "https://jsonfeed.org/version/1.1",
+        Title:       title,
+        HomePageURL: link,
+        FeedURL:     selfURL,
+        Description: serverConfig.Feed.Description,
+        Language:    "zh-CN",
+        Items:       []jsonFeedItem{},
+    }
+    for _, item := range items {
+        entry := jsonFeedItem{
+            ID:            item.ID,
+            URL:           item.Link,
+            Title:         item.Title,
+            ContentHTML:   item.Content,
+            Summary:       item.Summary,
+            DatePublished: item.Published.UTC().Format(time.RFC3339),
+            DateModified:  item.Updated.UTC().Format(time.RFC3339),
+        }
+        if item.Author != "" {
+            entry.Authors = []jsonFeedAuthor{{Name: item.Author}}
+        }
+        feed.Items = append(feed.Items, entry)
+    }
+    return json.MarshalIndent(feed, "", "  ")
+}
+
+// siteFeedItems 汇总城市页面、已发布的日记和（可选）留言
+func siteFeedItems(root, base string) []feedItem {
+    items := []feedItem{}
+    for _, city := range serverConfig.Cities {
+        summary := cityPageSummary(filepath.Join(root, city.Page))
+        if summary == nil {
+            continue
+        }
+        title := summary.title
+        if title == "" {
+            title = city.Name
+        }
+        items = append(items, feedItem{
+            ID:        base + "/" + city.Page,
+            Title:     title,
+            Link:      base + "/" + city.Page,
+            Summary:   summary.description,
+            Content:   html.EscapeString(summary.description),
+            Published: summary.modTime,
+            Updated:   summary.modTime,
+        })
+    }
+    for _, entry := range publishedDiaryEntries("", "") {
+        items = append(items, feedItem{
+            ID:        fmt.Sprintf("%s/api/diaries/%d", base, entry.ID),
+            Title:     entry.Title,
+            Link:      base + serverConfig.Render.RoutePrefix + entry.City,
+            Content:   renderMarkdown(entry.Body, markdownOptions{AllowImages: true, AllowHeadings: true}),
+            Author:    entry.Author,
+            Published: entry.CreatedAt,
+            Updated:   entry.UpdatedAt,
+        })
+    }
+    if serverConfig.Feed.IncludeComments {
+        for _, city := range serverConfig.Cities {
+            items = append(items, commentFeedItems(city.Abbr, base)...)
+        }
+    }
+    return items
+}
+
+// commentFeedItems 返回一个城市的留言条目
+func commentFeedItems(abbr, base string) []feedItem {
+    city, ok := findCity(abbr)
+    if !ok {
+        return nil
+    }
+    commentsMutex.RLock()
+    list := append([]Comment{}, comments[abbr]...)
+    commentsMutex.RUnlock()
+    items := make([]feedItem, 0, len(list))
+    for _, c := range list {
+        if c.Pending {
+            continue
+        }
+        items = append(items, feedItem{
+            ID:        fmt.Sprintf("%s/comments/%s#%d", base, abbr, c.ID),
+            Title:     fmt.Sprintf("%s 在%s留言", c.Nick, city.Name),
+            Link:      base + "/" + city.Page,
+            Summary:   c.Text,
+            Content:   c.HTML,
+            Author:    c.Nick,
+            Published: c.Date,
+            Updated:   c.Date,
+        })
+    }
+    return items
+}
+
+var (
+    htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+    htmlMetaPattern  = regexp.MustCompile(`(?is)<meta\s+name=["']description["']\s+content=["']([^"']*)["']`)
+    htmlBlockPattern = regexp.MustCompile(`(?is)<(style|head)\b[^>]*>.*?</(style|head)>`)
+    htmlParaPattern  = regexp.MustCompile(`(?is)<p[^>]*>(.*?)</p>`)
+    htmlTagPattern   = regexp.MustCompile(`<[^>]+>`)
+    htmlBreakPattern = regexp.MustCompile(`(?i)<br\s*/?>`)
+)
+
+// cityPageSummary 提取页面标题和摘要，按修改时间缓存
+func cityPageSummary(filePath string) *pageSummary {
+    info, err := os.Stat(filePath)
+    if err != nil {
+        return nil
+    }
+    pageSummariesMutex.Lock()
+    cached := pageSummaries[filePath]
+    pageSummariesMutex.Unlock()
+    if cached != nil && cached.modTime.Equal(info.ModTime()) {
+        return cached
+    }
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return nil
+    }
+    summary := &pageSummary{modTime: info.ModTime()}
+    if m := htmlTitlePattern.FindSubmatch(data); m != nil {
+        summary.title = plainText(string(m[1]))
+    }
+    if m := htmlMetaPattern.FindSubmatch(data); m != nil {
+        summary.description = plainText(string(m[1]))
+    } else {
+        body := htmlBlockPattern.ReplaceAll(data, nil)
+        // 部分页面的日志写在脚本模板里，跳过含 ${...} 占位符的段落和 "Day 1" 这类很短的小标题
+        for _, m := range htmlParaPattern.FindAllSubmatch(body, -1) {
+            text := plainText(string(m[1]))
+            if strings.Contains(text, "${") {
+                continue
+            }
+            if summary.description == "" {
+                summary.description = text
+            }
+            if utf8.RuneCountInString(text) >= 20 {
+                summary.description = text
+                break
+            }
+        }
+    }
+    if runes := []rune(summary.description); len(runes) > 200 {
+        summary.description = string(runes[:200]) + "…"
+    }
+    pageSummariesMutex.Lock()
+    pageSummaries[filePath] = summary
+    pageSummariesMutex.Unlock()
+    return summary
+}
+
+// plainText 去掉 HTML 标签并合并空白
+func plainText(s string) string {
+    s = htmlBreakPattern.ReplaceAllString(s, " ")
+    s = html.UnescapeString(htmlTagPattern.ReplaceAllString(s, ""))
+    return strings.Join(strings.Fields(s), " ")
+}
+
+// tokenizeSearch 分词：汉字按相邻两字切分（单字独立成词），字母和数字按连续片段切分
+func tokenizeSearch(text string) []string {
+    var tokens []string
+    var han, word []rune
+    flush := func() {
+        switch {
+        case len(han) == 1:
+            tokens = append(tokens, string(han))
+        case len(han) > 1:
+            for i := 0; i+1 < len(han); i++ {
+                tokens = append(tokens, string(han[i:i+2]))
+            }
+        }
+        if len(word) > 0 {
+            tokens = append(tokens, string(word))
+        }
+        han, word = han[:0], word[:0]
+    }
+    for _, r := range strings.ToLower(text) {
+        switch {
+        case unicode.Is(unicode.Han, r):
+            if len(word) > 0 {
+                flush()
+            }
+            han = append(han, r)
+        case unicode.IsLetter(r) || unicode.IsDigit(r):
+            if len(han) > 0 {
+                flush()
+            }
+            word = append(word, r)
+        default:
+            flush()
+        }
+    }
+    flush()
+    return tokens
+}
+
+// searchIndexTokens 索引使用的词：在 tokenizeSearch 的基础上再收录连续汉字中的每个字，
+// 查询只有一个汉字时也能命中
+func searchIndexTokens(text string) []string {
+    tokens := tokenizeSearch(text)
+    var han []rune
+    flush := func() {
+        if len(han) > 1 {
+            for _, r := range han {
+                tokens = append(tokens, string(r))
+            }
+        }
+        han = han[:0]
+    }
+    for _, r := range strings.ToLower(text) {
+        if unicode.Is(unicode.Han, r) {
+            han = append(han, r)
+        } else {
+            flush()
+        }
+    }
+    flush()
+    return tokens
+}
+
+// addSearchDoc 将文档加入倒排索引，ID 已存在时先移除旧文档
+func addSearchDoc(doc *searchDoc) {
+    tokens := searchIndexTokens(doc.Title + " " + doc.Text)
+    doc.length = len(tokens)
+    searchMutex.Lock()
+    defer searchMutex.Unlock()
+    removeSearchDocLocked(doc.ID)
+    searchDocs[doc.ID] = doc
+    searchLength += doc.length
+    for _, t := range tokens {
+        postings := searchPostings[t]
+        if postings == nil {
+            postings = make(map[string]int)
+            searchPostings[t] = postings
+        }
+        postings[doc.ID]++
+    }
+}
+
+// removeSearchDoc 从索引中移除文档
+func removeSearchDoc(id string) {
+    searchMutex.Lock()
+    defer searchMutex.Unlock()
+    removeSearchDocLocked(id)
+}
+
+func removeSearchDocLocked(id string) {
+    doc, ok := searchDocs[id]
+    if !ok {
+        return
+    }
+    for _, t := range searchIndexTokens(doc.Title + " " + doc.Text) {
+        if postings := searchPostings[t]; postings != nil {
+            delete(postings, id)
+            if len(postings) == 0 {
+                delete(searchPostings, t)
+            }
+        }
+    }
+    searchLength -= doc.length
+    delete(searchDocs, id)
+}
+
+// replaceSearchSource 用来源文件的新文档替换旧文档
+func replaceSearchSource(key string, modTime time.Time, docs []*searchDoc) {
+    searchMutex.RLock()
+    old := searchSources[key]
+    searchMutex.RUnlock()
+    if old != nil {
+        for _, id := range old.docIDs {
+            removeSearchDoc(id)
+        }
+    }
+    source := &searchSource{modTime: modTime}
+    for _, doc := range docs {
+        addSearchDoc(doc)
+        source.docIDs = append(source.docIDs, doc.ID)
+    }
+    searchMutex.Lock()
+    searchSources[key] = source
+    searchMutex.Unlock()
+}
+
+// indexComment 将一条新留言加入索引
+func indexComment(city string, c Comment) {
+    info, ok := findCity(city)
+    if !ok {
+        return
+    }
+    addSearchDoc(&searchDoc{
+        ID:    fmt.Sprintf("comment:%s:%d", city, c.ID),
+        Kind:  "comment",
+        City:  city,
+        Title: c.Nick,
+        URL:   "/" + info.Page,
+        Text:  c.Text,
+        Date:  c.Date,
+    })
+}
+
+// indexDiaryEntry 更新日记条目的索引，未发布的条目从索引中移除
+func indexDiaryEntry(entry DiaryEntry) {
+    id := fmt.Sprintf("entry:%d", entry.ID)
+    if entry.Status != "published" {
+        removeSearchDoc(id)
+        return
+    }
+    addSearchDoc(&searchDoc{
+        ID:    id,
+        Kind:  "diary",
+        City:  entry.City,
+        Title: entry.Title,
+        URL:   serverConfig.Render.RoutePrefix + entry.City,
+        Text:  plainText(renderMarkdown(entry.Body, markdownOptions{})) + " " + strings.Join(entry.Tags, " "),
+        Date:  entry.UpdatedAt,
+    })
+}
+
+var htmlTextBlockPattern = regexp.MustCompile(`(?is)<(p|h[1-6]|li)\b[^>]*>(.*?)</(p|h[1-6]|li)>`)
+
+// refreshSearchIndex 重新索引修改过的城市页面和 Markdown 日记
+func refreshSearchIndex(root string) {
+    for _, city := range serverConfig.Cities {
+        sources := []struct {
+            key, filePath, kind string
+        }{
+            {"page:" + city.Page, filepath.Join(root, city.Page), "page"},
+            {"diary:" + city.Abbr, filepath.Join(serverConfig.Render.DiaryDir, city.Abbr+".md"), "diary"},
+        }
+        for _, src := range sources {
+            info, err := os.Stat(src.filePath)
+            searchMutex.RLock()
+            old := searchSources[src.key]
+            searchMutex.RUnlock()
+            if err != nil {
+                if old != nil {
+                    replaceSearchSource(src.key, time.Time{}, nil)
+                }
+                continue
+            }
+            if old != nil && old.modTime.Equal(info.ModTime()) {
+                continue
+            }
+            data, err := os.ReadFile(src.filePath)
+            if err != nil {
+                continue
+            }
+            var docs []*searchDoc
+            if src.kind == "page" {
+                title := city.Name
+                if summary := cityPageSummary(src.filePath); summary != nil && summary.title != "" {
+                    title = summary.title
+                }
+                body := htmlBlockPattern.ReplaceAll(data, nil)
+                for i, m := range htmlTextBlockPattern.FindAllSubmatch(body, -1) {
+                    text := plainText(string(m[2]))
+                    // 跳过脚本模板中的占位符段落
+                    if text == "" || strings.Contains(text, "${") {
+                        continue
+                    }
+                    docs = append(docs, &searchDoc{
+                        ID:    fmt.Sprintf("page:%s#%d", city.Page, i),
+                        Kind:  "page",
+                        City:  city.Abbr,
+                        Title: title,
+                        URL:   "/" + city.Page,
+                        Text:  text,
+                        Date:  info.ModTime(),
+                    })
+                }
+            } else {
+                meta, body := parseFrontMatter(string(data))
+                title := meta["title"]
+                if title == "" {
+                    title = city.Name + "之旅"
+                }
+                docs = append(docs, &searchDoc{
+                    ID:    "diary:" + city.Abbr,
+                    Kind:  "diary",
+                    City:  city.Abbr,
+                    Title: title,
+                    URL:   serverConfig.Render.RoutePrefix + city.Abbr,
+                    Text:  plainText(renderMarkdown(body, markdownOptions{})),
+                    Date:  info.ModTime(),
+                })
+            }
+            replaceSearchSource(src.key, info.ModTime(), docs)
+        }
+    }
+}
+
+// periodicSearchIndex 建立完整索引，之后定期检查页面和日记文件的变化
+func periodicSearchIndex(root string) {
+    commentsMutex.RLock()
+    snapshot := make(map[string][]Comment, len(comments))
+    for city, list := range comments {
+        snapshot[city] = append([]Comment{}, list...)
+    }
+    commentsMutex.RUnlock()
+    for city, list := range snapshot {
+        for _, c := range list {
+            if !c.Pending {
+                indexComment(city, c)
+            }
+        }
+    }
+    diariesMutex.RLock()
+    entries := make([]DiaryEntry, 0, len(diaries.Entries))
+    for _, e := range diaries.Entries {
+        entries = append(entries, *e)
+    }
+    diariesMutex.RUnlock()
+    for _, e := range entries {
+        indexDiaryEntry(e)
+    }
+    refreshSearchIndex(root)
+    searchMutex.RLock()
+    log.Printf("🔎 搜索索引已建立: %d 篇文档, %d 个词", len(searchDocs), len(searchPostings))
+    searchMutex.RUnlock()
+
+    interval := serverConfig.Search.RefreshSeconds
+    if interval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(time.Duration(interval) * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        refreshSearchIndex(root)
+    }
+}
+
+// searchIndexQuery 查找包含全部查询词的文档，按 BM25 排序，完整包含查询短语的文档额外加权
+func searchIndexQuery(query, city, kind string) []searchResult {
+    terms := tokenizeSearch(query)
+    if len(terms) == 0 {
+        return []searchResult{}
+    }
+    searchMutex.RLock()
+    defer searchMutex.RUnlock()
+
+    total := float64(len(searchDocs))
+    avgLength := 1.0
+    if len(searchDocs) > 0 {
+        avgLength = math.Max(float64(searchLength)/total, 1)
+    }
+    scores := make(map[string]float64)
+    for i, t := range terms {
+        postings := searchPostings[t]
+        idf := math.Log(1 + (total-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+        next := make(map[string]float64)
+        for id, tf := range postings {
+            if _, ok := scores[id]; i > 0 && !ok {
+                continue
+            }
+            doc := searchDocs[id]
+            if (city != "" && doc.City != city) || (kind != "" && doc.Kind != kind) {
+                continue
+            }
+            f := float64(tf)
+            next[id] = scores[id] + idf*f*2.2/(f+1.2*(0.25+0.75*float64(doc.length)/avgLength))
+        }
+        scores = next
+    }
+
+    phrase := strings.ToLower(strings.Join(strings.Fields(query), " "))
+    results := make([]searchResult, 0, len(scores))
+    for id, score := range scores {
+        doc := searchDocs[id]
+        if strings.Contains(strings.ToLower(doc.Title+" "+doc.Text), phrase) {
+            score *= 1.5
+        }
+        results = append(results, searchResult{
+            Type:    doc.Kind,
+            City:    doc.City,
+            Title:   doc.Title,
+            URL:     doc.URL,
+            Snippet: highlightSnippet(doc.Text, query, serverConfig.Search.SnippetRunes),
+            Date:    doc.Date,
+            Score:   math.Round(score*1000) / 1000,
+        })
+    }
+    sort.Slice(results, func(i, j int) bool {
+        if results[i].Score != results[j].Score {
+            return results[i].Score > results[j].Score
+        }
+        return results[i].Date.After(results[j].Date)
+    })
+    return results
+}
+
+// highlightSnippet 截取第一个命中位置附近的文字，转义后用 <mark> 标出查询词
+func highlightSnippet(text, query string, width int) string {
+    runes := []rune(text)
+    lower := []rune(strings.ToLower(text))
+    if len(lower) != len(runes) {
+        lower = runes
+    }
+    marked := make([]bool, len(runes))
+    first := -1
+    for _, t := range tokenizeSearch(query) {
+        needle := []rune(t)
+        for i := 0; i+len(needle) <= len(lower); i++ {
+            if string(lower[i:i+len(needle)]) != t {
+                continue
+            }
+            for j := i; j < i+len(needle); j++ {
+                marked[j] = true
+            }
+            if first < 0 || i < first {
+                first = i
+            }
+        }
+    }
+    start, end := 0, len(runes)
+    if width > 0 && len(runes) > width {
+        start = maxInt(first-width/3, 0)
+        end = start + width
+        if end > len(runes) {
+            end = len(runes)
+            start = maxInt(end-width, 0)
+        }
+    }
+    var b strings.Builder
+    if start > 0 {
+        b.WriteString("…")
+    }
+    for i := start; i < end; {
+        j := i
+        for j < end && marked[j] == marked[i] {
+            j++
+        }
+        segment := html.EscapeString(string(runes[i:j]))
+        if marked[i] {
+            segment = "<mark>" + segment + "</mark>"
+        }
+        b.WriteString(segment)
+        i = j
+    }
+    if end < len(runes) {
+        b.WriteString("…")
+    }
+    return b.String()
+}
+
+// notifySubscriptions 根据配置创建通知渠道
+func notifySubscriptions() []*notifySubscription {
+    cfg := serverConfig.Notify
+    var subs []*notifySubscription
+    for i, hook := range cfg.Webhooks {
+        if hook.Name == "" {
+            hook.Name = fmt.Sprintf("webhook-%d", i+1)
+        }
+        subs = append(subs, &notifySubscription{
+            channel: &webhookChannel{cfg: hook, client: &http.Client{Timeout: 10 * time.Second}},
+            cities:  hook.Cities,
+            digest:  hook.Digest,
+        })
+    }
+    for i, mail := range cfg.Emails {
+        if mail.Name == "" {
+            mail.Name = fmt.Sprintf("email-%d", i+1)
+        }
+        subs = append(subs, &notifySubscription{channel: &emailChannel{cfg: mail}, cities: mail.Cities, digest: mail.Digest})
+    }
+    return subs
+}
+
+// startNotifier 启动通知分发协程
+func startNotifier() {
+    cfg := serverConfig.Notify
+    if !cfg.Enabled {
+        return
+    }
+    subs := notifySubscriptions()
+    if len(subs) == 0 {
+        log.Println("⚠  通知功能已启用但没有配置任何渠道")
+        return
+    }
+    notifyQueue = make(chan commentEvent, maxInt(cfg.QueueSize, 1))
+    go runNotifier(notifyQueue, subs)
+    log.Printf("📮 留言通知已启用: %d 个渠道", len(subs))
+}
+
+// notifyComment 将新留言放入通知队列，队列已满时丢弃并记录日志，不阻塞请求
+func notifyComment(city string, c Comment) {
+    if notifyQueue == nil {
+        return
+    }
+    info, _ := findCity(city)
+    event := commentEvent{City: city, ID: c.ID, Nick: c.Nick, Text: c.Text, Date: c.Date, Images: len(c.Images), Pending: c.Pending}
+    if info != nil {
+        event.CityName = info.Name
+        // 没有配置站点地址时无法给出可点击的完整链接，省略
+        if base := configuredBaseURL(); base != "" {
+            event.URL = base + "/" + info.Page
+        }
+    }
+    select {
+    case notifyQueue <- event:
+    default:
+        log.Printf("⚠  通知队列已满，丢弃留言通知: %s #%d", city, c.ID)
+    }
+}
+
+// runNotifier 把留言分发到各渠道：即时渠道立即交给投递协程，汇总渠道按间隔合并。
+// 每个渠道有自己的投递协程和队列，队列关闭后投递协程退出
+func runNotifier(queue <-chan commentEvent, subs []*notifySubscription) {
+    cfg := serverConfig.Notify
+    for _, sub := range subs {
+        sub.queue = make(chan *notifyDelivery, maxInt(cfg.QueueSize, 1))
+        go runNotifyWorker(sub, cfg)
+    }
+    defer func() {
+        for _, sub := range subs {
+            close(sub.queue)
+        }
+    }()
+    digestTicker := time.NewTicker(time.Duration(maxInt(cfg.DigestIntervalMinutes, 1)) * time.Minute)
+    defer digestTicker.Stop()
+
+    enqueue := func(d *notifyDelivery) {
+        select {
+        case d.sub.queue <- d:
+        default:
+            log.Printf("⚠  %s 的投递队列已满，丢弃 %d 条留言通知", d.sub.channel.Name(), len(d.events))
+        }
+    }
+
+    for {
+        select {
+        case event, ok := <-queue:
+            if !ok {
+                return
+            }
+            for _, sub := range subs {
+                if len(sub.cities) > 0 && !containsFold(sub.cities, event.City) {
+                    continue
+                }
+                if sub.digest {
+                    sub.pending = append(sub.pending, event)
+                    continue
+                }
+                enqueue(&notifyDelivery{sub: sub, events: []commentEvent{event}})
+            }
+        case <-digestTicker.C:
+            for _, sub := range subs {
+                if len(sub.pending) == 0 {
+                    continue
+                }
+                events := sub.pending
+                sub.pending = nil
+                enqueue(&notifyDelivery{sub: sub, events: events, digest: true})
+            }
+        }
+    }
+}
+
+// runNotifyWorker 依次投递一个渠道的通知，失败的投递按指数退避重试
+func runNotifyWorker(sub *notifySubscription, cfg NotifyConfig) {
+    retryTicker := time.NewTicker(time.Second)
+    defer retryTicker.Stop()
+    var retries []*notifyDelivery
+
+    deliver := func(d *notifyDelivery) {
+        err := sub.channel.Send(d.events, d.digest)
+        if err == nil {
+            log.Printf("📮 已通过 %s 发送 %d 条留言通知", sub.channel.Name(), len(d.events))
+            return
+        }
+        d.attempt++
+        if errors.Is(err, errPermanent) || d.attempt > cfg.MaxRetries {
+            log.Printf("❌ 通知发送失败，放弃: %s: %v", sub.channel.Name(), err)
+            return
+        }
+        delay := time.Duration(cfg.RetryBaseSeconds) * time.Second << (d.attempt - 1)
+        if delay > time.Hour || delay <= 0 {
+            delay = time.Hour
+        }
+        d.next = time.Now().Add(delay)
+        retries = append(retries, d)
+        log.Printf("⚠  通知发送失败，%v 后第 %d 次重试: %s: %v", delay, d.attempt, sub.channel.Name(), err)
+    }
+
+    for {
+        select {
+        case d, ok := <-sub.queue:
+            if !ok {
+                return
+            }
+            deliver(d)
+        case <-retryTicker.C:
+            now := time.Now()
+            var due []*notifyDelivery
+            remaining := retries[:0]
+            for _, d := range retries {
+                if now.Before(d.next) {
+                    remaining = append(remaining, d)
+                } else {
+                    due = append(due, d)
+                }
+            }
+            retries = remaining
+            for _, d := range due {
+                deliver(d)
+            }
+        }
+    }
+}
+
+func (c *webhookChannel) Name() string {
+    return c.cfg.Name
+}
+
+// Send 发送 JSON 请求。X-TravelDiary-Signature 为 "sha256=" 加上
+// HMAC-SHA256(secret, 时间戳 + "." + 请求体) 的十六进制值，接收方可据此校验来源并拒绝重放
+func (c *webhookChannel) Send(events []commentEvent, digest bool) error {
+    eventType := "comment.created"
+    if digest {
+        eventType = "comment.digest"
+    }
+    body, err := json.Marshal(map[string]interface{}{
+        "event":    eventType,
+        "site":     serverConfig.Feed.Title,
+        "comments": events,
+        "sent_at":  time.Now().UTC(),
+    })
+    if err != nil {
+        return fmt.Errorf("%w: %v", errPermanent, err)
+    }
+    req, err := http.NewRequest(http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+    if err != nil {
+        return fmt.Errorf("%w: %v", errPermanent, err)
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json; charset=utf-8")
+    req.Header.Set("User-Agent", "MyTravelDiary-Webhook/1.0")
+    req.Header.Set("X-TravelDiary-Event", eventType)
+    req.Header.Set("X-TravelDiary-Timestamp", timestamp)
+    req.Header.Set("X-TravelDiary-Delivery", generateNonce())
+    if c.cfg.Secret != "" {
+        mac := hmac.New(sha256.New, []byte(c.cfg.Secret))
+        mac.Write([]byte(timestamp + "."))
+        mac.Write(body)
+        req.Header.Set("X-TravelDiary-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+    resp, err := c.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return nil
+    case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+        return fmt.Errorf("%w: HTTP %d", errPermanent, resp.StatusCode)
+    }
+    return fmt.Errorf("HTTP %d", resp.StatusCode)
+}
+
+func (c *emailChannel) Name() string {
+    return c.cfg.Name
+}
+
+// Send 发送纯文本邮件，汇总模式下一封邮件包含多条留言
+func (c *emailChannel) Send(events []commentEvent, digest bool) error {
+    cfg := c.cfg
+    if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+        return fmt.Errorf("%w: 邮件配置不完整", errPermanent)
+    }
+    subject := fmt.Sprintf("[%s] %s 在%s留言", serverConfig.Feed.Title, events[0].Nick, events[0].CityName)
+    if digest || len(events) > 1 {
+        subject = fmt.Sprintf("[%s] %d 条新留言", serverConfig.Feed.Title, len(events))
+    }
+    var text strings.Builder
+    for _, e := range events {
+        fmt.Fprintf(&text, "%s · %s · %s\r\n%s\r\n", e.CityName, e.Nick, e.Date.Local().Format("2006-01-02 15:04"), e.Text)
+        if e.Images > 0 {
+            fmt.Fprintf(&text, "（附带 %d 张图片", e.Images)
+            if e.Pending {
+                text.WriteString("，等待审核")
+            }
+            text.WriteString("）\r\n")
+        }
+        if e.URL != "" {
+            fmt.Fprintf(&text, "%s\r\n", e.URL)
+        }
+        text.WriteString("\r\n")
+    }
+
+    return sendMail(cfg, buildMailMessage(cfg.From, cfg.To, subject, text.String()))
+}
+
+// buildMailMessage 生成 UTF-8 纯文本邮件，标题和正文使用 base64 编码
+func buildMailMessage(from string, to []string, subject, text string) []byte {
+    var msg bytes.Buffer
+    fmt.Fprintf(&msg, "From: %s\r\n", from)
+    fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+    fmt.Fprintf(&msg, "Subject: =?UTF-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject)))
+    fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    fmt.Fprintf(&msg, "Message-ID: <%s@mytraveldiary>\r\n", strings.Trim(generateNonce(), "="))
+    msg.WriteString("MIME-Version: 1.0\r\n")
+    msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+    msg.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+    encoded := base64.StdEncoding.EncodeToString([]byte(text))
+    for len(encoded) > 76 {
+        msg.WriteString(encoded[:76] + "\r\n")
+        encoded = encoded[76:]
+    }
+    msg.WriteString(encoded + "\r\n")
+    return msg.Bytes()
+}
+
+// smtpTimeout 连接 SMTP 服务器并发送一封邮件的总时限，服务器无响应时投递失败后按退避重试
+var smtpTimeout = 30 * time.Second
+
+// sendMail 通过配置的 SMTP 服务器发送一封已编码的邮件
+func sendMail(cfg EmailConfig, msg []byte) error {
+    port := cfg.Port
+    if port == 0 {
+        port = 25
+    }
+    addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+    dialer := &net.Dialer{Timeout: smtpTimeout}
+    var conn net.Conn
+    var err error
+    if cfg.ImplicitTLS {
+        conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: cfg.Host})
+    } else {
+        conn, err = dialer.Dial("tcp", addr)
+    }
+    if err != nil {
+        return err
+    }
+    if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+        conn.Close()
+        return err
+    }
+    client, err := smtp.NewClient(conn, cfg.Host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer client.Close()
+    if !cfg.ImplicitTLS {
+        if ok, _ := client.Extension("STARTTLS"); ok {
+            if err := client.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+                return err
+            }
+        }
+    }
+    if cfg.Username != "" {
+        if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+            return err
+        }
+    }
+    if err := client.Mail(cfg.From); err != nil {
+        return err
+    }
+    for _, to := range cfg.To {
+        if err := client.Rcpt(to); err != nil {
+            return err
+        }
+    }
+    wc, err := client.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := wc.Write(msg); err != nil {
+        return err
+    }
+    if err := wc.Close(); err != nil {
+        return err
+    }
+    return client.Quit()
+}
+
+// loadIdentities 加载已认领的昵称，首次启动时生成 Cookie 签名密钥
+func loadIdentities() {
+    data, err := os.ReadFile("identities.json")
+    if err == nil {
+        var store identityStore
+        if err := json.Unmarshal(data, &store); err != nil {
+            log.Printf("⚠  加载昵称认证记录失败: %v", err)
+        } else {
+            identities = store
+        }
+    }
+    if identities.Accounts == nil {
+        identities.Accounts = make(map[string]*NickAccount)
+    }
+    if identities.Secret == "" {
+        secret := make([]byte, 32)
+        if _, err := rand.Read(secret); err != nil {
+            log.Fatal("❌ 生成 Cookie 签名密钥失败:", err)
+        }
+        identities.Secret = hex.EncodeToString(secret)
+        if err := saveIdentities(); err != nil {
+            log.Printf("⚠  保存昵称认证记录失败: %v", err)
+        }
+    }
+    log.Printf("🪪 已加载 %d 个认证昵称", len(identities.Accounts))
+}
+
+// saveIdentities 保存昵称认证记录，调用方需持有 identitiesMutex
+func saveIdentities() error {
+    data, err := json.MarshalIndent(identities, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := "identities.json.tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, "identities.json")
+}
+
+// normalizeNick 统一昵称的比较形式：忽略大小写、空白、标点和零宽字符，
+// 防止用 "A d-m_i n" 这类写法冒充
+func normalizeNick(nick string) string {
+    var b strings.Builder
+    for _, r := range strings.ToLower(nick) {
+        if unicode.IsLetter(r) || unicode.IsDigit(r) {
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
+
+// isReservedNick 判断昵称是否为保留昵称
+func isReservedNick(nick string) bool {
+    key := normalizeNick(nick)
+    for _, reserved := range serverConfig.Identity.ReservedNicks {
+        if normalizeNick(reserved) == key {
+            return true
+        }
+    }
+    return false
+}
+
+// isOwnerNick 判断昵称是否属于站长
+func isOwnerNick(nick string) bool {
+    key := normalizeNick(nick)
+    for _, owner := range serverConfig.Identity.OwnerNicks {
+        if normalizeNick(owner) == key {
+            return true
+        }
+    }
+    for name := range serverConfig.Admin.Tokens {
+        if normalizeNick(name) == key {
+            return true
+        }
+    }
+    return false
+}
+
+// commentIdentity 判断留言昵称是否可用以及是否已认证。已认领、保留和站长昵称只能由本人使用
+func commentIdentity(r *http.Request, nick string) (verified, owner, allowed bool) {
+    if !serverConfig.Identity.Enabled {
+        return false, false, true
+    }
+    key := normalizeNick(nick)
+    if account := identityFromRequest(r); account != nil && normalizeNick(account.Nick) == key {
+        return true, account.Owner, true
+    }
+    if _, isAdmin := adminUser(r); isAdmin && isOwnerNick(nick) {
+        return true, true, true
+    }
+    identitiesMutex.RLock()
+    _, claimed := identities.Accounts[key]
+    identitiesMutex.RUnlock()
+    if claimed || isReservedNick(nick) || isOwnerNick(nick) {
+        return false, false, false
+    }
+    return false, false, true
+}
+
+// hashPassword 使用 PBKDF2-SHA256 计算密码哈希，salt 为空时生成新的盐
+func hashPassword(password, salt string) (string, string, error) {
+    if salt == "" {
+        b := make([]byte, 16)
+        rand.Read(b)
+        salt = hex.EncodeToString(b)
+    }
+    key, err := pbkdf2.Key(sha256.New, password, []byte(salt), 210000, 32)
+    if err != nil {
+        return "", "", err
+    }
+    return salt, hex.EncodeToString(key), nil
+}
+
+func checkPassword(account *NickAccount, password string) bool {
+    _, hash, err := hashPassword(password, account.Salt)
+    return err == nil && subtle.ConstantTimeCompare([]byte(hash), []byte(account.PasswordHash)) == 1
+}
+
+// loginLocked 15 分钟内失败 5 次后暂停登录。密码登录按昵称和 IP 统计，登录链接按昵称统计
+func loginLocked(key string) bool {
+    identitiesMutex.Lock()
+    defer identitiesMutex.Unlock()
+    cutoff := time.Now().Add(-15 * time.Minute)
+    var recent []time.Time
+    for _, t := range loginFailures[key] {
+        if t.After(cutoff) {
+            recent = append(recent, t)
+        }
+    }
+    if len(recent) == 0 {
+        delete(loginFailures, key)
+        return false
+    }
+    loginFailures[key] = recent
+    return len(recent) >= 5
+}
+
+func recordLoginFailure(key string) {
+    identitiesMutex.Lock()
+    loginFailures[key] = append(loginFailures[key], time.Now())
+    identitiesMutex.Unlock()
+}
+
+// serveIdentity 处理 /api/identity/ 下的昵称认领、登录、邮件确认和退出
+func serveIdentity(w http.ResponseWriter, r *http.Request) {
+    if !serverConfig.Identity.Enabled {
+        writeError(w, r, http.StatusNotFound, "")
+        return
+    }
+    action := strings.TrimPrefix(r.URL.Path, "/api/identity/")
+    if action == "me" || action == "verify" {
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+    } else if r.Method != http.MethodPost {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    // 认领和登录需要计算密码哈希或发送邮件，按 IP 限制次数
+    if (action == "claim" || action == "login" || action == "magic") && identityThrottled(getRealIP(r)) {
+        w.Header().Set("Retry-After", "900")
+        writeError(w, r, http.StatusTooManyRequests, "尝试次数过多，请稍后再试")
+        return
+    }
+
+    var req struct {
+        Nick      string `json:"nick"`
+        Password  string `json:"password"`
+        Email     string `json:"email"`
+        Challenge string `json:"challenge"`
+        Nonce     string `json:"nonce"`
+    }
+    if r.Method == http.MethodPost && action != "logout" {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            writeError(w, r, http.StatusBadRequest, "无效的请求体")
+            return
+        }
+        req.Nick = strings.TrimSpace(req.Nick)
+        req.Email = strings.TrimSpace(req.Email)
+        if req.Nick == "" {
+            writeError(w, r, http.StatusBadRequest, "昵称不能为空")
+            return
+        }
+        // 与匿名留言共用工作量证明，放在计算密码哈希和发送邮件之前
+        if serverConfig.Challenge.Enabled && action != "logout" {
+            if err := verifyChallenge(req.Challenge, req.Nonce); err != nil {
+                log.Printf("🛡  昵称认证人机验证失败: %s %s (%v), IP: %s", action, req.Nick, err, getRealIP(r))
+                writeError(w, r, http.StatusForbidden, err.Error())
+                return
+            }
+            recordCommentAttempt()
+        }
+    }
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-store")
+
+    switch action {
+    case "me":
+        account := identityFromRequest(r)
+        if account == nil {
+            writeError(w, r, http.StatusUnauthorized, "未登录")
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"nick": account.Nick, "owner": account.Owner, "verified": true})
+
+    case "claim":
+        if req.Password == "" && req.Email == "" {
+            writeError(w, r, http.StatusBadRequest, "需要设置密码或邮箱")
+            return
+        }
+        if req.Password != "" && utf8.RuneCountInString(req.Password) < serverConfig.Identity.MinPasswordLength {
+            writeError(w, r, http.StatusBadRequest, fmt.Sprintf("密码至少 %d 位", serverConfig.Identity.MinPasswordLength))
+            return
+        }
+        if req.Email != "" {
+            if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+                writeError(w, r, http.StatusBadRequest, "邮箱格式不正确")
+                return
+            }
+        }
+        _, isAdmin := adminUser(r)
+        owner := isOwnerNick(req.Nick)
+        if (owner || isReservedNick(req.Nick)) && !isAdmin {
+            writeError(w, r, http.StatusForbidden, "该昵称为保留昵称")
+            return
+        }
+        key := normalizeNick(req.Nick)
+        identitiesMutex.RLock()
+        _, exists := identities.Accounts[key]
+        identitiesMutex.RUnlock()
+        if exists {
+            writeError(w, r, http.StatusConflict, "该昵称已被认领")
+            return
+        }
+        account := &NickAccount{Nick: req.Nick, Email: req.Email, Owner: owner, CreatedAt: time.Now()}
+        if req.Password == "" {
+            // 只有邮箱时先发确认链接，点击后才真正认领，避免用别人的邮箱抢占昵称
+            if loginLocked("magic|" + key) {
+                w.Header().Set("Retry-After", "900")
+                writeError(w, r, http.StatusTooManyRequests, "尝试次数过多，请稍后再试")
+                return
+            }
+            recordLoginFailure("magic|" + key)
+            if err := sendMagicLink(account, true); err != nil {
+                log.Printf("⚠  发送认领确认链接失败: %s: %v", req.Nick, err)
+                writeError(w, r, http.StatusServiceUnavailable, "暂时无法发送确认邮件")
+                return
+            }
+            w.WriteHeader(http.StatusAccepted)
+            json.NewEncoder(w).Encode(map[string]interface{}{"nick": account.Nick, "owner": owner, "logged_in": false, "email_sent": true})
+            return
+        }
+        salt, hash, err := hashPassword(req.Password, "")
+        if err != nil {
+            log.Printf("⚠  计算密码哈希失败: %v", err)
+            writeError(w, r, http.StatusInternalServerError, "服务器内部错误")
+            return
+        }
+        account.Salt, account.PasswordHash = salt, hash
+        identitiesMutex.Lock()
+        if _, exists := identities.Accounts[key]; exists {
+            identitiesMutex.Unlock()
+            writeError(w, r, http.StatusConflict, "该昵称已被认领")
+            return
+        }
+        identities.Accounts[key] = account
+        err = saveIdentities()
+        identitiesMutex.Unlock()
+        if err != nil {
+            log.Printf("⚠  保存昵称认证记录失败: %v", err)
+            writeError(w, r, http.StatusInternalServerError, "保存失败")
+            return
+        }
+        log.Printf("🪪 昵称已认领: %s (站长: %v)", req.Nick, owner)
+        emailSent := false
+        if req.Email != "" {
+            if err := sendMagicLink(account, false); err != nil {
+                log.Printf("⚠  发送登录链接失败: %s: %v", req.Nick, err)
+            } else {
+                emailSent = true
+            }
+        }
+        setIdentityCookie(w, r, account.Nick)
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]interface{}{"nick": account.Nick, "owner": owner, "logged_in": true, "email_sent": emailSent})
+
+    case "login":
+        key := normalizeNick(req.Nick)
+        identitiesMutex.RLock()
+        account := identities.Accounts[key]
+        identitiesMutex.RUnlock()
+        // 昵称不存在或没有密码时直接拒绝，不计算哈希也不记录失败
+        if account == nil || account.PasswordHash == "" {
+            writeError(w, r, http.StatusUnauthorized, "昵称或密码错误")
+            return
+        }
+        // 失败次数按昵称和 IP 分别统计，别人无法替某个昵称触发锁定
+        failKey := key + "|" + getRealIP(r)
+        if loginLocked(failKey) {
+            w.Header().Set("Retry-After", "900")
+            writeError(w, r, http.StatusTooManyRequests, "尝试次数过多，请稍后再试")
+            return
+        }
+        if !checkPassword(account, req.Password) {
+            recordLoginFailure(failKey)
+            writeError(w, r, http.StatusUnauthorized, "昵称或密码错误")
+            return
+        }
+        setIdentityCookie(w, r, account.Nick)
+        json.NewEncoder(w).Encode(map[string]interface{}{"nick": account.Nick, "owner": account.Owner})
+
+    case "magic":
+        key := normalizeNick(req.Nick)
+        identitiesMutex.RLock()
+        account := identities.Accounts[key]
+        identitiesMutex.RUnlock()
+        // 无论昵称是否存在都返回相同结果，避免被用来探测已认领的昵称
+        if account != nil && account.Email != "" && !loginLocked("magic|"+key) {
+            recordLoginFailure("magic|" + key)
+            if err := sendMagicLink(account, false); err != nil {
+                log.Printf("⚠  发送登录链接失败: %s: %v", account.Nick, err)
+            }
+        }
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(map[string]string{"message": "如果该昵称绑定了邮箱，登录链接已发送"})
+
+    case "verify":
+        account := consumeMagicLink(r.URL.Query().Get("token"))
+        if account == nil {
+            writeError(w, r, http.StatusBadRequest, "登录链接无效或已过期")
+            return
+        }
+        setIdentityCookie(w, r, account.Nick)
+        http.Redirect(w, r, "/homepage.html", http.StatusSeeOther)
+
+    case "logout":
+        http.SetCookie(w, &http.Cookie{Name: serverConfig.Identity.CookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        writeError(w, r, http.StatusNotFound, "")
+    }
+}
+
+// identityThrottled 记录一次认领或登录请求，同一 IP 15 分钟内超过上限时返回 true
+func identityThrottled(ip string) bool {
+    limit := serverConfig.Identity.MaxAttemptsPerIP
+    if limit <= 0 {
+        return false
+    }
+    identitiesMutex.Lock()
+    defer identitiesMutex.Unlock()
+    now := time.Now()
+    cutoff := now.Add(-15 * time.Minute)
+    if len(identityAttempts) > 10000 {
+        for k, times := range identityAttempts {
+            if !times[len(times)-1].After(cutoff) {
+                delete(identityAttempts, k)
+            }
+        }
+    }
+    var recent []time.Time
+    for _, t := range identityAttempts[ip] {
+        if t.After(cutoff) {
+            recent = append(recent, t)
+        }
+    }
+    if len(recent) >= limit {
+        identityAttempts[ip] = recent
+        return true
+    }
+    identityAttempts[ip] = append(recent, now)
+    return false
+}
+
+// signIdentity 计算 Cookie 签名
+func signIdentity(payload string) string {
+    mac := hmac.New(sha256.New, []byte(identities.Secret))
+    mac.Write([]byte(payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setIdentityCookie 写入签名 Cookie，格式为 base64(昵称).过期时间.签名
+func setIdentityCookie(w http.ResponseWriter, r *http.Request, nick string) {
+    maxAge := time.Duration(serverConfig.Identity.CookieMaxAgeDays) * 24 * time.Hour
+    payload := base64.RawURLEncoding.EncodeToString([]byte(nick)) + "." + strconv.FormatInt(time.Now().Add(maxAge).Unix(), 10)
+    identitiesMutex.RLock()
+    value := payload + "." + signIdentity(payload)
+    identitiesMutex.RUnlock()
+    http.SetCookie(w, &http.Cookie{
+        Name:     serverConfig.Identity.CookieName,
+        Value:    value,
+        Path:     "/",
+        MaxAge:   int(maxAge.Seconds()),
+        HttpOnly: true,
+        Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+        SameSite: http.SameSiteLaxMode,
+    })
+}
+
+// identityFromRequest 校验 Cookie 并返回对应的昵称账号
+func identityFromRequest(r *http.Request) *NickAccount {
+    cookie, err := r.Cookie(serverConfig.Identity.CookieName)
+    if err != nil {
+        return nil
+    }
+    parts := strings.Split(cookie.Value, ".")
+    if len(parts) != 3 {
+        return nil
+    }
+    expires, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return nil
+    }
+    nick, err := base64.RawURLEncoding.DecodeString(parts[0])
+    if err != nil {
+        return nil
+    }
+    identitiesMutex.RLock()
+    defer identitiesMutex.RUnlock()
+    expected := signIdentity(parts[0] + "." + parts[1])
+    if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+        return nil
+    }
+    // 昵称被删除后旧 Cookie 随之失效
+    account := identities.Accounts[normalizeNick(string(nick))]
+    if account == nil {
+        return nil
+    }
+    copied := *account
+    return &copied
+}
+
+// sendMagicLink 生成一次性登录链接并发送到昵称绑定的邮箱。claim 为 true 时链接用于确认认领，
+// 账号在点击链接后才保存。链接地址只使用配置的站点地址，不信任请求的 Host
+func sendMagicLink(account *NickAccount, claim bool) error {
+    base := configuredBaseURL()
+    if base == "" {
+        return errors.New("未配置站点地址 feed.base_url")
+    }
+    mailer := serverConfig.Identity.Mailer
+    if mailer.Host == "" || mailer.From == "" {
+        return errors.New("未配置发信服务器")
+    }
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return err
+    }
+    token := base64.RawURLEncoding.EncodeToString(b)
+    sum := sha256.Sum256([]byte(token))
+    minutes := serverConfig.Identity.MagicLinkMinutes
+    identitiesMutex.Lock()
+    now := time.Now()
+    for k, link := range magicLinks {
+        if now.After(link.expires) {
+            delete(magicLinks, k)
+        }
+    }
+    // 只保存令牌的哈希，日志或内存泄露不会暴露可用的链接
+    pending := &magicLink{key: normalizeNick(account.Nick), expires: now.Add(time.Duration(minutes) * time.Minute)}
+    if claim {
+        copied := *account
+        pending.claim = &copied
+    }
+    magicLinks[hex.EncodeToString(sum[:])] = pending
+    identitiesMutex.Unlock()
+
+    link := base + "/api/identity/verify?token=" + token
+    purpose, subject := "登录", "登录链接"
+    if claim {
+        purpose, subject = "确认认领昵称并登录", "确认认领昵称"
+    }
+    text := fmt.Sprintf("你好 %s：\r\n\r\n点击下面的链接%s %s，链接 %d 分钟内有效，只能使用一次：\r\n%s\r\n\r\n如果不是你本人操作，请忽略这封邮件。\r\n",
+        account.Nick, purpose, serverConfig.SEO.SiteName, minutes, link)
+    subject = fmt.Sprintf("[%s] %s", serverConfig.SEO.SiteName, subject)
+    return sendMail(mailer, buildMailMessage(mailer.From, []string{account.Email}, subject, text))
+}
+
+// consumeMagicLink 校验并作废登录链接，首次使用时同时确认邮箱，认领确认链接在此时保存账号
+func consumeMagicLink(token string) *NickAccount {
+    if token == "" {
+        return nil
+    }
+    sum := sha256.Sum256([]byte(token))
+    identitiesMutex.Lock()
+    defer identitiesMutex.Unlock()
+    link := magicLinks[hex.EncodeToString(sum[:])]
+    delete(magicLinks, hex.EncodeToString(sum[:]))
+    if link == nil || time.Now().After(link.expires) {
+        return nil
+    }
+    account := identities.Accounts[link.key]
+    switch {
+    case link.claim != nil:
+        // 确认前昵称已被别人认领时链接作废
+        if account != nil {
+            return nil
+        }
+        account = link.claim
+        account.EmailVerified = true
+        identities.Accounts[link.key] = account
+        if err := saveIdentities(); err != nil {
+            log.Printf("⚠  保存昵称认证记录失败: %v", err)
+        }
+        log.Printf("🪪 昵称已通过邮箱认领: %s (站长: %v)", account.Nick, account.Owner)
+    case account == nil:
+        return nil
+    case !account.EmailVerified:
+        account.EmailVerified = true
+        if err := saveIdentities(); err != nil {
+            log.Printf("⚠  保存昵称认证记录失败: %v", err)
+        }
+    }
+    copied := *account
+    return &copied
+}
+
+// cityForPage 返回静态页面路径对应的城市
+func cityForPage(urlPath string) *CityInfo {
+    page := strings.TrimPrefix(urlPath, "/")
+    for i := range serverConfig.Cities {
+        if serverConfig.Cities[i].Page == page {
+            return &serverConfig.Cities[i]
+        }
+    }
+    return nil
+}
+
+// cityShareImage 返回城市的分享图片：配置的封面、相册第一张或默认图片
+func cityShareImage(city *CityInfo) string {
+    if city.Cover != "" {
+        return city.Cover
+    }
+    if city.ImageDir != "" {
+        galleriesMutex.RLock()
+        gallery := galleries[galleryCity(city.ImageDir)]
+        galleriesMutex.RUnlock()
+        if gallery != nil && len(gallery.Items) > 0 {
+            return strings.TrimPrefix(gallery.Items[0].URL, "/")
+        }
+    }
+    return serverConfig.SEO.DefaultImage
+}
+
+// cityMetaTags 生成 Open Graph 和 Twitter Card 元数据
+func cityMetaTags(base, pagePath, title, description, image string) string {
+    var b strings.Builder
+    tag := func(attr, name, content string) {
+        if content != "" {
+            fmt.Fprintf(&b, "<meta %s=\"%s\" content=\"%s\">\n", attr, name, html.EscapeString(content))
+        }
+    }
+    // 没有配置站点地址时无法生成完整地址，省略 canonical、og:url 和图片
+    pageURL := ""
+    if base != "" {
+        pageURL = base + pagePath
+    }
+    imageURL := ""
+    if image != "" && base != "" {
+        imageURL = base + "/img/" + strings.TrimPrefix(image, "/") + "?w=1200"
+    }
+    card := "summary"
+    if imageURL != "" {
+        card = "summary_large_image"
+    }
+    if pageURL != "" {
+        fmt.Fprintf(&b, "<link rel=\"canonical\" href=\"%s\">\n", html.EscapeString(pageURL))
+    }
+    tag("name", "description", description)
+    tag("property", "og:type", "article")
+    tag("property", "og:site_name", serverConfig.SEO.SiteName)
+    tag("property", "og:locale", "zh_CN")
+    tag("property", "og:title", title)
+    tag("property", "og:description", description)
+    tag("property", "og:url", pageURL)
+    tag("property", "og:image", imageURL)
+    tag("name", "twitter:card", card)
+    tag("name", "twitter:site", serverConfig.SEO.TwitterSite)
+    tag("name", "twitter:title", title)
+    tag("name", "twitter:description", description)
+    tag("name", "twitter:image", imageURL)
+    return b.String()
+}
+
+var headClosePattern = regexp.MustCompile(`(?i)</head>`)
+
+// injectHeadTags 把标签插入到第一个 </head> 之前
+func injectHeadTags(data []byte, tags string) []byte {
+    loc := headClosePattern.FindIndex(data)
+    if loc == nil {
+        return data
+    }
+    out := make([]byte, 0, len(data)+len(tags))
+    out = append(out, data[:loc[0]]...)
+    out = append(out, tags...)
+    return append(out, data[loc[0]:]...)
+}
+
+// sitemapURLs 列出首页、城市页面和有日记内容的渲染页面
+func sitemapURLs(root, base string) ([]sitemapURL, time.Time) {
+    var urls []sitemapURL
+    var newest time.Time
+    add := func(loc string, modTime time.Time, freq, priority string) {
+        u := sitemapURL{Loc: base + loc, ChangeFreq: freq, Priority: priority}
+        if !modTime.IsZero() {
+            u.LastMod = modTime.UTC().Format(time.RFC3339)
+            if modTime.After(newest) {
+                newest = modTime
+            }
+        }
+        urls = append(urls, u)
+    }
+    if info, err := os.Stat(filepath.Join(root, "homepage.html")); err == nil {
+        add("/homepage.html", info.ModTime(), "weekly", "1.0")
+    }
+    for _, city := range serverConfig.Cities {
+        if info, err := os.Stat(filepath.Join(root, city.Page)); err == nil {
+            add("/"+city.Page, info.ModTime(), "monthly", "0.8")
+        }
+    }
+    for _, city := range serverConfig.Cities {
+        var modTime time.Time
+        if info, err := os.Stat(filepath.Join(serverConfig.Render.DiaryDir, city.Abbr+".md")); err == nil {
+            modTime = info.ModTime()
+        }
+        for _, e := range publishedDiaryEntries(city.Abbr, "") {
+            if e.UpdatedAt.After(modTime) {
+                modTime = e.UpdatedAt
+            }
+        }
+        if !modTime.IsZero() {
+            add(serverConfig.Render.RoutePrefix+city.Abbr, modTime, "weekly", "0.7")
+        }
+    }
+    return urls, newest
+}
+
+// robotsTxt 按配置生成 robots.txt
+func robotsTxt(base string) string {
+    var b strings.Builder
+    for _, rule := range serverConfig.SEO.Robots {
+        agent := rule.UserAgent
+        if agent == "" {
+            agent = "*"
+        }
+        fmt.Fprintf(&b, "User-agent: %s\n", agent)
+        for _, p := range rule.Allow {
+            fmt.Fprintf(&b, "Allow: %s\n", p)
+        }
+        for _, p := range rule.Disallow {
+            fmt.Fprintf(&b, "Disallow: %s\n", p)
+        }
+        if rule.CrawlDelay > 0 {
+            fmt.Fprintf(&b, "Crawl-delay: %d\n", rule.CrawlDelay)
+        }
+        b.WriteString("\n")
+    }
+    for _, line := range serverConfig.SEO.RobotsExtra {
+        b.WriteString(line + "\n")
+    }
+    if base != "" {
+        fmt.Fprintf(&b, "Sitemap: %s/sitemap.xml\n", base)
+    }
+    return b.String()
+}
+
+// findDiaryEntry 按 ID 查找日记，调用方需持有 diariesMutex
+func findDiaryEntry(id int) *DiaryEntry {
+    for _, e := range diaries.Entries {
+        if e.ID == id {
+            return e
+        }
+    }
+    return nil
+}
+
+// publishedDiaryEntries 返回已发布日记的副本，可按城市和标签过滤
+func publishedDiaryEntries(city, tag string) []*DiaryEntry {
+    diariesMutex.RLock()
+    list := []*DiaryEntry{}
+    for _, e := range diaries.Entries {
+        if e.Status != "published" || (city != "" && e.City != city) {
+            continue
+        }
+        if tag != "" && !containsFold(e.Tags, tag) {
+            continue
+        }
+        copied := *e
+        list = append(list, &copied)
+    }
+    diariesMutex.RUnlock()
+    sortDiaryEntries(list)
+    return list
+}
+
+// sortDiaryEntries 按旅行开始日期倒序，没有日期的按创建时间
+func sortDiaryEntries(list []*DiaryEntry) {
+    sort.SliceStable(list, func(i, j int) bool {
+        a, b := list[i], list[j]
+        if a.StartDate != b.StartDate {
+            return a.StartDate > b.StartDate
+        }
+        return a.CreatedAt.After(b.CreatedAt)
+    })
+}
+
+// serveDiaryList 处理 /api/diaries：分页返回已发布的日记，可按城市和标签筛选
+func serveDiaryList(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    q := r.URL.Query()
+    city := q.Get("city")
+    if city != "" {
+        if _, ok := findCity(city); !ok {
+            writeError(w, r, http.StatusNotFound, "未知的城市")
+            return
+        }
+    }
+    page, perPage, ok := parsePagination(q)
+    if !ok {
+        writeError(w, r, http.StatusBadRequest, "无效的分页参数")
+        return
+    }
+    list := publishedDiaryEntries(city, q.Get("tag"))
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    json.NewEncoder(w).Encode(paginateDiaryEntries(list, page, perPage))
+}
+
+// serveDiary 处理 /api/diaries/{id}：草稿和不存在的日记一律返回 404
+func serveDiary(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+        return
+    }
+    id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/diaries/"))
+    if err != nil {
+        writeError(w, r, http.StatusNotFound, "日记不存在")
+        return
+    }
+    diariesMutex.RLock()
+    entry := findDiaryEntry(id)
+    var view map[string]interface{}
+    if entry != nil && entry.Status == "published" {
+        view = map[string]interface{}{
+            "entry":     entry,
+            "body_html": renderMarkdown(entry.Body, markdownOptions{AllowImages: true, AllowHeadings: true}),
+        }
+    }
+    diariesMutex.RUnlock()
+    if view == nil {
+        writeError(w, r, http.StatusNotFound, "日记不存在")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    json.NewEncoder(w).Encode(view)
+}
+
+// serveAdminDiaries 处理 /admin/diaries：列出全部日记（含草稿）或创建新日记
+func serveAdminDiaries(w http.ResponseWriter, r *http.Request) {
+    editor, ok := adminUser(r)
+    if !ok {
+        writeError(w, r, http.StatusUnauthorized, "未授权")
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        page, perPage, ok := parsePagination(r.URL.Query())
+        if !ok {
+            writeError(w, r, http.StatusBadRequest, "无效的分页参数")
+            return
+        }
+        diariesMutex.RLock()
+        list := make([]*DiaryEntry, 0, len(diaries.Entries))
+        for _, e := range diaries.Entries {
+            if city := r.URL.Query().Get("city"); city == "" || e.City == city {
+                copied := *e
+                list = append(list, &copied)
+            }
+        }
+        diariesMutex.RUnlock()
+        sortDiaryEntries(list)
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(paginateDiaryEntries(list, page, perPage))
+    case http.MethodPost:
+        input, ok := decodeDiaryInput(w, r)
+        if !ok {
+            return
+        }
+        diariesMutex.Lock()
+        defer diariesMutex.Unlock()
+        now := time.Now()
+        entry := &DiaryEntry{ID: diaries.NextID, Author: editor, CreatedAt: now}
+        applyDiaryInput(entry, input, editor, now)
+        diaries.NextID++
+        diaries.Entries = append(diaries.Entries, entry)
+        diaries.Revisions[entry.ID] = append(diaries.Revisions[entry.ID], DiaryRevision{Revision: entry.Revision, Editor: editor, Date: now, Entry: *entry})
+        if err := saveDiaryEntries(); err != nil {
+            log.Printf("⚠  保存日记记录失败: %v", err)
+            writeError(w, r, http.StatusInternalServerError, "保存失败")
+            return
+        }
+        log.Printf("📝 %s 创建了日记 #%d: %s", editor, entry.ID, entry.Title)
+        indexDiaryEntry(*entry)
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        w.Header().Set("Location", fmt.Sprintf("/admin/diaries/%d", entry.ID))
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(entry)
+    default:
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+    }
+}
+
+// serveAdminDiary 处理 /admin/diaries/{id} 的读取、修改、删除和 /revisions 历史版本
+func serveAdminDiary(w http.ResponseWriter, r *http.Request) {
+    editor, ok := adminUser(r)
+    if !ok {
+        writeError(w, r, http.StatusUnauthorized, "未授权")
+        return
+    }
+    rest := strings.TrimPrefix(r.URL.Path, "/admin/diaries/")
+    idPart, sub, _ := strings.Cut(rest, "/")
+    id, err := strconv.Atoi(idPart)
+    if err != nil || (sub != "" && sub != "revisions") {
+        writeError(w, r, http.StatusNotFound, "日记不存在")
+        return
+    }
+
+    if sub == "revisions" {
+        if r.Method != http.MethodGet {
+            writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+            return
+        }
+        diariesMutex.RLock()
+        revisions, exists := diaries.Revisions[id]
+        revisions = append([]DiaryRevision{}, revisions...)
+        diariesMutex.RUnlock()
+        if !exists {
+            writeError(w, r, http.StatusNotFound, "日记不存在")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(revisions)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        diariesMutex.RLock()
+        entry := findDiaryEntry(id)
+        var copied DiaryEntry
+        if entry != nil {
+            copied = *entry
+        }
+        diariesMutex.RUnlock()
+        if entry == nil {
+            writeError(w, r, http.StatusNotFound, "日记不存在")
+            return
+        }
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(copied)
+    case http.MethodPut:
+        input, ok := decodeDiaryInput(w, r)
+        if !ok {
+            return
+        }
+        diariesMutex.Lock()
+        defer diariesMutex.Unlock()
+        entry := findDiaryEntry(id)
+        if entry == nil {
+            writeError(w, r, http.StatusNotFound, "日记不存在")
+            return
+        }
+        now := time.Now()
+        applyDiaryInput(entry, input, editor, now)
+        diaries.Revisions[id] = append(diaries.Revisions[id], DiaryRevision{Revision: entry.Revision, Editor: editor, Date: now, Entry: *entry})
+        if err := saveDiaryEntries(); err != nil {
+            log.Printf("⚠  保存日记记录失败: %v", err)
+            writeError(w, r, http.StatusInternalServerError, "保存失败")
+            return
+        }
+        log.Printf("📝 %s 修改了日记 #%d (版本 %d)", editor, id, entry.Revision)
+        indexDiaryEntry(*entry)
+        w.Header().Set("Content-Type", "application/json; charset=utf-8")
+        json.NewEncoder(w).Encode(entry)
+    case http.MethodDelete:
+        diariesMutex.Lock()
+        defer diariesMutex.Unlock()
+        index := -1
+        for i, e := range diaries.Entries {
+            if e.ID == id {
+                index = i
+                break
+            }
+        }
+        if index < 0 {
+            writeError(w, r, http.StatusNotFound, "日记不存在")
+            return
+        }
+        // 删除条目但保留历史版本，便于误删后恢复
+        diaries.Entries = append(diaries.Entries[:index], diaries.Entries[index+1:]...)
+        if err := saveDiaryEntries(); err != nil {
+            log.Printf("⚠  保存日记记录失败: %v", err)
+            writeError(w, r, http.StatusInternalServerError, "保存失败")
+            return
+        }
+        log.Printf("🗑  %s 删除了日记 #%d", editor, id)
+        removeSearchDoc(fmt.Sprintf("entry:%d", id))
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        writeError(w, r, http.StatusMethodNotAllowed, "不支持的请求方法")
+    }
+}
+
+// parsePagination 解析 page 和 per_page 参数，默认第 1 页每页 10 条
+func parsePagination(q url.Values) (int, int, bool) {
+    page, perPage := 1, 10
+    if v := q.Get("page"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return 0, 0, false
+        }
+        page = n
+    }
+    if v := q.Get("per_page"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > 100 {
+            return 0, 0, false
+        }
+        perPage = n
+    }
+    return page, perPage, true
+}
+
+// paginateDiaryEntries 返回分页后的日记列表
+func paginateDiaryEntries(list []*DiaryEntry, page, perPage int) map[string]interface{} {
+    start := (page - 1) * perPage
+    if start > len(list) {
+        start = len(list)
+    }
+    end := start + perPage
+    if end > len(list) {
+        end = len(list)
+    }
+    return map[string]interface{}{
+        "entries":  list[start:end],
+        "page":     page,
+        "per_page": perPage,
+        "total":    len(list),
+    }
+}
+
+// decodeDiaryInput 解析并校验日记请求体，失败时已写入错误响应
+func decodeDiaryInput(w http.ResponseWriter, r *http.Request) (*diaryEntryInput, bool) {
+    var input diaryEntryInput
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+        var maxErr *http.MaxBytesError
+        if errors.As(err, &maxErr) {
+            writeError(w, r, http.StatusRequestEntityTooLarge, "请求体过大")
+            return nil, false
+        }
+        writeError(w, r, http.StatusBadRequest, "无效的请求体")
+        return nil, false
+    }
+    input.Title = strings.TrimSpace(input.Title)
+    if _, ok := findCity(input.City); !ok {
+        writeError(w, r, http.StatusBadRequest, "未知的城市")
+        return nil, false
+    }
+    if input.Title == "" {
+        writeError(w, r, http.StatusBadRequest, "标题不能为空")
+        return nil, false
+    }
+    for _, d := range []string{input.StartDate, input.EndDate} {
+        if d == "" {
+            continue
+        }
+        if _, err := time.Parse("2006-01-02", d); err != nil {
+            writeError(w, r, http.StatusBadRequest, "日期格式应为 YYYY-MM-DD")
+            return nil, false
+        }
+    }
+    if input.StartDate != "" && input.EndDate != "" && input.EndDate < input.StartDate {
+        writeError(w, r, http.StatusBadRequest, "结束日期不能早于开始日期")
+        return nil, false
+    }
+    switch input.Status {
+    case "":
+        input.Status = "draft"
+    case "draft", "published":
+    default:
+        writeError(w, r, http.StatusBadRequest, "状态只能是 draft 或 published")
+        return nil, false
+    }
+    tags := []string{}
+    for _, t := range input.Tags {
+        if t = strings.TrimSpace(t); t != "" && !containsFold(tags, t) {
+            tags = append(tags, t)
+        }
+    }
+    input.Tags = tags
+    return &input, true
+}
+
+// applyDiaryInput 用请求内容更新日记并递增版本号
+func applyDiaryInput(entry *DiaryEntry, input *diaryEntryInput, editor string, now time.Time) {
+    entry.City = input.City
+    entry.Title = input.Title
+    entry.Body = input.Body
+    entry.StartDate = input.StartDate
+    entry.EndDate = input.EndDate
+    entry.Cover = strings.TrimPrefix(input.Cover, "/")
+    entry.Tags = input.Tags
+    entry.Status = input.Status
+    entry.Revision++
+    entry.UpdatedAt = now
+}
+
+// loadCityLayout 加载自定义城市页面布局，失败时使用内置布局
+func loadCityLayout() {
+    file := serverConfig.Render.LayoutFile
+    if file == "" {
+        return
+    }
+    tmpl, err := template.ParseFiles(file)
+    if err != nil {
+        log.Printf("⚠  加载城市页面布局失败，使用内置布局: %v", err)
+        return
+    }
+    cityPageTemplate = tmpl
+    log.Printf("📄 已加载城市页面布局: %s", file)
+}
+
+// readDiary 读取城市的 Markdown 日记，文件不存在时返回空内容
+func readDiary(abbr string) (DiaryFrontMatter, string, time.Time, error) {
+    var meta DiaryFrontMatter
+    filePath := filepath.Join(serverConfig.Render.DiaryDir, abbr+".md")
+    info, err := os.Stat(filePath)
+    if os.IsNotExist(err) {
+        return meta, "", time.Time{}, nil
+    }
+    if err != nil {
+        return meta, "", time.Time{}, err
+    }
+    data, err := os.ReadFile(filePath)
+    if err != nil {
+        return meta, "", time.Time{}, err
+    }
+    fields, body := parseFrontMatter(string(data))
+    meta = DiaryFrontMatter{
+        Title:   fields["title"],
+        Start:   fields["start"],
+        End:     fields["end"],
+        Gallery: fields["gallery"],
+        Music:   fields["music"],
+        Cover:   fields["cover"],
+    }
+    return meta, body, info.ModTime(), nil
+}
+
+// parseFrontMatter 解析 --- 包围的 key: value 头部，返回字段和正文
+func parseFrontMatter(src string) (map[string]string, string) {
+    fields := make(map[string]string)
+    src = strings.TrimPrefix(strings.ReplaceAll(src, "\r\n", "\n"), "\ufeff")
+    if !strings.HasPrefix(src, "---\n") {
+        return fields, src
+    }
+    end := strings.Index(src[4:], "\n---")
+    if end < 0 {
+        return fields, src
+    }
+    for _, line := range strings.Split(src[4:4+end], "\n") {
+        key, value, ok := strings.Cut(line, ":")
+        if !ok {
+            continue
+        }
+        value = strings.Trim(strings.TrimSpace(value), `"'`)
+        fields[strings.ToLower(strings.TrimSpace(key))] = value
+    }
+    body := src[4+end+4:]
+    return fields, strings.TrimPrefix(body, "\n")
+}
+
+// cityPage 返回渲染好的城市页面，日记、布局和相册没有变化时使用缓存。
+// 分享卡片中的完整地址只取自配置，不使用请求的 Host。
+func cityPage(abbr string) (*renderedPage, error) {
+    city, _ := findCity(abbr)
+    base := configuredBaseURL()
+    meta, body, diaryMod, err := readDiary(abbr)
+    if err != nil {
+        return nil, err
+    }
+    galleryDir := city.ImageDir
+    if meta.Gallery != "" {
+        galleryDir = meta.Gallery
+    }
+    galleriesMutex.RLock()
+    gallery := galleries[galleryCity(galleryDir)]
+    galleriesMutex.RUnlock()
+    galleryVersion := ""
+    if gallery != nil {
+        galleryVersion = gallery.Version
+    }
+    layoutMod := time.Time{}
+    if serverConfig.Render.LayoutFile != "" {
+        if info, err := os.Stat(serverConfig.Render.LayoutFile); err == nil {
+            layoutMod = info.ModTime()
+        }
+    }
+    entries := publishedDiaryEntries(abbr, "")
+    entriesVersion := time.Time{}
+    for _, e := range entries {
+        if e.UpdatedAt.After(entriesVersion) {
+            entriesVersion = e.UpdatedAt
+        }
+    }
+    sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d|%d|%s|%d|%d", abbr, base, serverConfig.Render.RoutePrefix, diaryMod.UnixNano(), layoutMod.UnixNano(), galleryVersion, len(entries), entriesVersion.UnixNano())))
+    key := hex.EncodeToString(sum[:8])
+
+    renderedPagesMutex.RLock()
+    cached, ok := renderedPages[abbr]
+    renderedPagesMutex.RUnlock()
+    if ok && cached.key == key {
+        return cached, nil
+    }
+
+    data := cityPageData{
+        City:        *city,
+        Cities:      serverConfig.Cities,
+        RoutePrefix: serverConfig.Render.RoutePrefix,
+        Title:       meta.Title,
+        Start:       meta.Start,
+        End:         meta.End,
+        Cover:       meta.Cover,
+        Diary:       template.HTML(renderMarkdown(body, markdownOptions{AllowImages: true, AllowHeadings: true})),
+        MusicURL:    "/music/" + abbr + "/1",
+        AMapKey:     serverConfig.Render.AMapKey,
+        Feeds:       base != "",
+    }
+    if data.Title == "" {
+        data.Title = city.Name + "之旅"
+    }
+    if meta.Music != "" {
+        data.MusicURL = "/" + serverConfig.Music.Dir + "/" + meta.Music
+    }
+    if gallery != nil {
+        data.Gallery = gallery.Items
+    }
+    if serverConfig.SEO.OpenGraph {
+        image := meta.Cover
+        if image == "" {
+            image = cityShareImage(city)
+        }
+        description := ""
+        if m := htmlParaPattern.FindStringSubmatch(string(data.Diary)); m != nil {
+            description = plainText(m[1])
+        }
+        if runes := []rune(description); len(runes) > 200 {
+            description = string(runes[:200]) + "…"
+        }
+        data.Meta = template.HTML(cityMetaTags(base, serverConfig.Render.RoutePrefix+abbr, data.Title, description, image))
+    }
+    for _, e := range entries {
+        data.Entries = append(data.Entries, diaryEntryView{DiaryEntry: e, HTML: template.HTML(renderMarkdown(e.Body, markdownOptions{AllowImages: true, AllowHeadings: true}))})
+    }
+    if entriesVersion.After(diaryMod) {
+        diaryMod = entriesVersion
+    }
+    var buf bytes.Buffer
+    if err := cityPageTemplate.Execute(&buf, data); err != nil {
+        return nil, err
+    }
+    modTime := diaryMod
+    if layoutMod.After(modTime) {
+        modTime = layoutMod
+    }
+    page := &renderedPage{html: buf.Bytes(), key: key, modTime: modTime}
+    renderedPagesMutex.Lock()
+    renderedPages[abbr] = page
+    renderedPagesMutex.Unlock()
+    log.Printf("📝 已渲染城市页面: %s", abbr)
+    return page, nil
+}
+
+// renderAllCityPages 预生成所有城市页面到 outDir/{城市缩写}.html
+func renderAllCityPages(outDir string) error {
+    if err := os.MkdirAll(outDir, 0755); err != nil {
+        return err
+    }
+    for _, city := range serverConfig.Cities {
+        page, err := cityPage(city.Abbr)
+        if err != nil {
+            return fmt.Errorf("%s: %w", city.Abbr, err)
+        }
+        out := filepath.Join(outDir, city.Abbr+".html")
+        if err := os.WriteFile(out, page.html, 0644); err != nil {
+            return err
+        }
+        log.Printf("✅ 已生成 %s", out)
+    }
+    return nil
+}
+
+var (
+    mdHeadingPattern = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+    mdOrderedPattern = regexp.MustCompile(`^\d+[.)]\s+(.*)$`)
+    mdImagePattern   = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+    mdLinkPattern    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+    mdBoldPattern    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+    mdItalicPattern  = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+    mdCodePattern    = regexp.MustCompile("`([^`]+)`")
+)
+
+// renderMarkdown 将 Markdown 子集渲染为 HTML。所有文本先做 HTML 转义，
+// 链接只允许 http/https/mailto 和站内相对地址，因此输出可以直接嵌入页面。
+func renderMarkdown(src string, opts markdownOptions) string {
+    // 行内语法使用 \x00 包裹的占位符，输入中的 NUL 必须先去掉，否则可以伪造占位符
+    src = strings.ReplaceAll(src, "\x00", "")
+    var out strings.Builder
+    var paragraph []string
+    listTag := ""
+    inCode := false
+    var code []string
+
+    flushParagraph := func() {
+        if len(paragraph) > 0 {
+            out.WriteString("<p>" + strings.Join(paragraph, "<br>\n") + "</p>\n")
+            paragraph = nil
+        }
+    }
+    closeList := func() {
+        if listTag != "" {
+            out.WriteString("</" + listTag + ">\n")
+            listTag = ""
+        }
+    }
+    openList := func(tag string) {
+        if listTag != tag {
+            closeList()
+            out.WriteString("<" + tag + ">\n")
+            listTag = tag
+        }
+    }
+
+    for _, line := range strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n") {
+        trimmed := strings.TrimSpace(line)
+        if strings.HasPrefix(trimmed, "```") {
+            if inCode {
+                out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+                code = nil
+                inCode = false
+            } else {
+                flushParagraph()
+                closeList()
+                inCode = true
+            }
+            continue
+        }
+        if inCode {
+            code = append(code, line)
+            continue
+        }
+        switch {
+        case trimmed == "":
+            flushParagraph()
+            closeList()
+        case trimmed == "---" || trimmed == "***":
+            flushParagraph()
+            closeList()
+            out.WriteString("<hr>\n")
+        case opts.AllowHeadings && mdHeadingPattern.MatchString(trimmed):
+            flushParagraph()
+            closeList()
+            m := mdHeadingPattern.FindStringSubmatch(trimmed)
+            level := strconv.Itoa(len(m[1]))
+            out.WriteString("<h" + level + ">" + renderInlineMarkdown(m[2], opts) + "</h" + level + ">\n")
+        case strings.HasPrefix(trimmed, "> ") || trimmed == ">":
+            flushParagraph()
+            closeList()
+            out.WriteString("<blockquote>" + renderInlineMarkdown(strings.TrimSpace(strings.TrimPrefix(trimmed, ">")), opts) + "</blockquote>\n")
+        case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "+ "):
+            flushParagraph()
+            openList("ul")
+            out.WriteString("<li>" + renderInlineMarkdown(strings.TrimSpace(trimmed[2:]), opts) + "</li>\n")
+        case mdOrderedPattern.MatchString(trimmed):
+            flushParagraph()
+            openList("ol")
+            out.WriteString("<li>" + renderInlineMarkdown(mdOrderedPattern.FindStringSubmatch(trimmed)[1], opts) + "</li>\n")
+        default:
+            closeList()
+            paragraph = append(paragraph, renderInlineMarkdown(trimmed, opts))
+        }
+    }
+    if inCode {
+        out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+    }
+    flushParagraph()
+    closeList()
+    return out.String()
+}
+
+// renderInlineMarkdown 处理行内语法：代码、图片、链接、粗体和斜体
+func renderInlineMarkdown(text string, opts markdownOptions) string {
+    // 行内代码、链接和图片先替换为占位符，避免其中的内容（包括地址）被继续解析
+    var tokens []string
+    placeholder := func(s string) string {
+        tokens = append(tokens, s)
+        return "\x00" + strconv.Itoa(len(tokens)-1) + "\x00"
+    }
+    text = mdCodePattern.ReplaceAllStringFunc(text, func(m string) string {
+        return placeholder("<code>" + html.EscapeString(m[1:len(m)-1]) + "</code>")
+    })
+    text = html.EscapeString(text)
+
+    text = mdImagePattern.ReplaceAllStringFunc(text, func(m string) string {
+        parts := mdImagePattern.FindStringSubmatch(m)
+        if !opts.AllowImages || !safeMarkdownURL(html.UnescapeString(parts[2])) {
+            return parts[1]
+        }
+        return placeholder(`<img src="` + parts[2] + `" alt="` + parts[1] + `" loading="lazy">`)
+    })
+    text = mdLinkPattern.ReplaceAllStringFunc(text, func(m string) string {
+        parts := mdLinkPattern.FindStringSubmatch(m)
+        if !safeMarkdownURL(html.UnescapeString(parts[2])) {
+            return parts[1]
+        }
+        rel := ""
+        if opts.LinkRel != "" {
+            rel = ` rel="` + opts.LinkRel + `"`
+        }
+        return placeholder(`<a href="` + parts[2] + `"` + rel + `>` + renderEmphasis(parts[1], opts) + `</a>`)
+    })
+    text = renderEmphasis(text, opts)
+
+    for i, t := range tokens {
+        text = strings.Replace(text, "\x00"+strconv.Itoa(i)+"\x00", t, 1)
+    }
+    return text
+}
+
+// renderEmphasis 处理粗体、斜体和 emoji 短代码，输入必须已经转义
+func renderEmphasis(text string, opts markdownOptions) string {
+    text = mdBoldPattern.ReplaceAllString(text, "<strong>$1$2</strong>")
+    text = mdItalicPattern.ReplaceAllString(text, "<em>$1$2</em>")
+    if opts.Emoji {
+        text = emojiShortcodePattern.ReplaceAllStringFunc(text, func(m string) string {
+            if emoji, ok := emojiShortcodes[m[1:len(m)-1]]; ok {
+                return emoji
+            }
+            return m
+        })
+    }
+    return text
+}
+
+var emojiShortcodePattern = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// emojiShortcodes 留言支持的 emoji 短代码
+var emojiShortcodes = map[string]string{
+    "smile": "😄", "grin": "😁", "joy": "😂", "laughing": "😆", "sweat_smile": "😅", "wink": "😉",
+    "blush": "😊", "heart_eyes": "😍", "sunglasses": "😎", "thinking": "🤔", "cry": "😢", "sob": "😭",
+    "angry": "😠", "scream": "😱", "yum": "😋", "sleepy": "😪", "heart": "❤️", "broken_heart": "💔",
+    "+1": "👍", "thumbsup": "👍", "-1": "👎", "thumbsdown": "👎", "ok_hand": "👌", "clap": "👏",
+    "pray": "🙏", "wave": "👋", "muscle": "💪", "fire": "🔥", "star": "⭐", "sparkles": "✨",
+    "100": "💯", "tada": "🎉", "rocket": "🚀", "airplane": "✈️", "train": "🚆", "car": "🚗",
+    "camera": "📷", "sunny": "☀️", "cloud": "☁️", "umbrella": "☔", "snowflake": "❄️", "rainbow": "🌈",
+    "mountain": "⛰️", "beach": "🏖️", "ocean": "🌊", "palm_tree": "🌴", "cherry_blossom": "🌸", "moon": "🌙",
+    "coffee": "☕", "tea": "🍵", "ramen": "🍜", "rice": "🍚", "dumpling": "🥟", "beer": "🍺",
+    "map": "🗺️", "world_map": "🗺️", "luggage": "🧳", "ticket": "🎫", "house": "🏠", "cn": "🇨🇳",
+}
+
+// commentMarkdownOptions 留言允许的 Markdown 子集：不支持标题和图片，链接加 nofollow
+var commentMarkdownOptions = markdownOptions{LinkRel: "nofollow ugc noopener noreferrer", Emoji: true}
+
+// renderCommentHTML 将留言渲染为 HTML，并再经过白名单净化
+func renderCommentHTML(text string) string {
+    return sanitizeHTML(renderMarkdown(text, commentMarkdownOptions))
+}
+
+var (
+    sanitizeTagPattern  = regexp.MustCompile(`<[^<>]*>`)
+    sanitizeNamePattern = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)\s*(.*?)\s*(/?)>$`)
+    sanitizeAttrPattern = regexp.MustCompile(`^([a-zA-Z-]+)="([^"<>]*)"\s*`)
+)
+
+// sanitizeAllowedTags 净化器允许的标签和各自允许的属性
+var sanitizeAllowedTags = map[string][]string{
+    "p": nil, "br": nil, "hr": nil, "strong": nil, "em": nil, "code": nil, "pre": nil,
+    "ul": nil, "ol": nil, "li": nil, "blockquote": nil, "a": {"href", "rel"},
+}
+
+// sanitizeHTML 白名单净化：只保留允许的标签和属性，链接地址重新校验协议并强制加 rel，
+// 其余标签及无法解析的内容一律转义为文本
+func sanitizeHTML(src string) string {
+    var b strings.Builder
+    last := 0
+    for _, loc := range sanitizeTagPattern.FindAllStringIndex(src, -1) {
+        b.WriteString(sanitizeText(src[last:loc[0]]))
+        b.WriteString(sanitizeTag(src[loc[0]:loc[1]]))
+        last = loc[1]
+    }
+    b.WriteString(sanitizeText(src[last:]))
+    return b.String()
+}
+
+// sanitizeText 文本中不应出现的尖括号和引号重新转义，已有的字符实体保持不变
+func sanitizeText(text string) string {
+    return strings.NewReplacer("<", "&lt;", ">", "&gt;", `"`, "&#34;").Replace(text)
+}
+
+func sanitizeTag(tag string) string {
+    m := sanitizeNamePattern.FindStringSubmatch(tag)
+    if m == nil {
+        return html.EscapeString(tag)
+    }
+    closing, name, rest := m[1] == "/", strings.ToLower(m[2]), m[3]
+    allowedAttrs, ok := sanitizeAllowedTags[name]
+    if !ok {
+        return html.EscapeString(tag)
+    }
+    if closing {
+        if rest != "" {
+            return html.EscapeString(tag)
+        }
+        return "</" + name + ">"
+    }
+    var out strings.Builder
+    out.WriteString("<" + name)
+    href := ""
+    for rest != "" {
+        attr := sanitizeAttrPattern.FindStringSubmatch(rest)
+        if attr == nil {
+            return html.EscapeString(tag)
+        }
+        rest = rest[len(attr[0]):]
+        key := strings.ToLower(attr[1])
+        if !containsFold(allowedAttrs, key) || key == "rel" {
+            continue
+        }
+        if key == "href" {
+            href = attr[2]
+            if !safeMarkdownURL(html.UnescapeString(href)) {
+                return html.EscapeString(tag)
+            }
+        }
+        out.WriteString(" " + key + `="` + attr[2] + `"`)
+    }
+    if name == "a" {
+        if href == "" {
+            return html.EscapeString(tag)
+        }
+        out.WriteString(` rel="` + commentMarkdownOptions.LinkRel + `"`)
+    }
+    out.WriteString(">")
+    return out.String()
+}
+
+// safeMarkdownURL 只允许 http/https/mailto 和不带协议的站内地址
+func safeMarkdownURL(raw string) bool {
+    u := strings.ToLower(strings.TrimSpace(raw))
+    if u == "" || strings.ContainsAny(u, "\x00\t\n\r") {
+        return false
+    }
+    if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "mailto:") {
+        return true
+    }
+    if strings.HasPrefix(u, "//") {
+        return false
+    }
+    colon := strings.Index(u, ":")
+    return colon < 0 || strings.IndexAny(u[:colon], "/?#") >= 0
+}
+
+const defaultCityLayout = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Title}} - MyTravelDiary</title>
+    {{.Meta}}
+    {{if .Feeds}}<link rel="alternate" type="application/rss+xml" title="MyTravelDiary" href="/feed.xml">
+    <link rel="alternate" type="application/rss+xml" title="{{.City.Name}}的留言" href="/comments/{{.City.Abbr}}/feed.xml">{{end}}
+    <style>
+        body { margin: 0; font-family: '微软雅黑', Arial, sans-serif; background: #fffdf5; color: #333; }
+        header { background: #fff; border-bottom: 2px solid #ffd600; padding: 12px 24px; display: flex; align-items: center; gap: 24px; flex-wrap: wrap; }
+        header h1 { margin: 0; font-size: 1.5em; }
+        header .dates { color: #888; }
+        nav a { margin-right: 12px; color: #0066cc; text-decoration: none; }
+        nav a.current { font-weight: bold; color: #333; }
+        #amap-container { width: 100%; height: 300px; background: #f0f0f0; }
+        main { max-width: 960px; margin: 0 auto; padding: 24px; }
+        section { background: #fff; border: 2px solid #ffd600; border-radius: 10px; padding: 16px 24px; margin-bottom: 24px; box-shadow: 0 2px 8px rgba(0,0,0,0.06); }
+        .cover { width: 100%; border-radius: 10px; margin-bottom: 16px; }
+        .diary img { max-width: 100%; border-radius: 8px; }
+        .gallery { display: flex; flex-wrap: wrap; gap: 10px; }
+        .gallery figure { margin: 0; width: 180px; }
+        .gallery img { width: 180px; height: 135px; object-fit: cover; border-radius: 8px; }
+        .gallery figcaption { font-size: 0.85em; color: #666; }
+        .message { border-bottom: 1px solid #eee; padding: 8px 0; }
+        .message .nick { font-weight: bold; }
+        .message .date { color: #999; font-size: 0.85em; margin-left: 8px; }
+        .message .badge { color: #fff; background: #4caf50; border-radius: 4px; font-size: 0.75em; padding: 1px 5px; margin-left: 6px; }
+        .message .images img { max-height: 120px; margin: 6px 6px 0 0; border-radius: 4px; }
+        .message-form input, .message-form textarea { width: 100%; box-sizing: border-box; margin-bottom: 8px; padding: 6px; }
+        .message-form button { background: #ffd600; border: none; border-radius: 6px; padding: 8px 20px; cursor: pointer; }
+    </style>
+</head>
+<body>
+    <audio id="bgm" src="{{.MusicURL}}" autoplay loop style="display:none"></audio>
+    <header>
+        <h1>{{.Title}}</h1>
+        {{if .Start}}<span class="dates">{{.Start}}{{if .End}} ~ {{.End}}{{end}}</span>{{end}}
+        <nav>
+            <a href="/homepage.html">首页</a>
+            {{range .Cities}}<a href="{{$.RoutePrefix}}{{.Abbr}}"{{if eq .Abbr $.City.Abbr}} class="current"{{end}}>{{.Name}}</a>{{end}}
+        </nav>
+    </header>
+    <div id="amap-container"></div>
+    <main>
+        <section class="diary">
+            {{if .Cover}}<img class="cover" src="/img/{{.Cover}}?w=1280" alt="{{.Title}}">{{end}}
+            {{if .Diary}}{{.Diary}}{{else if not .Entries}}<p>这里是日志内容</p>{{end}}
+        </section>
+        {{range .Entries}}
+        <section class="diary">
+            <h2>{{.Title}}</h2>
+            {{if .StartDate}}<p class="dates">{{.StartDate}}{{if .EndDate}} ~ {{.EndDate}}{{end}}</p>{{end}}
+            {{if .Cover}}<img class="cover" src="/img/{{.Cover}}?w=1280" alt="{{.Title}}">{{end}}
+            {{.HTML}}
+        </section>
+        {{end}}
+        {{if .Gallery}}
+        <section>
+            <h2>相册</h2>
+            <div class="gallery">
+                {{range .Gallery}}
+                <figure>
+                    <a href="{{.URL}}" target="_blank"><img src="{{.Thumb}}" alt="{{.Caption}}" loading="lazy"></a>
+                    {{if .Caption}}<figcaption>{{.Caption}}</figcaption>{{end}}
+                </figure>
+                {{end}}
+            </div>
+        </section>
+        {{end}}
+        <section>
+            <h2>留言板</h2>
+            <div id="message-list"></div>
+            <form class="message-form" id="message-form">
+                <input id="nickname" maxlength="20" placeholder="昵称" required>
+                <textarea id="message-text" rows="3" maxlength="500" placeholder="说点什么吧..." required></textarea>
+                <input id="message-images" type="file" accept="image/jpeg,image/png" multiple>
+                <button type="submit">提交留言</button>
+            </form>
+        </section>
+    </main>
+    <script src="/challenge.js"></script>
+    <script>
+      document.addEventListener('click', function playMusicOnce() {
+        var audio = document.getElementById('bgm');
+        if (audio.paused) audio.play();
+        document.removeEventListener('click', playMusicOnce);
+      });
+      var cityAbbr = {{.City.Abbr}};
+      async function loadMessageList() {
+        var listEl = document.getElementById('message-list');
+        try {
+          var response = await fetch('/comments/' + cityAbbr);
+          if (!response.ok) throw new Error('HTTP ' + response.status);
+          var list = await response.json();
+          listEl.textContent = '';
+          if (list.length === 0) {
+            listEl.textContent = '还没有留言，快来抢沙发吧！';
+            return;
+          }
+          list.forEach(function(item) {
+            var div = document.createElement('div');
+            div.className = 'message';
+            var nick = document.createElement('span');
+            nick.className = 'nick';
+            nick.textContent = item.nick;
+            if (item.owner || item.verified) {
+              var badge = document.createElement('span');
+              badge.className = 'badge';
+              badge.textContent = item.owner ? '✔ 作者' : '✔';
+              badge.title = item.owner ? '站长本人' : '已认证昵称';
+              nick.appendChild(badge);
+            }
+            var date = document.createElement('span');
+            date.className = 'date';
+            date.textContent = new Date(item.date).toLocaleString();
+            // html 字段由服务器渲染并经过白名单净化
+            var text = document.createElement('div');
+            if (item.html) {
+              text.innerHTML = item.html;
+            } else {
+              text.textContent = item.text;
+            }
+            div.appendChild(nick);
+            div.appendChild(date);
+            div.appendChild(text);
+            if (item.images && item.images.length) {
+              var images = document.createElement('div');
+              images.className = 'images';
+              item.images.forEach(function(image) {
+                var link = document.createElement('a');
+                link.href = image.url;
+                link.target = '_blank';
+                var img = document.createElement('img');
+                img.src = image.thumb;
+                img.loading = 'lazy';
+                img.alt = item.nick;
+                link.appendChild(img);
+                images.appendChild(link);
+              });
+              div.appendChild(images);
+            }
+            listEl.appendChild(div);
+          });
+        } catch (error) {
+          listEl.textContent = '留言加载失败，请稍后再试';
+        }
+      }
+      document.getElementById('message-form').addEventListener('submit', async function(e) {
+        e.preventDefault();
+        var nick = document.getElementById('nickname').value.trim();
+        var text = document.getElementById('message-text').value.trim();
+        var fileInput = document.getElementById('message-images');
+        if (!nick || !text) return;
+        var proof;
+        try {
+          proof = await solveCommentChallenge();
+        } catch (error) {
+          alert('人机验证失败，请稍后再试');
+          return;
+        }
+        var request = {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ nick: nick, text: text, challenge: proof.challenge, nonce: proof.nonce })
+        };
+        // 带图片时改用 multipart 提交
+        if (fileInput.files.length > 0) {
+          var form = new FormData();
+          form.append('nick', nick);
+          form.append('text', text);
+          form.append('challenge', proof.challenge);
+          form.append('nonce', proof.nonce);
+          Array.prototype.forEach.call(fileInput.files, function(file) {
+            form.append('images', file);
+          });
+          request = { method: 'POST', body: form };
+        }
+        var response = await fetch('/comments/' + cityAbbr, request);
+        if (response.ok) {
+          document.getElementById('message-text').value = '';
+          fileInput.value = '';
+          if (response.status === 202) {
+            alert('留言已提交，图片审核通过后显示');
+          }
+          loadMessageList();
+        } else {
+          alert('留言提交失败，请稍后再试');
+        }
+      });
+      loadMessageList();
+    </script>
+    <script src="https://webapi.amap.com/maps?v=2.0&key={{.AMapKey}}"></script>
+    <script>
+      try {
+        new AMap.Map('amap-container', { center: [{{.City.Lon}}, {{.City.Lat}}], zoom: 11, viewMode: '2D' });
+      } catch (error) {
+        document.getElementById('amap-container').textContent = '地图加载失败';
+      }
+    </script>
+</body>
+</html>`
 
-        filePath := filepath.Join(staticDir, r.URL.Path)
-
-        if _, err := os.Stat(filePath); os.IsNotExist(err) {
-            log.Printf("文件不存在: %s (请求路径: %s) - IP: %s", filePath, r.URL.Path, clientIP)
-            w.WriteHeader(http.StatusNotFound)
-            w.Header().Set("Content-Type", "text/html; charset=utf-8")
-            w.Write([]byte(fmt.Sprintf(`
-<!DOCTYPE html>
-<html lang="zh-CN">
+const defaultErrorTemplate = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
 <head>
     <meta charset="UTF-8">
-    <title>页面未找到 - MyTravelDiary</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Title}} - MyTravelDiary</title>
     <style>
-        body { 
-            font-family: Arial, sans-serif; 
-            text-align: center; 
-            margin-top: 100px; 
-            background: #f5f5f5; 
+        body {
+            font-family: Arial, sans-serif;
+            text-align: center;
+            margin-top: 100px;
+            background: #f5f5f5;
         }
         .error-container {
             background: white;
@@ -142,11 +7611,12 @@ func main() {
         }
         h1 { color: #e74c3c; }
         p { color: #666; line-height: 1.6; }
-        a { 
-            background: #3498db; 
-            color: white; 
-            padding: 10px 20px; 
-            text-decoration: none; 
+        .status { color: #bbb; font-size: 48px; margin: 0; }
+        a {
+            background: #3498db;
+            color: white;
+            padding: 10px 20px;
+            text-decoration: none;
             border-radius: 4px;
             display: inline-block;
             margin-top: 20px;
@@ -156,344 +7626,165 @@ func main() {
 </head>
 <body>
     <div class="error-container">
-        <h1>🚀 页面未找到</h1>
-        <p>抱歉，您访问的页面 <strong>%s</strong> 不存在。</p>
-        <p>可能是页面正在建设中，或者链接有误。</p>
-        <a href="/homepage.html">返回首页</a>
+        <p class="status">{{.Status}}</p>
+        <h1>{{if eq .Status 404}}🚀 {{end}}{{.Title}}</h1>
+        {{if .Path}}<p><strong>{{.Path}}</strong></p>{{end}}
+        <p>{{.Message}}</p>
+        {{if .Detail}}<p>{{.Detail}}</p>{{end}}
+        <a href="/homepage.html">{{.HomeText}}</a>
     </div>
 </body>
-</html>`, r.URL.Path)))
-            return
-        }
-
-        setContentType(w, r.URL.Path)
-        setSecurityHeaders(w)
-
-        if strings.HasSuffix(r.URL.Path, ".html") {
-            w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-        } else {
-            w.Header().Set("Cache-Control", "public, max-age=3600")
-        }
-
-        log.Printf("成功服务文件: %s - IP: %s", filePath, clientIP)
-        fs.ServeHTTP(w, r)
-    })
-
-    http.HandleFunc("/comments/", func(w http.ResponseWriter, r *http.Request) {
-        // 添加 CORS 头
-        w.Header().Set("Access-Control-Allow-Origin", "http://1.95.203.92:9099")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-        // 处理 OPTIONS 预检请求
-        if r.Method == http.MethodOptions {
-            w.WriteHeader(http.StatusOK)
-            return
-        }
-
-        city := strings.TrimPrefix(r.URL.Path, "/comments/")
-        if city == "" {
-            http.Error(w, "无效的城市标识", http.StatusBadRequest)
-            return
-        }
-
-        switch r.Method {
-        case http.MethodGet:
-            commentsMutex.RLock()
-            defer commentsMutex.RUnlock()
-            w.Header().Set("Content-Type", "application/json; charset=utf-8")
-            json.NewEncoder(w).Encode(comments[city])
-        case http.MethodPost:
-            var newComment struct {
-                Nick string `json:"nick"`
-                Text string `json:"text"`
-            }
-            if err := json.NewDecoder(r.Body).Decode(&newComment); err != nil {
-                http.Error(w, "无效的请求体", http.StatusBadRequest)
-                return
-            }
-            if newComment.Nick == "" || newComment.Text == "" {
-                http.Error(w, "昵称和内容不能为空", http.StatusBadRequest)
-                return
-            }
-            commentsMutex.Lock()
-            defer commentsMutex.Unlock()
-            commentList := comments[city]
-            newID := 1
-            if len(commentList) > 0 {
-                newID = commentList[len(commentList)-1].ID + 1
-            }
-            comment := Comment{
-                ID:    newID,
-                Nick:  newComment.Nick,
-                Text:  newComment.Text,
-                Date:  time.Now(),
-            }
-            comments[city] = append(commentList, comment)
-            w.Header().Set("Content-Type", "application/json; charset=utf-8")
-            json.NewEncoder(w).Encode(comment)
-        default:
-            http.Error(w, "不支持的请求方法", http.StatusMethodNotAllowed)
-        }
-    })
-
-    http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Content-Type", "application/json")
-        w.Write([]byte(`{"status":"ok","service":"MyTravelDiary"}`))
-    })
-
-    http.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
-        if r.Header.Get("X-Admin-Token") != "UbuntuMyTravelDiaryXJWcnm114514!!@" {
-            http.Error(w, "未授权", http.StatusUnauthorized)
-            return
-        }
-        recordsMutex.RLock()
-        defer recordsMutex.RUnlock()
-        w.Header().Set("Content-Type", "application/json; charset=utf-8")
-        json.NewEncoder(w).Encode(accessRecords)
-    })
-
-    http.HandleFunc("/admin/export", func(w http.ResponseWriter, r *http.Request) {
-        if r.Header.Get("X-Admin-Token") != "UbuntuMyTravelDiaryXJWcnm114514!!@" {
-            http.Error(w, "未授权", http.StatusUnauthorized)
-            return
-        }
-        w.Header().Set("Content-Type", "application/octet-stream")
-        w.Header().Set("Content-Disposition", "attachment; filename=access_records.json")
-        recordsMutex.RLock()
-        data, _ := json.MarshalIndent(accessRecords, "", "  ")
-        recordsMutex.RUnlock()
-        w.Write(data)
-    })
-
-    log.Println("🌍 MyTravelDiary 增强版服务器已启动")
-    log.Println("📍 主页访问地址：http://1.95.203.92:9099")
-    log.Println("📍 或直接访问：http://1.95.203.92:9099/homepage.html")
-    log.Println("🔍 健康检查：http://1.95.203.92:9099/health")
-    log.Println("📊 管理统计：http://1.95.203.92:9099/admin/stats (需要认证)")
-    log.Println("📁 导出数据：http://1.95.203.92:9099/admin/export (需要认证)")
-    log.Println("🔐 安全特性：IP黑名单、速率限制、地理位置记录已启用")
-    log.Println("===========================================")
+</html>`
 
-    err := http.ListenAndServe(":9099", nil)
-    if err != nil {
-        log.Fatal("❌ 服务器启动失败:", err)
+var (
+    errorTemplates        = make(map[int]*template.Template)
+    fallbackErrorTemplate = template.Must(template.New("error").Parse(defaultErrorTemplate))
+    // 返回 JSON 错误体的 API 路由前缀
+    apiRoutePrefixes = []string{"/comments/", "/api/", "/admin/", "/health"}
+    errorTexts       = map[string]map[int]errorText{
+        "zh": {
+            http.StatusBadRequest:            {"请求有误", "请求的格式不正确，请检查后重试。"},
+            http.StatusUnauthorized:          {"未授权", "需要有效的凭证才能访问。"},
+            http.StatusForbidden:             {"访问被拒绝", "抱歉，您没有权限访问此页面。"},
+            http.StatusNotFound:              {"页面未找到", "抱歉，您访问的页面不存在。可能是页面正在建设中，或者链接有误。"},
+            http.StatusMethodNotAllowed:      {"不支持的请求方法", "此地址不支持该请求方法。"},
+            http.StatusConflict:              {"请求冲突", "该操作与现有数据冲突。"},
+            http.StatusRequestEntityTooLarge: {"请求体过大", "提交的内容超过了允许的大小。"},
+            http.StatusTooManyRequests:       {"请求过多", "您的访问太频繁了，请稍后再试。"},
+            http.StatusInternalServerError:   {"服务器内部错误", "服务器开小差了，请稍后再试。"},
+        },
+        "en": {
+            http.StatusBadRequest:            {"Bad Request", "The request was malformed. Please check it and try again."},
+            http.StatusUnauthorized:          {"Unauthorized", "Valid credentials are required."},
+            http.StatusForbidden:             {"Forbidden", "Sorry, you do not have permission to access this page."},
+            http.StatusNotFound:              {"Page Not Found", "Sorry, the page you requested does not exist. It may still be under construction, or the link is wrong."},
+            http.StatusMethodNotAllowed:      {"Method Not Allowed", "This address does not support that request method."},
+            http.StatusConflict:              {"Conflict", "The request conflicts with existing data."},
+            http.StatusRequestEntityTooLarge: {"Payload Too Large", "The submitted content exceeds the allowed size."},
+            http.StatusTooManyRequests:       {"Too Many Requests", "You are visiting too frequently. Please try again later."},
+            http.StatusInternalServerError:   {"Internal Server Error", "Something went wrong on our side. Please try again later."},
+        },
     }
-}
+    homeTexts = map[string]string{"zh": "返回首页", "en": "Back to Home"}
+)
 
-func loadComments() {
-    data, err := os.ReadFile("comments.json")
-    if err != nil {
-        log.Println("💾 没有找到评论记录文件，将创建新的记录")
+// loadErrorTemplates 从静态目录加载自定义错误页，加载失败时使用内置模板
+func loadErrorTemplates(staticDir string) {
+    if serverConfig.Static.ErrorPagesDir == "" {
         return
     }
-    if err := json.Unmarshal(data, &comments); err != nil {
-        log.Printf("⚠  加载评论记录失败: %v", err)
-        return
+    dir := filepath.Join(staticDir, serverConfig.Static.ErrorPagesDir)
+    if tmpl, err := template.ParseFiles(filepath.Join(dir, "error.html")); err == nil {
+        fallbackErrorTemplate = tmpl
+        log.Printf("📄 已加载自定义错误页模板: %s", filepath.Join(dir, "error.html"))
     }
-    log.Printf("📊 已加载 %d 个城市的评论记录", len(comments))
-}
-
-func periodicSave() {
-    ticker := time.NewTicker(5 * time.Minute)
-    defer ticker.Stop()
-    for {
-        select {
-        case <-ticker.C:
-            saveAccessRecords()
-            saveComments()
+    for status := range errorTexts["zh"] {
+        file := filepath.Join(dir, strconv.Itoa(status)+".html")
+        if _, err := os.Stat(file); err != nil {
+            continue
         }
-    }
-}
-
-func saveComments() {
-    commentsMutex.RLock()
-    data, err := json.MarshalIndent(comments, "", "  ")
-    commentsMutex.RUnlock()
-    if err != nil {
-        log.Printf("⚠  序列化评论记录失败: %v", err)
-        return
-    }
-    if err := os.WriteFile("comments.json", data, 0644); err != nil {
-        log.Printf("⚠  保存评论记录失败: %v", err)
-        return
-    }
-    log.Println("💾 评论记录已保存")
-}
-
-func getRealIP(r *http.Request) string {
-    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-        ips := strings.Split(xff, ",")
-        if len(ips) > 0 {
-            return strings.TrimSpace(ips[0])
+        tmpl, err := template.ParseFiles(file)
+        if err != nil {
+            log.Printf("⚠  解析错误页模板失败: %s: %v", file, err)
+            continue
         }
+        errorTemplates[status] = tmpl
+        log.Printf("📄 已加载自定义错误页模板: %s", file)
     }
-    if xri := r.Header.Get("X-Real-IP"); xri != "" {
-        return xri
-    }
-    ip, _, err := net.SplitHostPort(r.RemoteAddr)
-    if err != nil {
-        return r.RemoteAddr
-    }
-    return ip
 }
 
-func securityCheck(clientIP string, r *http.Request) bool {
-    for _, blockedIP := range blacklistedIPs {
-        if clientIP == blockedIP {
-            return false
-        }
-    }
-    userAgent := strings.ToLower(r.UserAgent())
-    suspiciousAgents := []string{"bot", "crawler", "spider", "scraper"}
-    for _, suspicious := range suspiciousAgents {
-        if strings.Contains(userAgent, suspicious) {
-            log.Printf("⚠  可疑访问: IP %s, User-Agent: %s", clientIP, r.UserAgent())
-        }
-    }
-    suspiciousChars := []string{"../", "..\\", "<script", "<?php", "eval("}
-    for _, char := range suspiciousChars {
-        if strings.Contains(r.URL.Path, char) {
-            log.Printf("🚨 安全警告: 检测到可疑路径 %s from IP %s", r.URL.Path, clientIP)
-            return false
-        }
+// writeError 输出错误响应：API 路由返回 JSON，其余按 Accept-Language 渲染中文或英文错误页。
+// detail 为补充说明（中文），仅在中文页面和 JSON 中出现。
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+    lang := preferredLanguage(r.Header.Get("Accept-Language"))
+    text, ok := errorTexts[lang][status]
+    if !ok {
+        text = errorText{Title: http.StatusText(status), Message: http.StatusText(status)}
     }
-    return true
-}
 
-func rateLimitCheck(clientIP string) bool {
-    requestMutex.Lock()
-    defer requestMutex.Unlock()
-    now := time.Now()
-    cutoff := now.Add(-time.Minute)
-    if _, exists := requestCounts[clientIP]; !exists {
-        requestCounts[clientIP] = []time.Time{}
-    }
-    var validRequests []time.Time
-    for _, reqTime := range requestCounts[clientIP] {
-        if reqTime.After(cutoff) {
-            validRequests = append(validRequests, reqTime)
-        }
-    }
-    if len(validRequests) >= rateLimitPerMinute {
-        return false
-    }
-    validRequests = append(validRequests, now)
-    requestCounts[clientIP] = validRequests
-    return true
-}
+    h := w.Header()
+    h.Del("Content-Length")
+    h.Set("X-Content-Type-Options", "nosniff")
+    h.Set("Cache-Control", "no-store")
 
-func recordAccess(clientIP string, r *http.Request) {
-    recordsMutex.Lock()
-    defer recordsMutex.Unlock()
-    record, exists := accessRecords[clientIP]
-    if !exists {
-        geoInfo := getGeoLocation(clientIP)
-        record = &AccessRecord{
-            IP:           clientIP,
-            UserAgent:    r.UserAgent(),
-            FirstVisit:   time.Now(),
-            LastVisit:    time.Now(),
-            VisitCount:   1,
-            Country:      geoInfo.Country,
-            Region:       geoInfo.RegionName,
-            City:         geoInfo.City,
-            ISP:          geoInfo.ISP,
-            PagesVisited: []string{r.URL.Path},
-            Blocked:      false,
-        }
-        log.Printf("🆕 新访客: IP %s, 地区: %s %s %s, ISP: %s", 
-            clientIP, geoInfo.Country, geoInfo.RegionName, geoInfo.City, geoInfo.ISP)
-    } else {
-        record.LastVisit = time.Now()
-        record.VisitCount++
-        found := false
-        for _, page := range record.PagesVisited {
-            if page == r.URL.Path {
-                found = true
-                break
-            }
-        }
-        if !found {
-            record.PagesVisited = append(record.PagesVisited, r.URL.Path)
+    if isAPIRoute(r.URL.Path) {
+        body := map[string]interface{}{"status": status, "error": text.Title}
+        if detail != "" && detail != text.Title {
+            body["message"] = detail
         }
+        h.Set("Content-Type", "application/json; charset=utf-8")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(body)
+        return
     }
-    accessRecords[clientIP] = record
-    logEntry := fmt.Sprintf("[%s] IP: %s | Path: %s | Agent: %s | Visits: %d | Location: %s %s %s\n",
-        time.Now().Format("2006-01-02 15:04:05"),
-        clientIP,
-        r.URL.Path,
-        r.UserAgent(),
-        record.VisitCount,
-        record.Country,
-        record.Region,
-        record.City,
-    )
-    logFile.WriteString(logEntry)
-    logFile.Sync()
-}
 
-func getGeoLocation(ip string) *IPGeolocation {
-    if isLocalIP(ip) {
-        return &IPGeolocation{
-            IP:      ip,
-            Country: "Local",
-            Region:  "Local",
-            City:    "Local",
-            ISP:     "Local Network",
-        }
+    data := errorPageData{
+        Status:   status,
+        Lang:     lang,
+        Title:    text.Title,
+        Message:  text.Message,
+        HomeText: homeTexts[lang],
     }
-    url := fmt.Sprintf("http://ip-api.com/json/%s?fields=status,message,country,countryCode,region,regionName,city,zip,lat,lon,timezone,isp,org,as,query", ip)
-    resp, err := http.Get(url)
-    if err != nil {
-        log.Printf("获取地理位置信息失败: %v", err)
-        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    if lang == "zh" && detail != "" && detail != text.Title {
+        data.Detail = detail
     }
-    defer resp.Body.Close()
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        log.Printf("读取地理位置响应失败: %v", err)
-        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    if status == http.StatusNotFound {
+        data.Path = r.URL.Path
     }
-    var geoInfo IPGeolocation
-    if err := json.Unmarshal(body, &geoInfo); err != nil {
-        log.Printf("解析地理位置信息失败: %v", err)
-        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    tmpl := errorTemplates[status]
+    if tmpl == nil {
+        tmpl = fallbackErrorTemplate
     }
-    if geoInfo.Status != "success" {
-        return &IPGeolocation{IP: ip, Country: "Unknown", Region: "Unknown", City: "Unknown", ISP: "Unknown"}
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, data); err != nil {
+        log.Printf("⚠  渲染错误页失败: %v", err)
+        h.Set("Content-Type", "text/plain; charset=utf-8")
+        w.WriteHeader(status)
+        w.Write([]byte(text.Title))
+        return
     }
-    return &geoInfo
+    h.Set("Content-Type", "text/html; charset=utf-8")
+    w.WriteHeader(status)
+    w.Write(buf.Bytes())
 }
 
-func isLocalIP(ip string) bool {
-    localRanges := []string{"127.", "192.168.", "10.", "172.16.", "172.17.", "172.18.", "172.19.", 
-                          "172.20.", "172.21.", "172.22.", "172.23.", "172.24.", "172.25.", 
-                          "172.26.", "172.27.", "172.28.", "172.29.", "172.30.", "172.31.", "::1"}
-    for _, localRange := range localRanges {
-        if strings.HasPrefix(ip, localRange) {
+func isAPIRoute(path string) bool {
+    for _, prefix := range apiRoutePrefixes {
+        if strings.HasPrefix(path, prefix) {
             return true
         }
     }
     return false
 }
 
-func logSecurityEvent(clientIP string, r *http.Request, eventType string) {
-    log.Printf("🚨 安全事件 [%s]: IP %s | Path: %s | Agent: %s", 
-        eventType, clientIP, r.URL.Path, r.UserAgent())
-    recordsMutex.Lock()
-    if record, exists := accessRecords[clientIP]; exists {
-        record.Blocked = true
-        record.BlockReason = eventType
+// preferredLanguage 按 Accept-Language 的 q 值选择 zh 或 en，默认中文
+func preferredLanguage(acceptLanguage string) string {
+    best := "zh"
+    bestQ := -1.0
+    for _, part := range strings.Split(acceptLanguage, ",") {
+        fields := strings.Split(strings.TrimSpace(part), ";")
+        tag := strings.ToLower(strings.TrimSpace(fields[0]))
+        q := 1.0
+        for _, param := range fields[1:] {
+            param = strings.TrimSpace(param)
+            if strings.HasPrefix(param, "q=") {
+                if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+                    q = v
+                }
+            }
+        }
+        lang := ""
+        switch {
+        case tag == "zh" || strings.HasPrefix(tag, "zh-"):
+            lang = "zh"
+        case tag == "en" || strings.HasPrefix(tag, "en-"):
+            lang = "en"
+        }
+        if lang != "" && q > bestQ {
+            best, bestQ = lang, q
+        }
     }
-    recordsMutex.Unlock()
-}
-
-func setSecurityHeaders(w http.ResponseWriter) {
-    w.Header().Set("X-Content-Type-Options", "nosniff")
-    w.Header().Set("X-Frame-Options", "DENY")
-    w.Header().Set("X-XSS-Protection", "1; mode=block")
-    w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+    return best
 }
 
 func initLogFile() {
@@ -546,8 +7837,8 @@ func setContentType(w http.ResponseWriter, path string) {
         w.Header().Set("Content-Type", "text/css; charset=utf-8")
     case strings.HasSuffix(path, ".js"):
         w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
-    case strings.HasSuffix(path, ".mp3"):
-        w.Header().Set("Content-Type", "audio/mpeg")
+    case audioContentType(path) != "":
+        w.Header().Set("Content-Type", audioContentType(path))
     case strings.HasSuffix(path, ".jpg"), strings.HasSuffix(path, ".jpeg"):
         w.Header().Set("Content-Type", "image/jpeg")
     case strings.HasSuffix(path, ".png"):
@@ -562,16 +7853,9 @@ func setContentType(w http.ResponseWriter, path string) {
 }
 
 func checkCriticalFiles(staticDir string) {
-    criticalFiles := []string{
-        "homepage.html",
-        "nj.html",
-        "sz.html",
-        "jj.html",
-        "nc.html",
-        "xjp.html",
-        "mlxy.html",
-        "zjj.html",
-        "gz.html",
+    criticalFiles := []string{"homepage.html"}
+    for _, city := range serverConfig.Cities {
+        criticalFiles = append(criticalFiles, city.Page)
     }
     log.Println("🔍 检查关键文件...")
     missingFiles := []string{}
@@ -593,7 +7877,12 @@ func checkCriticalFiles(staticDir string) {
     } else {
         log.Println("✅ 所有关键文件检查完成，没有发现缺失文件")
     }
-    resourceDirs := []string{"images", "bgm", "imagesxjp", "imgszc"}
+    resourceDirs := []string{serverConfig.Music.Dir}
+    for _, city := range serverConfig.Cities {
+        if city.ImageDir != "" && !containsFold(resourceDirs, city.ImageDir) {
+            resourceDirs = append(resourceDirs, city.ImageDir)
+        }
+    }
     for _, dir := range resourceDirs {
         dirPath := filepath.Join(staticDir, dir)
         if _, err := os.Stat(dirPath); os.IsNotExist(err) {
@@ -602,5 +7891,17 @@ func checkCriticalFiles(staticDir string) {
             log.Printf("✅ 资源目录存在 - %s", dir)
         }
     }
+    for _, city := range serverConfig.Cities {
+        for _, track := range city.Music {
+            if _, err := os.Stat(filepath.Join(staticDir, serverConfig.Music.Dir, track)); os.IsNotExist(err) {
+                log.Printf("⚠  警告: %s 的背景音乐不存在 - %s", city.Name, track)
+            }
+        }
+    }
+    for _, dir := range discoverGalleryDirs(staticDir) {
+        if !containsFold(resourceDirs, dir) {
+            log.Printf("💡 发现未在城市登记表中的相册目录 - %s，将以 %s 提供相册清单", dir, galleryCity(dir))
+        }
+    }
     log.Println("===========================================")
 }
@@ -0,0 +1,2408 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "image/jpeg"
+    "image/png"
+    "io"
+    "log"
+    "mime/multipart"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// withServerConfig 修改全局配置，测试结束后恢复
+func withServerConfig(t *testing.T, modify func(cfg *ServerConfig)) {
+    t.Helper()
+    saved := serverConfig
+    cfg := defaultServerConfig()
+    if modify != nil {
+        modify(cfg)
+    }
+    serverConfig = cfg
+    t.Cleanup(func() { serverConfig = saved })
+}
+
+// startTestServer 使用 newHTTPServer 在随机端口上启动服务器
+func startTestServer(t *testing.T, handler http.Handler) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := newHTTPServer(handler)
+    go server.Serve(listener)
+    t.Cleanup(func() { server.Close() })
+    return listener.Addr().String()
+}
+
+func TestSlowHeaderIsCutOff(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Server.ReadHeaderTimeoutSeconds = 1
+    })
+    addr := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+    conn, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    // 只发送一部分请求头，之后不再发送
+    if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n"); err != nil {
+        t.Fatal(err)
+    }
+    start := time.Now()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    _, err = io.ReadAll(conn)
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        t.Fatal("服务器没有在读取请求头超时后关闭连接")
+    }
+    if elapsed := time.Since(start); elapsed > 3*time.Second {
+        t.Fatalf("连接在 %v 后才关闭", elapsed)
+    }
+}
+
+func TestOversizedBodyIsRejected(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Server.MaxBodyBytes = 64
+        cfg.Server.RouteBodyLimits = map[string]int64{"/admin/upload/": 1024}
+    })
+    handler := bodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if _, err := io.ReadAll(r.Body); err != nil {
+            var maxErr *http.MaxBytesError
+            if errors.As(err, &maxErr) {
+                writeError(w, r, http.StatusRequestEntityTooLarge, "请求体过大")
+                return
+            }
+            writeError(w, r, http.StatusBadRequest, "")
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    }))
+
+    tests := []struct {
+        name    string
+        path    string
+        size    int
+        chunked bool
+        want    int
+    }{
+        {"默认上限内", "/api/diaries", 64, false, http.StatusNoContent},
+        {"超过默认上限", "/api/diaries", 65, false, http.StatusRequestEntityTooLarge},
+        {"未声明长度超过默认上限", "/api/diaries", 65, true, http.StatusRequestEntityTooLarge},
+        {"路由上限内", "/admin/upload/nj", 1024, false, http.StatusNoContent},
+        {"超过路由上限", "/admin/upload/nj", 1025, false, http.StatusRequestEntityTooLarge},
+        {"未声明长度超过路由上限", "/admin/upload/nj", 1025, true, http.StatusRequestEntityTooLarge},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var body io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+            if tt.chunked {
+                body = io.MultiReader(body)
+            }
+            req := httptest.NewRequest(http.MethodPost, tt.path, body)
+            if tt.chunked {
+                req.ContentLength = -1
+            }
+            rec := httptest.NewRecorder()
+            handler.ServeHTTP(rec, req)
+            if rec.Code != tt.want {
+                t.Fatalf("状态码 %d，期望 %d", rec.Code, tt.want)
+            }
+        })
+    }
+}
+
+func TestRouteReadTimeoutAllowsSlowUpload(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Server.ReadTimeoutSeconds = 1
+        cfg.Server.RouteReadTimeouts = map[string]int{"/admin/upload/": 5}
+    })
+    addr := startTestServer(t, bodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if _, err := io.ReadAll(r.Body); err != nil {
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    })))
+
+    // 请求体分两段发送，间隔超过默认读取时限
+    slowPost := func(path string) (int, error) {
+        conn, err := net.Dial("tcp", addr)
+        if err != nil {
+            return 0, err
+        }
+        defer conn.Close()
+        io.WriteString(conn, "POST "+path+" HTTP/1.1\r\nHost: example\r\nContent-Length: 4\r\n\r\nab")
+        time.Sleep(2 * time.Second)
+        io.WriteString(conn, "cd")
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+        if err != nil {
+            return 0, err
+        }
+        resp.Body.Close()
+        return resp.StatusCode, nil
+    }
+
+    if status, err := slowPost("/admin/upload/nj"); err != nil || status != http.StatusNoContent {
+        t.Fatalf("上传路由的慢速请求失败: %d %v", status, err)
+    }
+    if status, err := slowPost("/api/diaries"); err == nil && status == http.StatusNoContent {
+        t.Fatal("默认路由的慢速请求没有超时")
+    }
+}
+
+func FuzzResolveStaticPath(f *testing.F) {
+    root, err := realPath(f.TempDir())
+    if err != nil {
+        f.Fatal(err)
+    }
+    outside, err := realPath(f.TempDir())
+    if err != nil {
+        f.Fatal(err)
+    }
+    os.MkdirAll(filepath.Join(root, "imgnj"), 0755)
+    os.WriteFile(filepath.Join(root, "nj.html"), []byte("<html></html>"), 0644)
+    os.WriteFile(filepath.Join(root, "imgnj", "1.jpg"), []byte("jpg"), 0644)
+    os.WriteFile(filepath.Join(root, ".env"), []byte("SECRET=1"), 0644)
+    os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+    os.Symlink(outside, filepath.Join(root, "escape"))
+    os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "imgnj", "link.jpg"))
+    os.Symlink(filepath.Join(root, "nj.html"), filepath.Join(root, "alias.html"))
+
+    for _, seed := range []string{
+        "/nj.html", "/imgnj/1.jpg", "/alias.html",
+        "/../secret.txt", "/imgnj/../../secret.txt", "..", "/./../", "//..//..",
+        "/escape/secret.txt", "/imgnj/link.jpg", "/escape", "/escape/../nj.html",
+        "/.env", "/imgnj/.hidden", "/%2e%2e/secret.txt", "/%2e%2e%2fsecret.txt", "/.%2e/secret.txt",
+        "/imgnj\\..\\..\\secret.txt", "/nj.html\x00.jpg", "/\xff\xfe", "/test.go", "/config.json",
+    } {
+        f.Add(seed)
+    }
+    f.Fuzz(func(t *testing.T, urlPath string) {
+        resolved, err := resolveStaticPath(root, urlPath)
+        if err != nil {
+            if err != errPathForbidden && err != errPathNotFound {
+                t.Fatalf("%q: 意外的错误 %v", urlPath, err)
+            }
+            return
+        }
+        if !isWithinDir(root, resolved) {
+            t.Fatalf("%q 解析到了静态目录之外: %s", urlPath, resolved)
+        }
+        if real, err := filepath.EvalSymlinks(resolved); err != nil || !isWithinDir(root, real) {
+            t.Fatalf("%q 经由符号链接逃逸: %s", urlPath, real)
+        }
+        rel, _ := filepath.Rel(root, resolved)
+        for _, segment := range strings.Split(filepath.ToSlash(rel), "/") {
+            if strings.HasPrefix(segment, ".") && segment != "." {
+                t.Fatalf("%q 解析到了点文件: %s", urlPath, resolved)
+            }
+        }
+    })
+}
+
+func TestPruneImageCacheRemovesOldestFiles(t *testing.T) {
+    dir := t.TempDir()
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Images.CacheDir = dir
+        cfg.Images.CacheMaxBytes = 1000
+    })
+    now := time.Now()
+    for i := 0; i < 5; i++ {
+        name := filepath.Join(dir, fmt.Sprintf("%d.jpg", i))
+        os.WriteFile(name, make([]byte, 300), 0644)
+        // 0.jpg 最旧
+        modTime := now.Add(time.Duration(i-5) * time.Hour)
+        os.Chtimes(name, modTime, modTime)
+    }
+    pruneImageCache(serverConfig.Images)
+    for i, want := range []bool{false, false, true, true, true} {
+        _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%d.jpg", i)))
+        if exists := err == nil; exists != want {
+            t.Errorf("%d.jpg 存在=%v，期望 %v", i, exists, want)
+        }
+    }
+}
+
+func TestImageKeyLocksAreReleased(t *testing.T) {
+    done := make(chan struct{})
+    for i := 0; i < 8; i++ {
+        go func() {
+            unlock := lockImageKey("same")
+            time.Sleep(time.Millisecond)
+            unlock()
+            done <- struct{}{}
+        }()
+    }
+    for i := 0; i < 8; i++ {
+        <-done
+    }
+    imageKeyMutex.Lock()
+    defer imageKeyMutex.Unlock()
+    if len(imageKeyLocks) != 0 {
+        t.Fatalf("仍有 %d 个锁留在表中", len(imageKeyLocks))
+    }
+}
+
+// buildExifJPEG 生成只有 APP1 段的 JPEG 头：IFD0 中一个 GPS 指针（类型 typ，值 gpsOffset），
+// 偏移 26 处是包含一个纬度参考项的 GPS 目录
+func buildExifJPEG(typ uint16, gpsOffset uint32) []byte {
+    tiff := make([]byte, 44)
+    copy(tiff, "II*\x00")
+    binary.LittleEndian.PutUint32(tiff[4:], 8)
+    binary.LittleEndian.PutUint16(tiff[8:], 1)
+    binary.LittleEndian.PutUint16(tiff[10:], 0x8825)
+    binary.LittleEndian.PutUint16(tiff[12:], typ)
+    binary.LittleEndian.PutUint32(tiff[14:], 1)
+    binary.LittleEndian.PutUint32(tiff[18:], gpsOffset)
+    binary.LittleEndian.PutUint16(tiff[26:], 1)
+    binary.LittleEndian.PutUint16(tiff[28:], 0x0001)
+    binary.LittleEndian.PutUint16(tiff[30:], 2)
+    binary.LittleEndian.PutUint32(tiff[32:], 2)
+    copy(tiff[36:], "N\x00")
+
+    segment := append([]byte("Exif\x00\x00"), tiff...)
+    data := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0, 0}
+    binary.BigEndian.PutUint16(data[4:], uint16(len(segment)+2))
+    data = append(data, segment...)
+    return append(data, 0xFF, 0xD9)
+}
+
+func TestStripExifGPS(t *testing.T) {
+    tests := []struct {
+        name      string
+        data      []byte
+        wantStrip bool
+    }{
+        {"正常的 GPS 目录", buildExifJPEG(4, 26), true},
+        {"偏移越界", buildExifJPEG(4, 1<<30), false},
+        {"偏移指向目录末尾", buildExifJPEG(4, 43), false},
+        {"偏移指向 TIFF 头", buildExifJPEG(4, 2), false},
+        {"类型不是整数", buildExifJPEG(2, 26), false},
+        {"截断的文件", buildExifJPEG(4, 26)[:20], false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            data := append([]byte{}, tt.data...)
+            stripped := stripExifGPS(data)
+            if stripped != tt.wantStrip {
+                t.Fatalf("stripExifGPS = %v，期望 %v", stripped, tt.wantStrip)
+            }
+            if !stripped && !bytes.Equal(data, tt.data) {
+                t.Fatal("没有去掉 GPS 时不应修改数据")
+            }
+            if stripped {
+                if !bytes.HasPrefix(data[12:], []byte("II*\x00")) {
+                    t.Fatal("TIFF 头被破坏")
+                }
+                if bytes.Contains(data, []byte("N\x00")) {
+                    t.Fatal("GPS 数据没有被清除")
+                }
+            }
+        })
+    }
+}
+
+func TestMusicTrackRanges(t *testing.T) {
+    root, err := realPath(t.TempDir())
+    if err != nil {
+        t.Fatal(err)
+    }
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Music.Dir = "bgm"
+        cfg.Music.Tracks = map[string][]string{}
+        cfg.Music.Default = "nj"
+        cfg.Cities = []CityInfo{
+            {Abbr: "nj", Name: "南京", Page: "nj.html", Music: []string{"a - b.mp3"}},
+            {Abbr: "gz", Name: "广州", Page: "gz.html"},
+        }
+    })
+    os.MkdirAll(filepath.Join(root, "bgm"), 0755)
+    track := make([]byte, 1000)
+    for i := range track {
+        track[i] = byte(i)
+    }
+    os.WriteFile(filepath.Join(root, "bgm", "a - b.mp3"), track, 0644)
+
+    tests := []struct {
+        name        string
+        method      string
+        path        string
+        rangeHeader string
+        wantStatus  int
+        wantBody    []byte
+        wantRange   string
+    }{
+        {"完整文件", http.MethodGet, "/music/nj.mp3", "", http.StatusOK, track, ""},
+        {"按序号", http.MethodGet, "/music/nj/1", "", http.StatusOK, track, ""},
+        {"无扩展名", http.MethodGet, "/music/nj", "", http.StatusOK, track, ""},
+        {"HEAD", http.MethodHead, "/music/nj.mp3", "", http.StatusOK, nil, ""},
+        {"起止范围", http.MethodGet, "/music/nj.mp3", "bytes=0-99", http.StatusPartialContent, track[:100], "bytes 0-99/1000"},
+        {"开放范围", http.MethodGet, "/music/nj.mp3", "bytes=900-", http.StatusPartialContent, track[900:], "bytes 900-999/1000"},
+        {"末尾范围", http.MethodGet, "/music/nj.mp3", "bytes=-10", http.StatusPartialContent, track[990:], "bytes 990-999/1000"},
+        {"越界范围", http.MethodGet, "/music/nj.mp3", "bytes=1000-", http.StatusRequestedRangeNotSatisfiable, nil, "bytes */1000"},
+        {"扩展名不符", http.MethodGet, "/music/nj.ogg", "", http.StatusNotFound, nil, ""},
+        {"序号越界", http.MethodGet, "/music/nj/2", "", http.StatusNotFound, nil, ""},
+        {"不支持的方法", http.MethodPost, "/music/nj.mp3", "", http.StatusMethodNotAllowed, nil, ""},
+        {"登记城市使用默认曲目", http.MethodGet, "/music/gz.mp3", "", http.StatusOK, track, ""},
+        {"未知城市", http.MethodGet, "/music/unknown.mp3", "", http.StatusNotFound, nil, ""},
+        {"未知城市按序号", http.MethodGet, "/music/unknown/1", "", http.StatusNotFound, nil, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(tt.method, tt.path, nil)
+            if tt.rangeHeader != "" {
+                req.Header.Set("Range", tt.rangeHeader)
+            }
+            rec := httptest.NewRecorder()
+            serveMusicTrack(rec, req, root)
+            if rec.Code != tt.wantStatus {
+                t.Fatalf("状态码 %d，期望 %d", rec.Code, tt.wantStatus)
+            }
+            if tt.wantBody != nil && !bytes.Equal(rec.Body.Bytes(), tt.wantBody) {
+                t.Fatalf("响应体长度 %d，期望 %d", rec.Body.Len(), len(tt.wantBody))
+            }
+            if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+                t.Fatalf("Content-Range %q，期望 %q", got, tt.wantRange)
+            }
+            if rec.Code < 300 && rec.Header().Get("Content-Type") != "audio/mpeg" {
+                t.Fatalf("Content-Type %q", rec.Header().Get("Content-Type"))
+            }
+        })
+    }
+
+    for method, want := range map[string]int{
+        http.MethodGet:    http.StatusOK,
+        http.MethodHead:   http.StatusOK,
+        http.MethodPost:   http.StatusMethodNotAllowed,
+        http.MethodDelete: http.StatusMethodNotAllowed,
+    } {
+        rec := httptest.NewRecorder()
+        serveMusicPlaylist(rec, httptest.NewRequest(method, "/api/music/nj", nil), root)
+        if rec.Code != want {
+            t.Errorf("%s /api/music/nj 状态码 %d，期望 %d", method, rec.Code, want)
+        }
+    }
+    for path, want := range map[string]int{
+        "/api/music/gz":      http.StatusOK,
+        "/api/music/unknown": http.StatusNotFound,
+    } {
+        rec := httptest.NewRecorder()
+        serveMusicPlaylist(rec, httptest.NewRequest(http.MethodGet, path, nil), root)
+        if rec.Code != want {
+            t.Errorf("GET %s 状态码 %d，期望 %d", path, rec.Code, want)
+        }
+    }
+}
+
+func TestServeFeedConcurrentIgnoresHost(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Feed.BaseURL = "https://diary.example/"
+        cfg.Feed.CacheSeconds = 0
+    })
+    feedCacheMutex.Lock()
+    feedCache = make(map[string]*feedDocument)
+    feedCacheMutex.Unlock()
+    published := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+    build := func(base string) (string, string, []feedItem) {
+        return "测试", base + "/", []feedItem{{ID: base + "/nj.html", Title: "南京", Link: base + "/nj.html", Published: published, Updated: published}}
+    }
+
+    done := make(chan string)
+    for i := 0; i < 16; i++ {
+        go func(i int) {
+            req := httptest.NewRequest(http.MethodGet, "/feed.xml", nil)
+            req.Host = fmt.Sprintf("evil%d.example", i)
+            rec := httptest.NewRecorder()
+            serveFeed(rec, req, "site", "rss", build)
+            done <- rec.Body.String()
+        }(i)
+    }
+    for i := 0; i < 16; i++ {
+        if body := <-done; strings.Contains(body, "evil") || !strings.Contains(body, "https://diary.example/nj.html") {
+            t.Fatalf("订阅源使用了请求的 Host: %s", body)
+        }
+    }
+    feedCacheMutex.Lock()
+    defer feedCacheMutex.Unlock()
+    if len(feedCache) != 1 {
+        t.Fatalf("缓存了 %d 份订阅源，期望 1 份", len(feedCache))
+    }
+}
+
+func TestServeFeedRequiresBaseURL(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Feed.BaseURL = ""
+    })
+    built := false
+    build := func(base string) (string, string, []feedItem) {
+        built = true
+        return "测试", base + "/", nil
+    }
+    for _, format := range []string{"rss", "atom", "json"} {
+        rec := httptest.NewRecorder()
+        serveFeed(rec, httptest.NewRequest(http.MethodGet, "/feed.xml", nil), "site", format, build)
+        if rec.Code != http.StatusNotFound {
+            t.Errorf("%s: 未配置站点地址时状态码 %d，期望 404", format, rec.Code)
+        }
+    }
+    if built {
+        t.Error("未配置站点地址时不应生成订阅源")
+    }
+}
+
+func TestServeFeedSignatureTracksItems(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Feed.BaseURL = "https://diary.example"
+        cfg.Feed.CacheSeconds = 0
+    })
+    feedCacheMutex.Lock()
+    feedCache = make(map[string]*feedDocument)
+    feedCacheMutex.Unlock()
+    older := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+    newer := older.Add(time.Hour)
+    item := func(id string, updated time.Time) feedItem {
+        return feedItem{ID: "https://diary.example/" + id, Title: id, Link: "https://diary.example/" + id, Published: updated, Updated: updated}
+    }
+    fetch := func(items ...feedItem) string {
+        rec := httptest.NewRecorder()
+        serveFeed(rec, httptest.NewRequest(http.MethodGet, "/feed.xml", nil), "site", "rss", func(base string) (string, string, []feedItem) {
+            return "测试", base + "/", items
+        })
+        if rec.Code != http.StatusOK {
+            t.Fatalf("状态码 %d", rec.Code)
+        }
+        return rec.Body.String()
+    }
+
+    fetch(item("a", older), item("b", newer))
+    // 删除 a 再新增 c：条数和最新更新时间都不变
+    body := fetch(item("c", older), item("b", newer))
+    if strings.Contains(body, "diary.example/a") || !strings.Contains(body, "diary.example/c") {
+        t.Fatalf("删除后新增条目时返回了旧的订阅源: %s", body)
+    }
+    // 较早的条目被修改
+    edited := fetch(item("c", older.Add(time.Minute)), item("b", newer))
+    if edited == body {
+        t.Fatal("条目更新时间变化后订阅源没有重新生成")
+    }
+}
+
+func TestSiteURLsComeFromConfigOnly(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Feed.BaseURL = ""
+        cfg.SEO.OpenGraph = true
+        cfg.Render.DiaryDir = t.TempDir()
+    })
+    renderedPagesMutex.Lock()
+    renderedPages = make(map[string]*renderedPage)
+    renderedPagesMutex.Unlock()
+
+    if robots := robotsTxt(configuredBaseURL()); strings.Contains(robots, "Sitemap:") {
+        t.Errorf("未配置站点地址时 robots.txt 不应包含 Sitemap: %q", robots)
+    }
+    tags := cityMetaTags(configuredBaseURL(), "/nj.html", "南京", "", "imgnj/1.jpg")
+    if strings.Contains(tags, "canonical") || strings.Contains(tags, "og:url") || strings.Contains(tags, "og:image") {
+        t.Errorf("未配置站点地址时不应输出完整地址: %s", tags)
+    }
+    page, err := cityPage("nj")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bytes.Contains(page.html, []byte("og:url")) {
+        t.Errorf("城市页面输出了 og:url")
+    }
+    if bytes.Contains(page.html, []byte(`href="/feed.xml"`)) {
+        t.Errorf("未配置站点地址时城市页面不应链接订阅源")
+    }
+
+    serverConfig.Feed.BaseURL = "https://diary.example/"
+    if robots := robotsTxt(configuredBaseURL()); !strings.Contains(robots, "Sitemap: https://diary.example/sitemap.xml") {
+        t.Errorf("robots.txt 的 Sitemap 地址错误: %q", robots)
+    }
+    page, err = cityPage("nj")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Contains(page.html, []byte(`<link rel="canonical" href="https://diary.example`)) {
+        t.Errorf("城市页面缺少配置的 canonical 地址")
+    }
+    if !bytes.Contains(page.html, []byte(`href="/feed.xml"`)) {
+        t.Errorf("城市页面缺少订阅源链接")
+    }
+    renderedPagesMutex.RLock()
+    defer renderedPagesMutex.RUnlock()
+    if len(renderedPages) != 1 {
+        t.Fatalf("缓存了 %d 份城市页面，期望 1 份", len(renderedPages))
+    }
+}
+
+// fakeResolver 按表返回反向和正向解析结果
+type fakeResolver struct {
+    ptr   map[string][]string
+    hosts map[string][]string
+    err   error
+}
+
+func (f fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+    if f.err != nil {
+        return nil, f.err
+    }
+    names, ok := f.ptr[addr]
+    if !ok {
+        return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+    }
+    return names, nil
+}
+
+func (f fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+    addrs, ok := f.hosts[host]
+    if !ok {
+        return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+    }
+    return addrs, nil
+}
+
+func TestVerifyCrawlerIP(t *testing.T) {
+    withServerConfig(t, nil)
+    old := botResolver
+    t.Cleanup(func() { botResolver = old })
+    botResolver = fakeResolver{
+        ptr: map[string][]string{
+            "66.249.66.1": {"crawl-66-249-66-1.googlebot.com."},
+            "6.6.6.6":     {"crawl-6-6-6-6.googlebot.com.evil.example."},
+            "7.7.7.7":     {"fake.googlebot.com."},
+            "8.8.4.4":     {"Crawl.GoogleBot.com."},
+        },
+        hosts: map[string][]string{
+            "crawl-66-249-66-1.googlebot.com":         {"66.249.66.1"},
+            "crawl-6-6-6-6.googlebot.com.evil.example": {"6.6.6.6"},
+            "fake.googlebot.com":                       {"1.2.3.4"},
+            "crawl.googlebot.com":                      {"8.8.4.4"},
+        },
+    }
+    domains := []string{"googlebot.com", "google.com"}
+    tests := []struct {
+        ip   string
+        want bool
+    }{
+        {"66.249.66.1", true},
+        {"8.8.4.4", true},
+        // 域名只是前缀匹配，不属于爬虫域名
+        {"6.6.6.6", false},
+        // 正向解析不回到原 IP
+        {"7.7.7.7", false},
+        // 没有反向解析记录
+        {"9.9.9.9", false},
+    }
+    for _, tt := range tests {
+        got, err := verifyCrawlerIP(tt.ip, domains)
+        if err != nil || got != tt.want {
+            t.Errorf("verifyCrawlerIP(%s) = %v, %v，期望 %v", tt.ip, got, err, tt.want)
+        }
+    }
+
+    botResolver = fakeResolver{err: errors.New("timeout")}
+    if ok, err := verifyCrawlerIP("66.249.66.1", domains); ok || err == nil {
+        t.Errorf("解析失败时应返回错误，得到 %v, %v", ok, err)
+    }
+}
+
+func TestPruneRequestWindows(t *testing.T) {
+    old := time.Now().Add(-2 * time.Minute)
+    botActivityMutex.Lock()
+    botActivity = map[string][]time.Time{"10.0.0.1": {old}, "10.0.0.2": {old, time.Now()}}
+    botActivityMutex.Unlock()
+    requestMutex.Lock()
+    requestCounts = map[string][]time.Time{"10.0.0.3": {old}, "10.0.0.4": {time.Now()}}
+    requestMutex.Unlock()
+
+    pruneRequestWindows()
+
+    botActivityMutex.Lock()
+    _, stale := botActivity["10.0.0.1"]
+    _, fresh := botActivity["10.0.0.2"]
+    botActivityMutex.Unlock()
+    if stale || !fresh {
+        t.Errorf("爬虫计数清理错误: %v", botActivity)
+    }
+    requestMutex.Lock()
+    _, stale = requestCounts["10.0.0.3"]
+    _, fresh = requestCounts["10.0.0.4"]
+    requestMutex.Unlock()
+    if stale || !fresh {
+        t.Errorf("限流计数清理错误: %v", requestCounts)
+    }
+}
+
+func TestSearchSingleHanCharacter(t *testing.T) {
+    withServerConfig(t, nil)
+    searchMutex.Lock()
+    searchDocs = make(map[string]*searchDoc)
+    searchPostings = make(map[string]map[string]int)
+    searchLength = 0
+    searchMutex.Unlock()
+    addSearchDoc(&searchDoc{ID: "a", Kind: "diary", City: "hz", Title: "西湖", Text: "傍晚沿着湖边散步"})
+    addSearchDoc(&searchDoc{ID: "b", Kind: "diary", City: "nj", Title: "夫子庙", Text: "秦淮河的夜景"})
+
+    tests := []struct {
+        query string
+        want  []string
+    }{
+        {"湖", []string{"a"}},
+        {"西湖", []string{"a"}},
+        {"河", []string{"b"}},
+        {"湖 河", nil},
+        {"山", nil},
+    }
+    for _, tt := range tests {
+        var got []string
+        for _, r := range searchIndexQuery(tt.query, "", "") {
+            got = append(got, r.Title)
+        }
+        var want []string
+        for _, id := range tt.want {
+            want = append(want, searchDocs[id].Title)
+        }
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Errorf("搜索 %q 得到 %v，期望 %v", tt.query, got, want)
+        }
+    }
+
+    // 移除文档后单字索引也要清理干净
+    searchMutex.Lock()
+    removeSearchDocLocked("a")
+    _, left := searchPostings["湖"]
+    searchMutex.Unlock()
+    if left {
+        t.Errorf("移除文档后仍有单字索引")
+    }
+}
+
+// fakeSMTPServer 一个最简单的 SMTP 服务器，收到的邮件正文写入 received
+func fakeSMTPServer(t *testing.T, received chan<- string) string {
+    t.Helper()
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                reader := bufio.NewReader(conn)
+                fmt.Fprint(conn, "220 fake ESMTP\r\n")
+                for {
+                    line, err := reader.ReadString('\n')
+                    if err != nil {
+                        return
+                    }
+                    switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+                    case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+                        fmt.Fprint(conn, "250 fake\r\n")
+                    case strings.HasPrefix(cmd, "DATA"):
+                        fmt.Fprint(conn, "354 go ahead\r\n")
+                        var body strings.Builder
+                        for {
+                            line, err := reader.ReadString('\n')
+                            if err != nil {
+                                return
+                            }
+                            if line == ".\r\n" {
+                                break
+                            }
+                            body.WriteString(line)
+                        }
+                        received <- body.String()
+                        fmt.Fprint(conn, "250 queued\r\n")
+                    case cmd == "QUIT":
+                        fmt.Fprint(conn, "221 bye\r\n")
+                        return
+                    default:
+                        fmt.Fprint(conn, "250 ok\r\n")
+                    }
+                }
+            }(conn)
+        }
+    }()
+    return listener.Addr().String()
+}
+
+func TestSendMail(t *testing.T) {
+    received := make(chan string, 1)
+    host, port, _ := net.SplitHostPort(fakeSMTPServer(t, received))
+    portNum, _ := strconv.Atoi(port)
+    cfg := EmailConfig{Host: host, Port: portNum, From: "diary@example.com", To: []string{"me@example.com"}}
+    if err := sendMail(cfg, buildMailMessage(cfg.From, cfg.To, "新留言", "你好")); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case body := <-received:
+        if !strings.Contains(body, "To: me@example.com") {
+            t.Errorf("邮件内容不完整: %q", body)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("SMTP 服务器没有收到邮件")
+    }
+}
+
+func TestSendMailTimesOutOnSilentServer(t *testing.T) {
+    old := smtpTimeout
+    smtpTimeout = 200 * time.Millisecond
+    t.Cleanup(func() { smtpTimeout = old })
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    // 接受连接但从不发送问候
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    }()
+    host, port, _ := net.SplitHostPort(listener.Addr().String())
+    portNum, _ := strconv.Atoi(port)
+    start := time.Now()
+    err = sendMail(EmailConfig{Host: host, Port: portNum, From: "a@example.com", To: []string{"b@example.com"}}, []byte("x"))
+    if err == nil {
+        t.Fatal("服务器无响应时应返回错误")
+    }
+    if elapsed := time.Since(start); elapsed > 2*time.Second {
+        t.Fatalf("等待了 %v 才超时", elapsed)
+    }
+}
+
+func TestNotifyCommentURLRequiresBaseURL(t *testing.T) {
+    withServerConfig(t, nil)
+    old := notifyQueue
+    notifyQueue = make(chan commentEvent, 1)
+    t.Cleanup(func() { notifyQueue = old })
+
+    notifyComment("nj", Comment{ID: 1, Nick: "小明", Text: "你好"})
+    if event := <-notifyQueue; event.URL != "" {
+        t.Errorf("未配置站点地址时不应生成相对链接: %q", event.URL)
+    }
+    serverConfig.Feed.BaseURL = "https://diary.example/"
+    notifyComment("nj", Comment{ID: 2, Nick: "小明", Text: "你好"})
+    if event := <-notifyQueue; !strings.HasPrefix(event.URL, "https://diary.example/") {
+        t.Errorf("留言链接错误: %q", event.URL)
+    }
+}
+
+func TestPasswordHashMatchesStoredFormat(t *testing.T) {
+    // 由独立实现算出，保证已保存的哈希在更换实现后仍然有效
+    account := &NickAccount{Salt: "0123456789abcdef", PasswordHash: "800ce32532b3c706d1b9e7175f5255e6206684c6b3bc3d3bc0ca604ca8cfd9ce"}
+    if !checkPassword(account, "correct horse") {
+        t.Fatal("正确的密码没有通过校验")
+    }
+    if checkPassword(account, "correct horse!") {
+        t.Fatal("错误的密码通过了校验")
+    }
+}
+
+func TestIdentityThrottled(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) { cfg.Identity.MaxAttemptsPerIP = 3 })
+    identitiesMutex.Lock()
+    identityAttempts = make(map[string][]time.Time)
+    identitiesMutex.Unlock()
+    for i := 0; i < 3; i++ {
+        if identityThrottled("10.0.0.1") {
+            t.Fatalf("第 %d 次请求被限制", i+1)
+        }
+    }
+    if !identityThrottled("10.0.0.1") {
+        t.Fatal("超过上限后没有限制")
+    }
+    if identityThrottled("10.0.0.2") {
+        t.Fatal("其他 IP 受到了影响")
+    }
+}
+
+// magicTokenFromMail 从收到的邮件中解出登录链接的令牌
+func magicTokenFromMail(t *testing.T, raw string) string {
+    t.Helper()
+    parts := strings.SplitN(raw, "\r\n\r\n", 2)
+    if len(parts) != 2 {
+        t.Fatalf("邮件格式错误: %q", raw)
+    }
+    text, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(parts[1], "\r\n", ""))
+    if err != nil {
+        t.Fatal(err)
+    }
+    const prefix = "https://diary.example/api/identity/verify?token="
+    i := strings.Index(string(text), prefix)
+    if i < 0 {
+        t.Fatalf("邮件中没有配置的站点地址: %s", text)
+    }
+    return strings.Fields(string(text)[i+len(prefix):])[0]
+}
+
+func TestEmailClaimIsPendingUntilConfirmed(t *testing.T) {
+    t.Chdir(t.TempDir())
+    received := make(chan string, 2)
+    host, port, _ := net.SplitHostPort(fakeSMTPServer(t, received))
+    portNum, _ := strconv.Atoi(port)
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Identity.Mailer = EmailConfig{Host: host, Port: portNum, From: "diary@example.com"}
+    })
+    identitiesMutex.Lock()
+    identities = identityStore{Secret: "test", Accounts: make(map[string]*NickAccount)}
+    magicLinks = make(map[string]*magicLink)
+    identitiesMutex.Unlock()
+
+    account := &NickAccount{Nick: "旅人", Email: "me@example.com", CreatedAt: time.Now()}
+    if err := sendMagicLink(account, true); err == nil {
+        t.Fatal("未配置站点地址时应拒绝发送登录链接")
+    }
+    serverConfig.Feed.BaseURL = "https://diary.example"
+    if err := sendMagicLink(account, true); err != nil {
+        t.Fatal(err)
+    }
+    token := magicTokenFromMail(t, <-received)
+
+    identitiesMutex.RLock()
+    _, claimed := identities.Accounts[normalizeNick("旅人")]
+    identitiesMutex.RUnlock()
+    if claimed {
+        t.Fatal("确认前就保存了账号")
+    }
+    confirmed := consumeMagicLink(token)
+    if confirmed == nil || !confirmed.EmailVerified {
+        t.Fatalf("确认链接无效: %+v", confirmed)
+    }
+    identitiesMutex.RLock()
+    _, claimed = identities.Accounts[normalizeNick("旅人")]
+    identitiesMutex.RUnlock()
+    if !claimed {
+        t.Fatal("确认后没有保存账号")
+    }
+    if consumeMagicLink(token) != nil {
+        t.Fatal("确认链接可以重复使用")
+    }
+
+    // 确认前昵称已被别人认领时，认领链接作废
+    other := &NickAccount{Nick: "旅人", Email: "evil@example.com", CreatedAt: time.Now()}
+    if err := sendMagicLink(other, true); err != nil {
+        t.Fatal(err)
+    }
+    if consumeMagicLink(magicTokenFromMail(t, <-received)) != nil {
+        t.Fatal("已认领的昵称被覆盖")
+    }
+}
+
+func TestMarkdownXSSPayloads(t *testing.T) {
+    diaryOptions := markdownOptions{AllowImages: true, AllowHeadings: true}
+    tests := []struct {
+        name  string
+        input string
+        opts  markdownOptions
+        // 输出中不允许出现的片段（忽略大小写）
+        banned []string
+    }{
+        {"javascript 链接", "[点我](javascript:alert(1))", commentMarkdownOptions, []string{"javascript:", "<a"}},
+        {"大小写混合协议", "[点我](JaVaScRiPt:alert(1))", commentMarkdownOptions, []string{"javascript:", "<a"}},
+        // 实体会被再次转义，浏览器只会把它当作相对地址
+        {"实体编码协议", "[点我](javascript&#58;alert(1))", commentMarkdownOptions, []string{"javascript:", `href="javascript&#58;`}},
+        {"data 图片", "![x](data:text/html;base64,PHNjcmlwdD4=)", diaryOptions, []string{"<img"}},
+        {"链接地址中的引号", `[点我](http://a.example/"onmouseover="alert(1))`, commentMarkdownOptions, []string{`"onmouseover`, `" onmouseover`}},
+        {"图片地址中的引号", `![x](http://a.example/"onerror="alert(1))`, diaryOptions, []string{`"onerror`}},
+        {"图片说明中的引号", `![x" onerror="alert(1)](http://a.example/1.jpg)`, diaryOptions, []string{`" onerror`}},
+        {"原始 script", "<script>alert(1)</script>", commentMarkdownOptions, []string{"<script"}},
+        {"img onerror", `<img src=x onerror=alert(1)>`, commentMarkdownOptions, []string{"<img"}},
+        {"日记中的原始 HTML", `<img src=x onerror=alert(1)><script>alert(1)</script>`, diaryOptions, []string{"<img", "<script"}},
+        {"svg onload", `<svg/onload=alert(1)>`, commentMarkdownOptions, []string{"<svg"}},
+        {"NUL 占位符注入图片说明", "![\x001\x00](http://a.example/1.jpg) [t](http://b.example/)", diaryOptions, []string{`alt="<a`, "\x00"}},
+        {"NUL 占位符注入链接文字", "[\x000\x00](http://b.example/) `x`", commentMarkdownOptions, []string{"\x00", "<a href=\"http://b.example/\" rel=\"nofollow ugc noopener noreferrer\"><code>"}},
+        {"NUL 拆分协议", "[点我](java\x00script:alert(1))", commentMarkdownOptions, []string{"javascript:", "\x00"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var got string
+            if tt.opts.LinkRel != "" {
+                got = renderCommentHTML(tt.input)
+            } else {
+                got = renderMarkdown(tt.input, tt.opts)
+            }
+            lower := strings.ToLower(got)
+            for _, b := range tt.banned {
+                if strings.Contains(lower, strings.ToLower(b)) {
+                    t.Errorf("输出包含 %q: %q", b, got)
+                }
+            }
+        })
+    }
+}
+
+// solveChallenge 领取挑战并求出满足难度的 nonce
+func solveChallenge(t *testing.T) (string, string, int) {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    serveCommentChallenge(rec, httptest.NewRequest(http.MethodGet, "/comments/challenge", nil))
+    if rec.Code != http.StatusOK {
+        t.Fatalf("领取挑战失败: %d", rec.Code)
+    }
+    var task struct {
+        Challenge  string `json:"challenge"`
+        Difficulty int    `json:"difficulty"`
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &task); err != nil {
+        t.Fatal(err)
+    }
+    for n := 0; ; n++ {
+        nonce := strconv.Itoa(n)
+        sum := sha256.Sum256([]byte(task.Challenge + ":" + nonce))
+        if leadingZeroBits(sum[:]) >= task.Difficulty {
+            return task.Challenge, nonce, task.Difficulty
+        }
+    }
+}
+
+func TestChallengeVerify(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Challenge.Difficulty = 8
+        cfg.Challenge.MaxDifficulty = 8
+    })
+
+    challenge, _, difficulty := solveChallenge(t)
+    for n := 0; ; n++ {
+        wrong := "x" + strconv.Itoa(n)
+        sum := sha256.Sum256([]byte(challenge + ":" + wrong))
+        if leadingZeroBits(sum[:]) < difficulty {
+            if err := verifyChallenge(challenge, wrong); err == nil {
+                t.Fatal("工作量不足的 nonce 通过了验证")
+            }
+            break
+        }
+    }
+    challenge, nonce, _ := solveChallenge(t)
+    if err := verifyChallenge(challenge, nonce); err != nil {
+        t.Fatalf("正确的解没有通过验证: %v", err)
+    }
+    if err := verifyChallenge(challenge, nonce); err == nil {
+        t.Fatal("同一个挑战可以重复使用")
+    }
+
+    challenge, nonce, _ = solveChallenge(t)
+    parts := strings.Split(challenge, ".")
+    parts[2] = "0"
+    if err := verifyChallenge(strings.Join(parts, "."), nonce); err == nil {
+        t.Fatal("篡改难度的挑战通过了验证")
+    }
+    if err := verifyChallenge("", ""); err == nil {
+        t.Fatal("缺少挑战时通过了验证")
+    }
+
+    // 签名正确但已过期
+    payload := fmt.Sprintf("v1.%d.0.%s", time.Now().Add(-time.Hour).Unix(), "00112233445566778899aabb")
+    expired := payload + "." + signChallenge(payload)
+    if err := verifyChallenge(expired, "0"); err == nil || !strings.Contains(err.Error(), "过期") {
+        t.Fatalf("过期的挑战没有被拒绝: %v", err)
+    }
+}
+
+func TestChallengeDifficultyAdapts(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Challenge.Difficulty = 4
+        cfg.Challenge.MaxDifficulty = 6
+        cfg.Challenge.StepComments = 2
+    })
+    challengeMutex.Lock()
+    commentAttempts = nil
+    challengeDifficulty = 0
+    challengeMutex.Unlock()
+
+    if d := currentChallengeDifficulty(); d != 4 {
+        t.Fatalf("初始难度 %d，期望 4", d)
+    }
+    for i := 0; i < 2; i++ {
+        recordCommentAttempt()
+    }
+    if _, _, d := solveChallenge(t); d != 5 {
+        t.Fatalf("两次提交后难度 %d，期望 5", d)
+    }
+    for i := 0; i < 10; i++ {
+        recordCommentAttempt()
+    }
+    if d := currentChallengeDifficulty(); d != 6 {
+        t.Fatalf("难度 %d 超过了上限 6", d)
+    }
+}
+
+func TestUnverifiedSubmissionsDoNotRaiseDifficulty(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Challenge.Enabled = true
+        cfg.Challenge.Difficulty = 4
+        cfg.Challenge.MaxDifficulty = 8
+        cfg.Challenge.StepComments = 1
+        cfg.Identity.Enabled = true
+    })
+    challengeMutex.Lock()
+    commentAttempts = nil
+    challengeDifficulty = 0
+    challengeMutex.Unlock()
+    commentsMutex.Lock()
+    savedComments := comments
+    comments = make(map[string][]Comment)
+    commentsMutex.Unlock()
+    t.Cleanup(func() {
+        commentsMutex.Lock()
+        comments = savedComments
+        commentsMutex.Unlock()
+        removeSearchDoc("comment:nj:1")
+    })
+
+    post := func(handler http.HandlerFunc, path string, body map[string]string) int {
+        data, _ := json.Marshal(body)
+        req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("Accept", "application/json")
+        req.RemoteAddr = "203.0.113.50:1234"
+        rec := httptest.NewRecorder()
+        handler(rec, req)
+        return rec.Code
+    }
+    challenge, _, _ := solveChallenge(t)
+    for i := 0; i < 3; i++ {
+        for _, body := range []map[string]string{
+            {"nick": "路人", "text": "你好"},
+            {"nick": "路人", "text": "你好", "challenge": challenge, "nonce": "not-a-solution"},
+        } {
+            if code := post(serveComments, "/comments/nj", body); code != http.StatusForbidden {
+                t.Fatalf("未通过验证的留言状态码 %d，期望 403", code)
+            }
+        }
+        if code := post(serveIdentity, "/api/identity/login", map[string]string{"nick": "路人", "password": "12345678"}); code != http.StatusForbidden {
+            t.Fatalf("未通过验证的登录状态码 %d，期望 403", code)
+        }
+    }
+    if d := currentChallengeDifficulty(); d != 4 {
+        t.Fatalf("未通过验证的提交把难度提高到了 %d", d)
+    }
+
+    challenge, nonce, _ := solveChallenge(t)
+    solved := map[string]string{"nick": "路人", "text": "你好", "challenge": challenge, "nonce": nonce}
+    if code := post(serveComments, "/comments/nj", solved); code != http.StatusOK {
+        t.Fatalf("通过验证的留言状态码 %d", code)
+    }
+    if code := post(serveComments, "/comments/nj", solved); code != http.StatusForbidden {
+        t.Fatalf("重复使用挑战的留言状态码 %d，期望 403", code)
+    }
+    if d := currentChallengeDifficulty(); d != 5 {
+        t.Fatalf("一次通过验证的提交后难度 %d，期望 5", d)
+    }
+}
+
+func TestChallengeUsedPrunedInOrder(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Challenge.Difficulty = 0
+        cfg.Challenge.MaxDifficulty = 0
+    })
+    past := time.Now().Add(-time.Minute)
+    challengeMutex.Lock()
+    challengeUsed = map[string]time.Time{"old-1": past, "old-2": past}
+    challengeUsedOrder = []usedChallenge{{key: "old-1", expires: past}, {key: "old-2", expires: past}}
+    challengeMutex.Unlock()
+
+    challenge, nonce, _ := solveChallenge(t)
+    if err := verifyChallenge(challenge, nonce); err != nil {
+        t.Fatal(err)
+    }
+    challengeMutex.Lock()
+    defer challengeMutex.Unlock()
+    if len(challengeUsed) != 1 || len(challengeUsedOrder) != 1 || challengeUsedOrder[0].key != challenge {
+        t.Fatalf("过期的挑战没有被清理: %v", challengeUsed)
+    }
+}
+
+func TestSecurityHeadersNonceAndOverrides(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.SecurityHeaders.UseNonce = true
+        cfg.SecurityHeaders.RouteOverrides = map[string]map[string]string{
+            "/api/": {"Content-Security-Policy": "default-src 'none'", "X-Frame-Options": ""},
+        }
+    })
+    page := filepath.Join(t.TempDir(), "page.html")
+    os.WriteFile(page, []byte(`<html><head><script src="/challenge.js"></script><SCRIPT type="module">run()</SCRIPT></head><body><script>go()</script></body></html>`), 0644)
+    handler := securityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        serveHTMLPage(w, r, page, cspNonce(r), nil)
+    }))
+
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page.html", nil))
+    csp := rec.Header().Get("Content-Security-Policy")
+    start := strings.Index(csp, "'nonce-")
+    if start < 0 {
+        t.Fatalf("CSP 中没有 nonce: %q", csp)
+    }
+    nonce := csp[start+len("'nonce-"):]
+    nonce = nonce[:strings.Index(nonce, "'")]
+    body := rec.Body.String()
+    if n := strings.Count(body, `nonce="`+nonce+`"`); n != 2 {
+        t.Errorf("内联脚本应带 nonce，实际 %d 个: %s", n, body)
+    }
+    if !strings.Contains(body, `<script src="/challenge.js">`) {
+        t.Errorf("外部脚本不应加 nonce: %s", body)
+    }
+    if rec.Header().Get("X-Frame-Options") == "" {
+        t.Errorf("默认策略缺少 X-Frame-Options")
+    }
+
+    // 两次请求的 nonce 不同
+    rec2 := httptest.NewRecorder()
+    handler.ServeHTTP(rec2, httptest.NewRequest(http.MethodGet, "/page.html", nil))
+    if rec2.Header().Get("Content-Security-Policy") == csp {
+        t.Errorf("nonce 没有按请求重新生成")
+    }
+
+    rec = httptest.NewRecorder()
+    handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/cities", nil))
+    if got := rec.Header().Get("Content-Security-Policy"); got != "default-src 'none'" {
+        t.Errorf("路由覆盖没有替换默认 CSP: %q", got)
+    }
+    if got := rec.Header().Get("X-Frame-Options"); got != "" {
+        t.Errorf("覆盖为空时应删除响应头，实际 %q", got)
+    }
+}
+
+func TestMediaRequestsUseSeparateRateLimit(t *testing.T) {
+    requestMutex.Lock()
+    requestCounts = make(map[string][]time.Time)
+    requestMutex.Unlock()
+    handler := accessControlMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    get := func(path string, header ...string) int {
+        req := httptest.NewRequest(http.MethodGet, path, nil)
+        req.RemoteAddr = "192.0.2.10:1234"
+        if len(header) == 2 {
+            req.Header.Set(header[0], header[1])
+        }
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, req)
+        return rec.Code
+    }
+    // 一个相册页面的缩略图不占用页面请求的额度
+    for i := 0; i < 100; i++ {
+        if code := get(fmt.Sprintf("/img/imgnj/%d.jpg?w=320", i)); code != http.StatusOK {
+            t.Fatalf("第 %d 张缩略图返回 %d", i+1, code)
+        }
+    }
+    if code := get("/music/nj/1", "Range", "bytes=0-"); code != http.StatusOK {
+        t.Fatalf("音乐分段请求返回 %d", code)
+    }
+    for i := 0; i < rateLimitPerMinute; i++ {
+        if code := get("/nj.html"); code != http.StatusOK {
+            t.Fatalf("第 %d 次页面请求返回 %d", i+1, code)
+        }
+    }
+    if code := get("/nj.html"); code != http.StatusTooManyRequests {
+        t.Fatalf("超过页面额度后返回 %d，期望 429", code)
+    }
+}
+
+func TestOriginAllowed(t *testing.T) {
+    allowed := []string{"https://diary.example", "http://localhost:9099/", "https://*.example.com"}
+    tests := []struct {
+        origin string
+        want   bool
+    }{
+        {"https://diary.example", true},
+        {"HTTPS://Diary.Example", true},
+        {"http://diary.example", false},
+        {"https://diary.example:8443", false},
+        {"http://localhost:9099", true},
+        {"http://localhost:3000", false},
+        {"https://a.example.com", true},
+        {"https://a.b.example.com", true},
+        {"https://example.com", false},
+        {"https://.example.com", false},
+        {"http://a.example.com", false},
+        {"https://a.example.com:8443", false},
+        {"https://evilexample.com", false},
+        {"https://a.example.com.evil.net", false},
+        {"https://user@a.example.com", false},
+        {"https://evil.net/.example.com", false},
+        {"null", false},
+        {"", false},
+    }
+    for _, tt := range tests {
+        if got := originAllowed(allowed, tt.origin); got != tt.want {
+            t.Errorf("originAllowed(%q) = %v，期望 %v", tt.origin, got, tt.want)
+        }
+    }
+    if !originAllowed([]string{"*"}, "https://any.example") {
+        t.Errorf("* 应允许任意来源")
+    }
+}
+
+func TestCORSPreflight(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.CORS.AllowedOrigins = []string{"https://diary.example"}
+        cfg.CORS.AllowCredentials = true
+    })
+    handler := corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusOK)
+    }))
+    tests := []struct {
+        name       string
+        method     string
+        path       string
+        origin     string
+        reqMethod  string
+        reqHeaders string
+        wantCode   int
+        wantACAO   string
+    }{
+        {"允许的预检", http.MethodOptions, "/comments/nj", "https://diary.example", "POST", "Content-Type", http.StatusNoContent, "https://diary.example"},
+        {"来源不在列表中", http.MethodOptions, "/comments/nj", "https://evil.example", "POST", "", http.StatusForbidden, ""},
+        {"方法不允许", http.MethodOptions, "/comments/nj", "https://diary.example", "DELETE", "", http.StatusForbidden, ""},
+        {"请求头不允许", http.MethodOptions, "/comments/nj", "https://diary.example", "POST", "X-Admin-Token", http.StatusForbidden, ""},
+        {"简单请求", http.MethodGet, "/comments/nj", "https://diary.example", "", "", http.StatusOK, "https://diary.example"},
+        {"简单请求来源不允许", http.MethodGet, "/comments/nj", "https://evil.example", "", "", http.StatusOK, ""},
+        {"不在跨域路由中", http.MethodGet, "/admin/stats", "https://diary.example", "", "", http.StatusOK, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(tt.method, tt.path, nil)
+            req.Header.Set("Origin", tt.origin)
+            if tt.reqMethod != "" {
+                req.Header.Set("Access-Control-Request-Method", tt.reqMethod)
+            }
+            if tt.reqHeaders != "" {
+                req.Header.Set("Access-Control-Request-Headers", tt.reqHeaders)
+            }
+            rec := httptest.NewRecorder()
+            handler.ServeHTTP(rec, req)
+            if rec.Code != tt.wantCode {
+                t.Errorf("状态码 %d，期望 %d", rec.Code, tt.wantCode)
+            }
+            if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantACAO {
+                t.Errorf("Access-Control-Allow-Origin = %q，期望 %q", got, tt.wantACAO)
+            }
+            if tt.wantACAO == "" && rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+                t.Errorf("拒绝时不应返回 Access-Control-Allow-Credentials")
+            }
+            if tt.wantCode == http.StatusNoContent && rec.Header().Get("Access-Control-Max-Age") != "600" {
+                t.Errorf("预检缺少 Access-Control-Max-Age")
+            }
+        })
+    }
+}
+
+func TestStaticServeAllowed(t *testing.T) {
+    withServerConfig(t, nil)
+    root, _ := filepath.EvalSymlinks(t.TempDir())
+    files := []string{"homepage.html", "style.css", "notes.txt", "data.json", "imgnj/1.jpg", "imgnj/raw.psd", "private/a.html", "bgm/nj.mp3"}
+    for _, f := range files {
+        os.MkdirAll(filepath.Join(root, filepath.Dir(f)), 0755)
+        os.WriteFile(filepath.Join(root, f), []byte("x"), 0644)
+    }
+    tests := []struct {
+        path string
+        want bool
+    }{
+        {"homepage.html", true},
+        {"style.css", true},
+        {"notes.txt", true},
+        {"data.json", false},
+        {"imgnj/1.jpg", true},
+        {"imgnj/raw.psd", false},
+        {"private/a.html", false},
+        {"bgm/nj.mp3", true},
+        {"imgnj", false},
+        {"missing.html", false},
+    }
+    for _, tt := range tests {
+        if got := staticServeAllowed(root, filepath.Join(root, tt.path)); got != tt.want {
+            t.Errorf("staticServeAllowed(%s) = %v，期望 %v", tt.path, got, tt.want)
+        }
+    }
+    serverConfig.Static.DirectoryListing = true
+    if !staticServeAllowed(root, filepath.Join(root, "imgnj")) {
+        t.Errorf("开启目录列表后目录应可访问")
+    }
+}
+
+func TestAuditStaticDirReportsSensitiveFiles(t *testing.T) {
+    withServerConfig(t, nil)
+    root := t.TempDir()
+    for _, f := range []string{".env", "comments.json", "node_modules/x.js", "homepage.html", "private/a.html"} {
+        os.MkdirAll(filepath.Join(root, filepath.Dir(f)), 0755)
+        os.WriteFile(filepath.Join(root, f), []byte("x"), 0644)
+    }
+    var buf bytes.Buffer
+    log.SetOutput(&buf)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    auditStaticDir(root)
+    out := buf.String()
+    for _, name := range []string{".env", "comments.json", "node_modules"} {
+        if !strings.Contains(out, "敏感文件（已拒绝访问，建议移出）: "+name) {
+            t.Errorf("审计没有报告 %s:\n%s", name, out)
+        }
+    }
+    if strings.Contains(out, "homepage.html") || strings.Contains(out, "x.js") {
+        t.Errorf("审计报告了不该报告的文件:\n%s", out)
+    }
+    if !strings.Contains(out, "有 1 个文件不在允许列表中") {
+        t.Errorf("审计没有统计不对外提供的文件:\n%s", out)
+    }
+}
+
+func TestPreferredLanguage(t *testing.T) {
+    tests := []struct {
+        header string
+        want   string
+    }{
+        {"", "zh"},
+        {"en", "en"},
+        {"en-US,en;q=0.9", "en"},
+        {"zh-CN,zh;q=0.9,en;q=0.8", "zh"},
+        {"en;q=0.5,zh-TW;q=0.8", "zh"},
+        {"fr-FR,en;q=0.3", "en"},
+        {"fr-FR,de", "zh"},
+        {"EN-gb", "en"},
+    }
+    for _, tt := range tests {
+        if got := preferredLanguage(tt.header); got != tt.want {
+            t.Errorf("preferredLanguage(%q) = %q，期望 %q", tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestWriteErrorFormats(t *testing.T) {
+    tests := []struct {
+        name        string
+        path        string
+        lang        string
+        status      int
+        detail      string
+        contentType string
+        contains    []string
+        excludes    []string
+    }{
+        {"页面 404 中文", "/nope.html", "zh-CN", http.StatusNotFound, "", "text/html", []string{"页面未找到", "/nope.html", `lang="zh"`}, nil},
+        {"页面 404 英文", "/nope.html", "en-US", http.StatusNotFound, "", "text/html", []string{"Not Found", `lang="en"`}, []string{"页面未找到"}},
+        {"页面中转义路径", "/<script>.html", "", http.StatusNotFound, "", "text/html", []string{"&lt;script&gt;"}, []string{"<script>.html"}},
+        {"英文页面不显示中文详情", "/x", "en", http.StatusForbidden, "访问被拒绝了", "text/html", nil, []string{"访问被拒绝了"}},
+        {"API 返回 JSON", "/api/cities", "zh", http.StatusBadRequest, "昵称不能为空", "application/json", []string{`"status":400`, `"error":"请求有误"`, `"message":"昵称不能为空"`}, nil},
+        {"留言接口返回 JSON", "/comments/nj", "en", http.StatusTooManyRequests, "", "application/json", []string{`"status":429`}, []string{"message"}},
+        {"管理接口返回 JSON", "/admin/stats", "", http.StatusUnauthorized, "未授权", "application/json", []string{`"error":"未授权"`}, []string{"message"}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.path, nil)
+            req.URL.Path = tt.path
+            req.Header.Set("Accept-Language", tt.lang)
+            rec := httptest.NewRecorder()
+            rec.Header().Set("Content-Length", "123")
+            writeError(rec, req, tt.status, tt.detail)
+            if rec.Code != tt.status {
+                t.Errorf("状态码 %d，期望 %d", rec.Code, tt.status)
+            }
+            if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+                t.Errorf("Content-Type = %q，期望 %s", ct, tt.contentType)
+            }
+            if rec.Header().Get("Content-Length") != "" {
+                t.Errorf("应删除之前设置的 Content-Length")
+            }
+            body := rec.Body.String()
+            for _, s := range tt.contains {
+                if !strings.Contains(body, s) {
+                    t.Errorf("响应缺少 %q: %s", s, body)
+                }
+            }
+            for _, s := range tt.excludes {
+                if strings.Contains(body, s) {
+                    t.Errorf("响应不应包含 %q: %s", s, body)
+                }
+            }
+        })
+    }
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+    tests := []struct {
+        header, encoding string
+        want             bool
+    }{
+        {"gzip, deflate, br", "br", true},
+        {"gzip, deflate, br", "gzip", true},
+        {"gzip;q=0", "gzip", false},
+        {"br;q=0, *", "br", false},
+        {"*", "gzip", true},
+        {"*;q=0", "gzip", false},
+        {"GZIP", "gzip", true},
+        {"identity", "gzip", false},
+        {"", "gzip", false},
+    }
+    for _, tt := range tests {
+        if got := acceptsEncoding(tt.header, tt.encoding); got != tt.want {
+            t.Errorf("acceptsEncoding(%q, %q) = %v，期望 %v", tt.header, tt.encoding, got, tt.want)
+        }
+    }
+}
+
+func TestServeCompressedStatic(t *testing.T) {
+    withServerConfig(t, nil)
+    dir := t.TempDir()
+    css := filepath.Join(dir, "style.css")
+    content := strings.Repeat("body { color: #333; }\n", 200)
+    os.WriteFile(css, []byte(content), 0644)
+    os.WriteFile(css+".br", []byte("brotli-bytes"), 0644)
+    os.WriteFile(filepath.Join(dir, "small.css"), []byte("a{}"), 0644)
+    os.WriteFile(filepath.Join(dir, "photo.jpg"), bytes.Repeat([]byte{0xff}, 4096), 0644)
+    // 预压缩文件比原文件旧时视为过期
+    stale := filepath.Join(dir, "app.js")
+    os.WriteFile(stale, []byte(strings.Repeat("console.log(1);\n", 200)), 0644)
+    os.WriteFile(stale+".br", []byte("old"), 0644)
+    old := time.Now().Add(-time.Hour)
+    os.Chtimes(stale+".br", old, old)
+
+    serve := func(file, acceptEncoding string) (*httptest.ResponseRecorder, bool) {
+        req := httptest.NewRequest(http.MethodGet, "/"+filepath.Base(file), nil)
+        req.Header.Set("Accept-Encoding", acceptEncoding)
+        rec := httptest.NewRecorder()
+        rec.Header().Set("ETag", `"abc"`)
+        return rec, serveCompressedStatic(rec, req, file)
+    }
+
+    rec, ok := serve(css, "gzip, br")
+    if !ok || rec.Header().Get("Content-Encoding") != "br" || rec.Body.String() != "brotli-bytes" {
+        t.Errorf("应使用预压缩的 .br 文件: %v %q %q", ok, rec.Header().Get("Content-Encoding"), rec.Body.String())
+    }
+    if rec.Header().Get("ETag") != `"abc-br"` || !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+        t.Errorf("压缩响应的 ETag/Vary 错误: %v", rec.Header())
+    }
+
+    rec, ok = serve(css, "gzip")
+    if !ok || rec.Header().Get("Content-Encoding") != "gzip" {
+        t.Fatalf("只接受 gzip 时应实时压缩: %v %v", ok, rec.Header())
+    }
+    zr, err := gzip.NewReader(rec.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    plain, _ := io.ReadAll(zr)
+    if string(plain) != content {
+        t.Errorf("gzip 解压后内容不一致")
+    }
+    if rec.Header().Get("ETag") != `"abc-gzip"` {
+        t.Errorf("gzip 响应的 ETag 错误: %q", rec.Header().Get("ETag"))
+    }
+
+    if rec, ok = serve(stale, "br, gzip"); !ok || rec.Header().Get("Content-Encoding") != "gzip" {
+        t.Errorf("过期的预压缩文件不应使用: %v %q", ok, rec.Header().Get("Content-Encoding"))
+    }
+    if _, ok = serve(css, "identity"); ok {
+        t.Errorf("不接受压缩时应交给文件服务器")
+    }
+    if _, ok = serve(filepath.Join(dir, "small.css"), "gzip"); ok {
+        t.Errorf("小于 MinSize 的文件不应压缩")
+    }
+    if _, ok = serve(filepath.Join(dir, "photo.jpg"), "gzip"); ok {
+        t.Errorf("JPEG 不应压缩")
+    }
+    serverConfig.Compression.Precompressed = false
+    if rec, ok = serve(css, "br, gzip"); !ok || rec.Header().Get("Content-Encoding") != "gzip" {
+        t.Errorf("关闭预压缩后应实时 gzip: %q", rec.Header().Get("Content-Encoding"))
+    }
+}
+
+func TestContentHashETagAndRevalidation(t *testing.T) {
+    withServerConfig(t, nil)
+    dir := t.TempDir()
+    asset := filepath.Join(dir, "app.js")
+    os.WriteFile(asset, []byte("console.log('v1')"), 0644)
+    page := filepath.Join(dir, "index.html")
+    os.WriteFile(page, []byte("<p>hi</p>"), 0644)
+
+    serve := func(filePath string, fingerprinted bool, ifNoneMatch string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, "/"+filepath.Base(filePath), nil)
+        if ifNoneMatch != "" {
+            req.Header.Set("If-None-Match", ifNoneMatch)
+        }
+        rec := httptest.NewRecorder()
+        setCacheHeaders(rec, req, filePath, fingerprinted)
+        f, _ := os.Open(filePath)
+        defer f.Close()
+        info, _ := f.Stat()
+        http.ServeContent(rec, req, filePath, info.ModTime(), f)
+        return rec
+    }
+
+    rec := serve(asset, false, "")
+    etag := rec.Header().Get("ETag")
+    sum := sha256.Sum256([]byte("console.log('v1')"))
+    if etag != `"`+hex.EncodeToString(sum[:])[:16]+`"` {
+        t.Fatalf("ETag 不是内容哈希: %q", etag)
+    }
+    if cc := rec.Header().Get("Cache-Control"); strings.Contains(cc, "immutable") {
+        t.Errorf("未带指纹的资源不应 immutable: %q", cc)
+    }
+    if rec := serve(asset, false, etag); rec.Code != http.StatusNotModified {
+        t.Errorf("ETag 匹配时应返回 304，实际 %d", rec.Code)
+    }
+    if rec := serve(asset, true, ""); !strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+        t.Errorf("哈希匹配的指纹地址应 immutable: %q", rec.Header().Get("Cache-Control"))
+    }
+
+    // 内容变化后 ETag 随之变化，旧 ETag 不再命中
+    later := time.Now().Add(time.Second)
+    os.WriteFile(asset, []byte("console.log('v2')"), 0644)
+    os.Chtimes(asset, later, later)
+    rec = serve(asset, false, etag)
+    if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+        t.Errorf("文件修改后仍返回旧 ETag: %d %q", rec.Code, rec.Header().Get("ETag"))
+    }
+
+    rec = serve(page, false, "")
+    if cc := rec.Header().Get("Cache-Control"); cc != serverConfig.Cache.HTMLCacheControl {
+        t.Errorf("HTML 的 Cache-Control = %q，期望 %q", cc, serverConfig.Cache.HTMLCacheControl)
+    }
+    if rec := serve(page, false, rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+        t.Errorf("HTML 重新验证应返回 304，实际 %d", rec.Code)
+    }
+}
+
+func TestFingerprintURLRoundTrip(t *testing.T) {
+    u := fingerprintURL("/imgnj/1.jpg", "0123456789abcdef")
+    if u != "/static/0123456789abcdef/imgnj/1.jpg" {
+        t.Fatalf("fingerprintURL = %q", u)
+    }
+    hash, p := splitFingerprintPath(u)
+    if hash != "0123456789abcdef" || p != "/imgnj/1.jpg" {
+        t.Errorf("splitFingerprintPath = %q, %q", hash, p)
+    }
+    if hash, p := splitFingerprintPath("/static/onlyhash"); hash != "" || p != "/onlyhash" {
+        t.Errorf("没有路径时 = %q, %q", hash, p)
+    }
+}
+
+// writeTestPNG 写入指定尺寸的 PNG 图片
+func writeTestPNG(t *testing.T, path string, w, h int) {
+    t.Helper()
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+        t.Fatal(err)
+    }
+    os.MkdirAll(filepath.Dir(path), 0755)
+    if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestGalleryManifestBuildAndRefresh(t *testing.T) {
+    withServerConfig(t, nil)
+    root, _ := filepath.EvalSymlinks(t.TempDir())
+    writeTestPNG(t, filepath.Join(root, "imgnj", "10.png"), 40, 30)
+    writeTestPNG(t, filepath.Join(root, "imgnj", "2.png"), 20, 10)
+    os.WriteFile(filepath.Join(root, "imgnj", "2.txt"), []byte(" 夫子庙 \n"), 0644)
+    os.WriteFile(filepath.Join(root, "imgnj", "raw.psd"), []byte("x"), 0644)
+    writeTestPNG(t, filepath.Join(root, "imgzjj", "1.png"), 8, 8)
+    os.MkdirAll(filepath.Join(root, "css"), 0755)
+    galleriesMutex.Lock()
+    galleries = make(map[string]*GalleryManifest)
+    galleriesMutex.Unlock()
+
+    if !refreshGalleries(root) {
+        t.Fatal("首次扫描应有变化")
+    }
+    galleriesMutex.RLock()
+    nj, zjj, css := galleries["nj"], galleries["zjj"], galleries["css"]
+    galleriesMutex.RUnlock()
+    if nj == nil || zjj == nil || css != nil {
+        t.Fatalf("相册目录识别错误: nj=%v zjj=%v css=%v", nj != nil, zjj != nil, css != nil)
+    }
+    var files []string
+    for _, item := range nj.Items {
+        files = append(files, item.File)
+    }
+    if fmt.Sprint(files) != "[imgnj/2.png imgnj/10.png]" {
+        t.Fatalf("相册内容或排序错误: %v", files)
+    }
+    first := nj.Items[0]
+    if first.URL != "/imgnj/2.png" || first.Thumb != "/img/imgnj/2.png?w=320" || first.Caption != "夫子庙" || first.Width != 20 || first.Height != 10 {
+        t.Errorf("相册条目错误: %+v", first)
+    }
+
+    if refreshGalleries(root) {
+        t.Error("目录没有变化时不应重建")
+    }
+    writeTestPNG(t, filepath.Join(root, "imgnj", "3.png"), 4, 4)
+    if !refreshGalleries(root) {
+        t.Fatal("新增图片后应重建清单")
+    }
+    galleriesMutex.RLock()
+    if n := len(galleries["nj"].Items); n != 3 {
+        t.Errorf("新增图片后有 %d 张，期望 3 张", n)
+    }
+    if galleries["zjj"] != zjj {
+        t.Errorf("未变化的相册不应重建")
+    }
+    galleriesMutex.RUnlock()
+
+    os.RemoveAll(filepath.Join(root, "imgzjj"))
+    if !refreshGalleries(root) {
+        t.Fatal("删除相册目录后应有变化")
+    }
+    galleriesMutex.RLock()
+    _, ok := galleries["zjj"]
+    galleriesMutex.RUnlock()
+    if ok {
+        t.Error("删除的相册目录仍在清单中")
+    }
+}
+
+// logSignal 转发日志，出现指定内容时发出通知，用于等待后台任务结束
+type logSignal struct {
+    marker string
+    ch     chan struct{}
+}
+
+func (s logSignal) Write(p []byte) (int, error) {
+    if bytes.Contains(p, []byte(s.marker)) {
+        select {
+        case s.ch <- struct{}{}:
+        default:
+        }
+    }
+    return os.Stderr.Write(p)
+}
+
+func TestAdminUpload(t *testing.T) {
+    root, _ := filepath.EvalSymlinks(t.TempDir())
+    audit := filepath.Join(t.TempDir(), "audit.log")
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Admin.Tokens = map[string]string{"alice": "tok123"}
+        cfg.Upload.AuditLogFile = audit
+        cfg.Upload.MaxFileBytes = 64 << 10
+        cfg.Upload.MaxPixels = 1000 * 1000
+        cfg.Upload.MaxFiles = 5
+        cfg.Images.CacheDir = t.TempDir()
+    })
+    // 缩略图并发槽位在 main 中按配置创建
+    slots := imageResizeSlots
+    imageResizeSlots = make(chan struct{}, 1)
+    t.Cleanup(func() { imageResizeSlots = slots })
+    // 上传成功后在后台刷新相册和照片索引，修改配置前要等它结束
+    indexed := logSignal{marker: "照片索引已更新", ch: make(chan struct{}, 1)}
+    log.SetOutput(indexed)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    dir := cityImageDirs()["nj"]
+    os.MkdirAll(filepath.Join(root, dir), 0755)
+
+    encode := func(img image.Image, format string) []byte {
+        var buf bytes.Buffer
+        if format == "jpeg" {
+            jpeg.Encode(&buf, img, nil)
+        } else {
+            png.Encode(&buf, img)
+        }
+        return buf.Bytes()
+    }
+    small := image.NewRGBA(image.Rect(0, 0, 16, 16))
+    noisy := image.NewRGBA(image.Rect(0, 0, 256, 256))
+    seed := uint32(1)
+    for i := range noisy.Pix {
+        seed = seed*1664525 + 1013904223
+        noisy.Pix[i] = byte(seed >> 24)
+    }
+    var gif bytes.Buffer
+    gif.WriteString("GIF89a")
+    gif.Write(make([]byte, 32))
+
+    type file struct {
+        name string
+        data []byte
+    }
+    upload := func(token, method, city string, files ...file) *httptest.ResponseRecorder {
+        var body bytes.Buffer
+        mw := multipart.NewWriter(&body)
+        mw.WriteField("note", "ignored")
+        for _, f := range files {
+            part, _ := mw.CreateFormFile("photo", f.name)
+            part.Write(f.data)
+        }
+        mw.Close()
+        req := httptest.NewRequest(method, "/admin/upload/"+city, &body)
+        req.Header.Set("Content-Type", mw.FormDataContentType())
+        if token != "" {
+            req.Header.Set("X-Admin-Token", token)
+        }
+        rec := httptest.NewRecorder()
+        serveAdminUpload(rec, req, root)
+        return rec
+    }
+
+    if rec := upload("", http.MethodPost, "nj"); rec.Code != http.StatusUnauthorized {
+        t.Errorf("没有令牌时返回 %d", rec.Code)
+    }
+    if rec := upload("wrong", http.MethodPost, "nj"); rec.Code != http.StatusUnauthorized {
+        t.Errorf("令牌错误时返回 %d", rec.Code)
+    }
+    if rec := upload("tok123", http.MethodGet, "nj"); rec.Code != http.StatusMethodNotAllowed {
+        t.Errorf("GET 返回 %d", rec.Code)
+    }
+    if rec := upload("tok123", http.MethodPost, "atlantis"); rec.Code != http.StatusNotFound {
+        t.Errorf("未知城市返回 %d", rec.Code)
+    }
+
+    rec := upload("tok123", http.MethodPost, "nj",
+        file{"a.png", encode(small, "png")},
+        // 扩展名和声明的类型都不可信，按内容识别
+        file{"b.png", encode(small, "jpeg")},
+        file{"evil.jpg", []byte("<?php system($_GET['c']); ?>")},
+        file{"anim.gif", gif.Bytes()},
+        file{"huge.png", encode(noisy, "png")},
+    )
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("上传返回 %d: %s", rec.Code, rec.Body.String())
+    }
+    select {
+    case <-indexed.ch:
+    case <-time.After(5 * time.Second):
+        t.Fatal("上传后没有刷新照片索引")
+    }
+    var resp struct {
+        Saved   int `json:"saved"`
+        Results []struct {
+            OriginalName string `json:"original_name"`
+            File         string `json:"file"`
+            Error        string `json:"error"`
+        } `json:"results"`
+    }
+    json.Unmarshal(rec.Body.Bytes(), &resp)
+    want := []struct{ file, err string }{
+        {dir + "/1.png", ""},
+        {dir + "/2.jpg", ""},
+        {"", "只支持 JPEG 和 PNG 图片"},
+        {"", "只支持 JPEG 和 PNG 图片"},
+        {"", "文件超过"},
+    }
+    if resp.Saved != 2 || len(resp.Results) != len(want) {
+        t.Fatalf("上传结果错误: %s", rec.Body.String())
+    }
+    for i, w := range want {
+        got := resp.Results[i]
+        if got.File != w.file || !strings.HasPrefix(got.Error, w.err) || (w.err == "") != (got.Error == "") {
+            t.Errorf("%s: file=%q error=%q，期望 file=%q error 以 %q 开头", got.OriginalName, got.File, got.Error, w.file, w.err)
+        }
+    }
+    if _, err := os.Stat(filepath.Join(root, dir, "2.jpg")); err != nil {
+        t.Errorf("按内容识别的 JPEG 没有保存为 .jpg: %v", err)
+    }
+
+    data, err := os.ReadFile(audit)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("审计日志有 %d 条，期望 2 条:\n%s", len(lines), data)
+    }
+    var entry UploadAuditEntry
+    json.Unmarshal([]byte(lines[0]), &entry)
+    if entry.Uploader != "alice" || entry.OriginalName != "a.png" || entry.City != "nj" || entry.File != dir+"/1.png" || len(entry.SHA256) != 64 {
+        t.Errorf("审计记录不完整: %+v", entry)
+    }
+
+    // 像素数超过上限
+    serverConfig.Upload.MaxPixels = 100
+    if rec := upload("tok123", http.MethodPost, "nj", file{"big.png", encode(small, "png")}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "图片尺寸超出限制") {
+        t.Errorf("超出像素上限时返回 %d: %s", rec.Code, rec.Body.String())
+    }
+}
+
+func TestAdminRoutesDisabledWithoutToken(t *testing.T) {
+    withServerConfig(t, nil)
+    if adminEnabled() || len(serverConfig.Admin.Tokens) != 0 {
+        t.Fatal("默认配置不应包含管理员令牌")
+    }
+    next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    })
+    handler := accessControlMiddleware(next)
+    do := func(path string) int {
+        req := httptest.NewRequest(http.MethodGet, path, nil)
+        req.RemoteAddr = "203.0.113.39:1234"
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, req)
+        return rec.Code
+    }
+    for _, path := range []string{"/admin/stats", "/admin/diaries", "/admin/comments/nj"} {
+        if code := do(path); code != http.StatusNotFound {
+            t.Errorf("未配置令牌时 %s 状态码 %d，期望 404", path, code)
+        }
+    }
+    if code := do("/comments/nj"); code != http.StatusNoContent {
+        t.Errorf("非管理接口不应受影响，状态码 %d", code)
+    }
+
+    serverConfig.Admin.Tokens = map[string]string{"alice": ""}
+    if code := do("/admin/stats"); code != http.StatusNotFound {
+        t.Errorf("空令牌不应启用管理接口，状态码 %d", code)
+    }
+    serverConfig.Admin.Tokens = map[string]string{"alice": "tok123"}
+    if code := do("/admin/stats"); code != http.StatusNoContent {
+        t.Errorf("配置令牌后状态码 %d，期望放行", code)
+    }
+}
+
+func TestRenderMarkdown(t *testing.T) {
+    diaryOptions := markdownOptions{AllowImages: true, AllowHeadings: true}
+    tests := []struct {
+        name  string
+        input string
+        opts  markdownOptions
+        want  string
+    }{
+        {"标题和段落", "# 标题\n正文", diaryOptions, "<h1>标题</h1>\n<p>正文</p>\n"},
+        {"不允许标题", "# 标题\n正文", markdownOptions{}, "<p># 标题<br>\n正文</p>\n"},
+        {"Windows 换行", "a\r\nb", markdownOptions{}, "<p>a<br>\nb</p>\n"},
+        {"分隔线", "a\n---\nb", markdownOptions{}, "<p>a</p>\n<hr>\n<p>b</p>\n"},
+        {"引用", "> 引用 *斜体*", markdownOptions{}, "<blockquote>引用 <em>斜体</em></blockquote>\n"},
+        {"列表", "- a\n- b\n\n1. x\n2) y", markdownOptions{}, "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>x</li>\n<li>y</li>\n</ol>\n"},
+        {"列表类型切换", "- a\n1. b", markdownOptions{}, "<ul>\n<li>a</li>\n</ul>\n<ol>\n<li>b</li>\n</ol>\n"},
+        {"代码块不解析", "```\n<b>x</b>\n  **y**\n```", markdownOptions{}, "<pre><code>&lt;b&gt;x&lt;/b&gt;\n  **y**</code></pre>\n"},
+        {"未闭合代码块", "```\na", markdownOptions{}, "<pre><code>a</code></pre>\n"},
+        {"行内语法", "**粗** 和 `a*b*c` 与 [链接](https://a.example/?x=1&y=2)", markdownOptions{}, `<p><strong>粗</strong> 和 <code>a*b*c</code> 与 <a href="https://a.example/?x=1&amp;y=2">链接</a></p>` + "\n"},
+        {"相对链接", "[南京](/city/nj)", markdownOptions{}, `<p><a href="/city/nj">南京</a></p>` + "\n"},
+        {"日记图片", "![猫](imgnj/1.jpg)", diaryOptions, `<p><img src="imgnj/1.jpg" alt="猫" loading="lazy"></p>` + "\n"},
+        {"不允许图片时保留说明", "![猫](imgnj/1.jpg)", markdownOptions{}, "<p>猫</p>\n"},
+        {"留言链接", "[a](https://b.example/)", commentMarkdownOptions, `<p><a href="https://b.example/" rel="nofollow ugc noopener noreferrer">a</a></p>` + "\n"},
+        {"emoji 短代码", "太棒了 :tada: :unknown:", commentMarkdownOptions, "<p>太棒了 🎉 :unknown:</p>\n"},
+        {"日记不替换 emoji", "太棒了 :tada:", diaryOptions, "<p>太棒了 :tada:</p>\n"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := renderMarkdown(tt.input, tt.opts); got != tt.want {
+                t.Errorf("输出 %q，期望 %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestParseFrontMatter(t *testing.T) {
+    tests := []struct {
+        name       string
+        input      string
+        wantFields map[string]string
+        wantBody   string
+    }{
+        {"没有头部", "正文\n", map[string]string{}, "正文\n"},
+        {"基本字段", "---\ntitle: \"南京之旅\"\nStart: 2024-05-01\ncover: 'a.jpg'\n---\n正文\n",
+            map[string]string{"title": "南京之旅", "start": "2024-05-01", "cover": "a.jpg"}, "正文\n"},
+        {"BOM 和 Windows 换行", "\ufeff---\r\ntitle: x\r\n---\r\n正文", map[string]string{"title": "x"}, "正文"},
+        {"值中的冒号", "---\nmusic: a: b.mp3\n---\n", map[string]string{"music": "a: b.mp3"}, ""},
+        {"忽略没有冒号的行", "---\n随便写写\nend: 2024-05-03\n---\n正文", map[string]string{"end": "2024-05-03"}, "正文"},
+        {"未闭合的头部", "---\ntitle: x\n正文", map[string]string{}, "---\ntitle: x\n正文"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fields, body := parseFrontMatter(tt.input)
+            if body != tt.wantBody {
+                t.Errorf("正文 %q，期望 %q", body, tt.wantBody)
+            }
+            if len(fields) != len(tt.wantFields) {
+                t.Errorf("字段 %v，期望 %v", fields, tt.wantFields)
+            }
+            for k, v := range tt.wantFields {
+                if fields[k] != v {
+                    t.Errorf("字段 %s = %q，期望 %q", k, fields[k], v)
+                }
+            }
+        })
+    }
+}
+
+func TestCityPageCache(t *testing.T) {
+    dir := t.TempDir()
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Render.DiaryDir = dir
+        cfg.Render.LayoutFile = ""
+    })
+    renderedPagesMutex.Lock()
+    renderedPages = make(map[string]*renderedPage)
+    renderedPagesMutex.Unlock()
+    diariesMutex.Lock()
+    savedDiaries := diaries
+    diaries = diaryStore{NextID: 1, Revisions: make(map[int][]DiaryRevision)}
+    diariesMutex.Unlock()
+    t.Cleanup(func() {
+        diariesMutex.Lock()
+        diaries = savedDiaries
+        diariesMutex.Unlock()
+    })
+
+    diaryFile := filepath.Join(dir, "nj.md")
+    os.WriteFile(diaryFile, []byte("---\ntitle: 金陵\n---\n第一天\n"), 0644)
+    mod := time.Now().Add(-time.Hour)
+    os.Chtimes(diaryFile, mod, mod)
+
+    page, err := cityPage("nj")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Contains(page.html, []byte("金陵")) || !bytes.Contains(page.html, []byte(`href="/city/gz"`)) {
+        t.Fatalf("页面缺少标题或导航链接")
+    }
+    if again, _ := cityPage("nj"); again != page {
+        t.Fatal("内容没有变化时应使用缓存")
+    }
+
+    // 路由前缀会改变导航链接，必须参与缓存键
+    serverConfig.Render.RoutePrefix = "/trip/"
+    prefixed, err := cityPage("nj")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if prefixed.key == page.key {
+        t.Fatal("路由前缀变化后缓存键没有变化")
+    }
+    if !bytes.Contains(prefixed.html, []byte(`href="/trip/gz"`)) || bytes.Contains(prefixed.html, []byte(`href="/city/`)) {
+        t.Fatal("导航链接没有使用配置的路由前缀")
+    }
+
+    mod = mod.Add(time.Minute)
+    os.Chtimes(diaryFile, mod, mod)
+    edited, _ := cityPage("nj")
+    if edited.key == prefixed.key {
+        t.Fatal("日记文件修改后缓存键没有变化")
+    }
+
+    diariesMutex.Lock()
+    diaries.Entries = append(diaries.Entries, &DiaryEntry{ID: 1, City: "nj", Title: "夫子庙", Body: "夜游秦淮河", Status: "published", UpdatedAt: time.Now()})
+    diariesMutex.Unlock()
+    withEntry, _ := cityPage("nj")
+    if withEntry.key == edited.key || !bytes.Contains(withEntry.html, []byte("夜游秦淮河")) {
+        t.Fatal("发布日记条目后页面没有更新")
+    }
+}
+
+func TestParsePagination(t *testing.T) {
+    tests := []struct {
+        query       string
+        wantPage    int
+        wantPerPage int
+        wantOK      bool
+    }{
+        {"", 1, 10, true},
+        {"page=3&per_page=100", 3, 100, true},
+        {"per_page=1", 1, 1, true},
+        {"page=0", 0, 0, false},
+        {"page=-1", 0, 0, false},
+        {"page=abc", 0, 0, false},
+        {"per_page=0", 0, 0, false},
+        {"per_page=101", 0, 0, false},
+    }
+    for _, tt := range tests {
+        q, _ := url.ParseQuery(tt.query)
+        page, perPage, ok := parsePagination(q)
+        if page != tt.wantPage || perPage != tt.wantPerPage || ok != tt.wantOK {
+            t.Errorf("%q: 得到 (%d, %d, %v)，期望 (%d, %d, %v)", tt.query, page, perPage, ok, tt.wantPage, tt.wantPerPage, tt.wantOK)
+        }
+    }
+}
+
+func TestDiaryAdminHandlers(t *testing.T) {
+    t.Chdir(t.TempDir())
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Admin.Tokens = map[string]string{"alice": "tok123"}
+    })
+    diariesMutex.Lock()
+    savedDiaries := diaries
+    diaries = diaryStore{NextID: 1, Revisions: make(map[int][]DiaryRevision)}
+    diariesMutex.Unlock()
+    t.Cleanup(func() {
+        diariesMutex.Lock()
+        diaries = savedDiaries
+        diariesMutex.Unlock()
+        for id := 1; id <= 3; id++ {
+            removeSearchDoc(fmt.Sprintf("entry:%d", id))
+        }
+    })
+
+    call := func(handler http.HandlerFunc, method, path, token, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("Accept", "application/json")
+        if token != "" {
+            req.Header.Set("X-Admin-Token", token)
+        }
+        rec := httptest.NewRecorder()
+        handler(rec, req)
+        return rec
+    }
+    decode := func(rec *httptest.ResponseRecorder, v interface{}) {
+        t.Helper()
+        if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+            t.Fatalf("无法解析响应 %q: %v", rec.Body.String(), err)
+        }
+    }
+
+    if rec := call(serveAdminDiaries, http.MethodPost, "/admin/diaries", "", `{"city":"nj","title":"x"}`); rec.Code != http.StatusUnauthorized {
+        t.Fatalf("未带令牌状态码 %d，期望 401", rec.Code)
+    }
+    invalid := []struct {
+        name string
+        body string
+        want string
+    }{
+        {"无效 JSON", `{"city":`, "无效的请求体"},
+        {"未知城市", `{"city":"xx","title":"x"}`, "未知的城市"},
+        {"空标题", `{"city":"nj","title":"  "}`, "标题不能为空"},
+        {"日期格式", `{"city":"nj","title":"x","start_date":"2024-5-1"}`, "日期格式"},
+        {"日期颠倒", `{"city":"nj","title":"x","start_date":"2024-05-03","end_date":"2024-05-01"}`, "结束日期不能早于开始日期"},
+        {"未知状态", `{"city":"nj","title":"x","status":"archived"}`, "状态只能是"},
+    }
+    for _, tt := range invalid {
+        rec := call(serveAdminDiaries, http.MethodPost, "/admin/diaries", "tok123", tt.body)
+        if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+            t.Errorf("%s: 状态码 %d，响应 %q，期望 400 和 %q", tt.name, rec.Code, rec.Body.String(), tt.want)
+        }
+    }
+
+    rec := call(serveAdminDiaries, http.MethodPost, "/admin/diaries", "tok123",
+        `{"city":"nj","title":" 草稿 ","body":"未完待续","start_date":"2024-05-01","end_date":"2024-05-03","tags":["美食"," 美食 ",""]}`)
+    if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/admin/diaries/1" {
+        t.Fatalf("创建草稿状态码 %d，Location %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+    }
+    var draft DiaryEntry
+    decode(rec, &draft)
+    if draft.Status != "draft" || draft.Revision != 1 || draft.Title != "草稿" || draft.Author != "alice" || len(draft.Tags) != 1 {
+        t.Fatalf("草稿内容错误: %+v", draft)
+    }
+    rec = call(serveAdminDiaries, http.MethodPost, "/admin/diaries", "tok123", `{"city":"nj","title":"夫子庙","status":"published"}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("创建已发布日记状态码 %d", rec.Code)
+    }
+
+    // 公开接口看不到草稿
+    var list struct {
+        Entries []DiaryEntry `json:"entries"`
+        Total   int          `json:"total"`
+    }
+    decode(call(serveDiaryList, http.MethodGet, "/api/diaries?city=nj", "", ""), &list)
+    if list.Total != 1 || len(list.Entries) != 1 || list.Entries[0].ID != 2 {
+        t.Fatalf("公开列表应只有已发布的日记: %+v", list)
+    }
+    if rec := call(serveDiary, http.MethodGet, "/api/diaries/1", "", ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("公开接口读取草稿状态码 %d，期望 404", rec.Code)
+    }
+    if rec := call(serveDiary, http.MethodGet, "/api/diaries/2", "", ""); rec.Code != http.StatusOK {
+        t.Fatalf("公开接口读取已发布日记状态码 %d", rec.Code)
+    }
+    decode(call(serveAdminDiaries, http.MethodGet, "/admin/diaries", "tok123", ""), &list)
+    if list.Total != 2 {
+        t.Fatalf("管理列表应包含草稿，共 %d 篇", list.Total)
+    }
+
+    // 分页参数越界
+    if rec := call(serveDiaryList, http.MethodGet, "/api/diaries?per_page=101", "", ""); rec.Code != http.StatusBadRequest {
+        t.Errorf("per_page=101 状态码 %d，期望 400", rec.Code)
+    }
+    if rec := call(serveAdminDiaries, http.MethodGet, "/admin/diaries?page=0", "tok123", ""); rec.Code != http.StatusBadRequest {
+        t.Errorf("page=0 状态码 %d，期望 400", rec.Code)
+    }
+    decode(call(serveAdminDiaries, http.MethodGet, "/admin/diaries?page=5&per_page=1", "tok123", ""), &list)
+    if list.Total != 2 || len(list.Entries) != 0 {
+        t.Errorf("超出范围的页应为空: %+v", list)
+    }
+
+    // 修改递增版本号，校验失败时不改动
+    if rec := call(serveAdminDiary, http.MethodPut, "/admin/diaries/1", "tok123", `{"city":"nj","title":"草稿","status":"hidden"}`); rec.Code != http.StatusBadRequest {
+        t.Fatalf("无效状态的修改状态码 %d，期望 400", rec.Code)
+    }
+    rec = call(serveAdminDiary, http.MethodPut, "/admin/diaries/1", "tok123", `{"city":"nj","title":"秦淮夜游","status":"published"}`)
+    var updated DiaryEntry
+    decode(rec, &updated)
+    if rec.Code != http.StatusOK || updated.Revision != 2 || updated.Status != "published" || !updated.UpdatedAt.After(draft.UpdatedAt) {
+        t.Fatalf("修改后状态码 %d，内容 %+v", rec.Code, updated)
+    }
+    var revisions []DiaryRevision
+    decode(call(serveAdminDiary, http.MethodGet, "/admin/diaries/1/revisions", "tok123", ""), &revisions)
+    if len(revisions) != 2 || revisions[0].Revision != 1 || revisions[1].Revision != 2 || revisions[0].Entry.Title != "草稿" {
+        t.Fatalf("历史版本错误: %+v", revisions)
+    }
+    if rec := call(serveAdminDiary, http.MethodPut, "/admin/diaries/9", "tok123", `{"city":"nj","title":"x"}`); rec.Code != http.StatusNotFound {
+        t.Errorf("修改不存在的日记状态码 %d，期望 404", rec.Code)
+    }
+    if rec := call(serveDiary, http.MethodGet, "/api/diaries/1", "", ""); rec.Code != http.StatusOK {
+        t.Fatalf("发布后公开接口状态码 %d", rec.Code)
+    }
+
+    if rec := call(serveAdminDiary, http.MethodDelete, "/admin/diaries/1", "tok123", ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("删除状态码 %d", rec.Code)
+    }
+    if rec := call(serveDiary, http.MethodGet, "/api/diaries/1", "", ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("删除后公开接口状态码 %d，期望 404", rec.Code)
+    }
+    if _, err := os.Stat("diary_entries.json"); err != nil {
+        t.Fatalf("日记记录没有保存: %v", err)
+    }
+}
+
+// stubChannel 记录收到的通知，设置 block 时每次发送都等待它关闭
+type stubChannel struct {
+    name  string
+    block chan struct{}
+    sent  chan []commentEvent
+}
+
+func (c *stubChannel) Name() string {
+    return c.name
+}
+
+func (c *stubChannel) Send(events []commentEvent, digest bool) error {
+    if c.block != nil {
+        <-c.block
+    }
+    c.sent <- events
+    return nil
+}
+
+func TestNotifierSlowChannelDoesNotBlockOthers(t *testing.T) {
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Notify.QueueSize = 8
+    })
+    slow := &stubChannel{name: "slow", block: make(chan struct{}), sent: make(chan []commentEvent, 8)}
+    fast := &stubChannel{name: "fast", sent: make(chan []commentEvent, 8)}
+    other := &stubChannel{name: "other", sent: make(chan []commentEvent, 8)}
+    queue := make(chan commentEvent, 8)
+    go runNotifier(queue, []*notifySubscription{
+        {channel: slow},
+        {channel: fast},
+        // 只订阅广州的渠道收不到南京的留言
+        {channel: other, cities: []string{"gz"}},
+    })
+    defer close(queue)
+
+    queue <- commentEvent{City: "nj", ID: 1}
+    queue <- commentEvent{City: "nj", ID: 2}
+    for want := 1; want <= 2; want++ {
+        select {
+        case events := <-fast.sent:
+            if len(events) != 1 || events[0].ID != want {
+                t.Fatalf("快速渠道收到 %+v，期望留言 #%d", events, want)
+            }
+        case <-time.After(2 * time.Second):
+            t.Fatal("慢渠道阻塞了其他渠道的投递")
+        }
+    }
+
+    close(slow.block)
+    for want := 1; want <= 2; want++ {
+        select {
+        case events := <-slow.sent:
+            if events[0].ID != want {
+                t.Fatalf("慢渠道收到留言 #%d，期望 #%d", events[0].ID, want)
+            }
+        case <-time.After(2 * time.Second):
+            t.Fatal("慢渠道放行后没有收到通知")
+        }
+    }
+    select {
+    case events := <-other.sent:
+        t.Fatalf("未订阅的城市也发送了通知: %+v", events)
+    default:
+    }
+}
+
+func TestCommentAttachments(t *testing.T) {
+    t.Chdir(t.TempDir())
+    uploads := t.TempDir()
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Admin.Tokens = map[string]string{"alice": "tok123"}
+        cfg.Challenge.Enabled = false
+        cfg.Identity.Enabled = false
+        cfg.Attachments.Dir = uploads
+        cfg.Attachments.MaxImages = 2
+        cfg.Images.CacheDir = t.TempDir()
+    })
+    slots := imageResizeSlots
+    imageResizeSlots = make(chan struct{}, 1)
+    commentsMutex.Lock()
+    savedComments := comments
+    comments = make(map[string][]Comment)
+    commentsMutex.Unlock()
+    t.Cleanup(func() {
+        imageResizeSlots = slots
+        commentsMutex.Lock()
+        comments = savedComments
+        commentsMutex.Unlock()
+        removeSearchDoc("comment:nj:1")
+    })
+
+    var photo bytes.Buffer
+    png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+    gif := append([]byte("GIF89a"), make([]byte, 32)...)
+    post := func(text string, files ...[]byte) *httptest.ResponseRecorder {
+        var body bytes.Buffer
+        mw := multipart.NewWriter(&body)
+        mw.WriteField("nick", "旅人")
+        mw.WriteField("text", text)
+        for i, data := range files {
+            part, _ := mw.CreateFormFile("image", fmt.Sprintf("%d.png", i))
+            part.Write(data)
+        }
+        mw.Close()
+        req := httptest.NewRequest(http.MethodPost, "/comments/nj", &body)
+        req.Header.Set("Content-Type", mw.FormDataContentType())
+        req.Header.Set("Accept", "application/json")
+        rec := httptest.NewRecorder()
+        serveComments(rec, req)
+        return rec
+    }
+    list := func(token string) []Comment {
+        req := httptest.NewRequest(http.MethodGet, "/comments/nj", nil)
+        if token != "" {
+            req.Header.Set("X-Admin-Token", token)
+        }
+        rec := httptest.NewRecorder()
+        serveComments(rec, req)
+        var got []Comment
+        json.Unmarshal(rec.Body.Bytes(), &got)
+        return got
+    }
+    admin := func(method, path string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, nil)
+        req.Header.Set("X-Admin-Token", "tok123")
+        rec := httptest.NewRecorder()
+        serveAdminComments(rec, req)
+        return rec
+    }
+    files := func() []string {
+        entries, _ := os.ReadDir(uploads)
+        var names []string
+        for _, e := range entries {
+            names = append(names, e.Name())
+        }
+        return names
+    }
+
+    // 不是 JPEG/PNG 的文件和超出数量的图片都被拒绝，不留下文件
+    if rec := post("动图", gif); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "只支持 JPEG 和 PNG 图片") {
+        t.Fatalf("GIF 状态码 %d: %s", rec.Code, rec.Body.String())
+    }
+    if rec := post("三张", photo.Bytes(), photo.Bytes(), photo.Bytes()); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "最多附带 2 张图片") {
+        t.Fatalf("超出数量状态码 %d: %s", rec.Code, rec.Body.String())
+    }
+    if rec := post("", gif, photo.Bytes()); rec.Code != http.StatusBadRequest {
+        t.Fatalf("第二张合法时仍应拒绝，状态码 %d", rec.Code)
+    }
+    if names := files(); len(names) != 0 {
+        t.Fatalf("被拒绝的留言留下了文件: %v", names)
+    }
+
+    // 带图留言进入待审核，返回 202 并立即保存
+    rec := post("夫子庙的夜景", photo.Bytes())
+    if rec.Code != http.StatusAccepted {
+        t.Fatalf("带图留言状态码 %d: %s", rec.Code, rec.Body.String())
+    }
+    var created Comment
+    json.Unmarshal(rec.Body.Bytes(), &created)
+    if !created.Pending || len(created.Images) != 1 || created.Text != "夫子庙的夜景" || created.Nick != "旅人" {
+        t.Fatalf("留言内容错误: %+v", created)
+    }
+    name := created.Images[0].Name
+    if !commentImagePattern.MatchString(name) || created.Images[0].URL != "/comments/nj/images/"+name {
+        t.Fatalf("图片信息错误: %+v", created.Images[0])
+    }
+    if _, err := os.Stat(filepath.Join(uploads, name)); err != nil {
+        t.Fatalf("图片没有保存: %v", err)
+    }
+    saved, err := os.ReadFile("comments.json")
+    if err != nil || !bytes.Contains(saved, []byte(name)) {
+        t.Fatalf("带图留言没有立即保存: %v", err)
+    }
+    if got := list(""); len(got) != 0 {
+        t.Fatalf("待审核的留言对访客可见: %+v", got)
+    }
+    if got := list("tok123"); len(got) != 1 || !got[0].Pending {
+        t.Fatalf("管理员看不到待审核的留言: %+v", got)
+    }
+    var pending map[string][]Comment
+    json.Unmarshal(admin(http.MethodGet, "/admin/comments/").Body.Bytes(), &pending)
+    if len(pending["nj"]) != 1 {
+        t.Fatalf("待审核列表错误: %+v", pending)
+    }
+
+    if rec := admin(http.MethodPost, "/admin/comments/nj/9/approve"); rec.Code != http.StatusNotFound {
+        t.Errorf("通过不存在的留言状态码 %d", rec.Code)
+    }
+    if rec := admin(http.MethodPost, "/admin/comments/nj/1/approve"); rec.Code != http.StatusOK {
+        t.Fatalf("通过留言状态码 %d", rec.Code)
+    }
+    if got := list(""); len(got) != 1 || got[0].Pending {
+        t.Fatalf("通过后访客看不到留言: %+v", got)
+    }
+
+    if rec := admin(http.MethodDelete, "/admin/comments/nj/1"); rec.Code != http.StatusNoContent {
+        t.Fatalf("删除留言状态码 %d", rec.Code)
+    }
+    if _, err := os.Stat(filepath.Join(uploads, name)); !os.IsNotExist(err) {
+        t.Fatalf("删除留言后图片仍然存在: %v", err)
+    }
+    if got := list("tok123"); len(got) != 0 {
+        t.Fatalf("删除后仍有留言: %+v", got)
+    }
+}
+
+func TestSweepCommentImages(t *testing.T) {
+    uploads := t.TempDir()
+    withServerConfig(t, func(cfg *ServerConfig) {
+        cfg.Attachments.Dir = uploads
+    })
+    commentsMutex.Lock()
+    savedComments := comments
+    comments = map[string][]Comment{"nj": {{ID: 1, Images: []CommentImage{{Name: "aaaaaaaaaaaaaaaaaaaaaaaa.jpg"}}}}}
+    commentsMutex.Unlock()
+    t.Cleanup(func() {
+        commentsMutex.Lock()
+        comments = savedComments
+        commentsMutex.Unlock()
+    })
+    for _, name := range []string{"aaaaaaaaaaaaaaaaaaaaaaaa.jpg", "bbbbbbbbbbbbbbbbbbbbbbbb.png", "notes.txt"} {
+        os.WriteFile(filepath.Join(uploads, name), []byte("x"), 0600)
+    }
+    sweepCommentImages()
+    for name, want := range map[string]bool{
+        "aaaaaaaaaaaaaaaaaaaaaaaa.jpg": true,
+        "bbbbbbbbbbbbbbbbbbbbbbbb.png": false,
+        // 不是留言图片命名格式的文件不动
+        "notes.txt": true,
+    } {
+        _, err := os.Stat(filepath.Join(uploads, name))
+        if exists := err == nil; exists != want {
+            t.Errorf("%s 存在=%v，期望 %v", name, exists, want)
+        }
+    }
+}